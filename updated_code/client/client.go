@@ -1,9 +1,14 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"time"
 
 	"../internal"
 	"../lib/support/client"
@@ -15,6 +20,10 @@ import (
 
 var server * rpc.ServerRemote
 
+const UPLOAD_CHUNK_SIZE = 500000 // in bytes, at most the server's MAX_UPLOAD_CHUNK
+const DOWNLOAD_CHUNK_SIZE = 500000 // in bytes, at most the server's MAX_DOWNLOAD_CHUNK
+const TRANSFER_RETRIES = 3 // times to reconnect during an upload or download before giving up
+
 func main() {
 
 	if len(os.Args) != 2 {
@@ -24,7 +33,7 @@ func main() {
 
 	server = rpc.NewServerRemote(os.Args[1])
 
-	var success string
+	var success internal.AuthReturn
 
 	// authenticate user based on cookie value sent to server
 	err := server.Call("authenticate", &success, getCookie())
@@ -33,18 +42,18 @@ func main() {
 		return
 	}
 
-	c := Client{server}
+	c := Client{server: server}
 
 	// check if authentication is success, spawn appropriate CLI
-	if (strings.Contains(success, "false")) {
-		if strings.Contains(success, "session expired"){
+	if success.Err.Code != internal.OK {
+		if errors.Is(success.Err, internal.ErrSessionExpired) {
 			fmt.Println("session expired")
 		}
 		// launches seperate login REPL before RunCLI REPL
 		launchREPLs()
 	} else {
 		// goes straight to RunCLI REPL
-		fmt.Println("logged in, welcome " + success)
+		fmt.Println("logged in, welcome " + success.Username)
 		err := client.RunCLI(&c)
 		if err != nil {
 			fmt.Printf("fatal error: %v\n", err)
@@ -53,8 +62,13 @@ func main() {
 	}
 }
 
+// Client implements client.Client by calling the server. Errors reported by
+// the server are returned as internal.Error values, which callers can check
+// with errors.Is (e.g. errors.Is(err, internal.ErrNotFound)); errors talking
+// to the server itself are returned as fatal errors.
 type Client struct {
-	server *rpc.ServerRemote
+	server  *rpc.ServerRemote
+	pending string // token of a login waiting for its two-factor code
 }
 
 /*
@@ -65,7 +79,7 @@ type Client struct {
  * Returns: none
  */
 func launchREPLs() {
-	c := Client{server}
+	c := Client{server: server}
 	fmt.Println("please log in: \"login <username> <password>\" or sign up: \"signup <username> <password>\"")
 	// login REPL
 	client.RunAuth(&c)
@@ -106,6 +120,21 @@ func getCookie() string {
 	return cookie
 }
 
+/*
+ * deviceLabel() - gets a label for this device to tell its session apart from
+ *					the user's sessions on other devices
+ *
+ * Parameters: none
+ * Returns: a string representing the device
+ */
+func deviceLabel() string {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		return "unknown"
+	}
+	return hostname
+}
+
 /*
  * Delete() - calls deleteHandler in server to delete user
  *
@@ -115,14 +144,14 @@ func getCookie() string {
  * Returns: an error if request malfunctions
  */
 func (c *Client) Delete() (err error) {
-	var ret string
+	var ret internal.Error
 	// sends cookie as argument to handler
 	err = c.server.Call("delete", &ret, getCookie())
 	if err != nil {
 		return client.MakeFatalError(err)
 	}
-	if ret != "" {
-		return fmt.Errorf(ret)
+	if ret.Code != internal.OK {
+		return ret
 	}
 	fmt.Println("successfully deleted account")
 	// relaunch login REPL for new login
@@ -139,14 +168,14 @@ func (c *Client) Delete() (err error) {
  * Returns: an error if request malfunctions
  */
 func (c *Client) LogOut() (err error) {
-	var ret string
+	var ret internal.Error
 	// sends cookie as argument to handler
 	err = c.server.Call("logout", &ret, getCookie())
 	if err != nil {
 		return client.MakeFatalError(err)
 	}
-	if ret != "" {
-		return fmt.Errorf(ret)
+	if ret.Code != internal.OK {
+		return ret
 	}
 	fmt.Println("logged out")
 	// relaunch login REPL for new login
@@ -163,14 +192,14 @@ func (c *Client) LogOut() (err error) {
  * Returns: an error if request malfunctions
  */
 func (c *Client) SignUp(username string, password string) (err error) {
-	var ret string
+	var ret internal.Error
 	// sends username and passwords as arguments to handler
 	err = c.server.Call("signup", &ret, username, password)
 	if err != nil {
 		return client.MakeFatalError(err)
 	}
-	if ret != "" {
-		return fmt.Errorf(ret)
+	if ret.Code != internal.OK {
+		return ret
 	}
 	fmt.Println("signup successful, please log in or sign up another user")
 	return nil
@@ -186,23 +215,118 @@ func (c *Client) SignUp(username string, password string) (err error) {
  * Returns: an error if request malfunctions
  */
 func (c *Client) LogIn(username string, password string) (err error) {
-	var ret string
-	// sends username and passwords as arguments to handler
-	err = c.server.Call("login", &ret, username, password)
+	var ret internal.LoginReturn
+	// sends username, password and a label for this device as arguments to handler
+	err = c.server.Call("login", &ret, username, password, deviceLabel())
 	if err != nil {
 		return client.MakeFatalError(err)
 	}
-	if !strings.Contains(ret, "cookie:") {
-		return fmt.Errorf(ret)
+	if errors.Is(ret.Err, internal.ErrTwoFactorRequired) {
+		// keep the pending login for LogInCode
+		c.pending = ret.Pending
+		return client.ErrCodeRequired
 	}
-	// gets cookie from return value, writes it to bin as cookie.txt file
-	ret = strings.TrimPrefix(ret, "cookie:")
+	if ret.Err.Code != internal.OK {
+		return ret.Err
+	}
+	saveCookie(ret.Cookie)
+	fmt.Println("logged in")
+	return nil
+}
+
+/*
+ * LogInCode() - calls loginCodeHandler in server to finish a login that needs a
+ *					two-factor code, if successful sets up cookie on client side
+ *
+ * Preconditions: LogIn returned client.ErrCodeRequired
+ * Postconditions: cookie is validated for session on server-side and sent back
+ * Parameters: a string representing the code or recovery code
+ * Returns: an error if request malfunctions
+ */
+func (c *Client) LogInCode(code string) (err error) {
+	if c.pending == "" {
+		return errors.New("log in with your username and password first")
+	}
+	var ret internal.LoginReturn
+	// sends the pending login and the code as arguments to handler
+	err = c.server.Call("login_code", &ret, c.pending, code)
+	if err != nil {
+		return client.MakeFatalError(err)
+	}
+	if ret.Err.Code != internal.OK {
+		// a wrong code can be tried again, unless the pending login is gone
+		if errors.Is(ret.Err, internal.ErrUnauthenticated) || errors.Is(ret.Err, internal.ErrSessionExpired) {
+			c.pending = ""
+		}
+		return ret.Err
+	}
+	c.pending = ""
+	saveCookie(ret.Cookie)
+	fmt.Println("logged in")
+	return nil
+}
+
+/*
+ * saveCookie() - writes the cookie of a new session to bin as cookie.txt file
+ *
+ * Parameters: cookie: a string representing the cookie
+ * Returns: nothing
+ */
+func saveCookie(cookie string) {
 	dir, _ := filepath.Abs(filepath.Dir(os.Args[0]))
-	err2 := ioutil.WriteFile(dir + "/cookie.txt", []byte(ret), 0777)
-	if err2 != nil {
+	err := ioutil.WriteFile(dir + "/cookie.txt", []byte(cookie), 0777)
+	if err != nil {
 		fmt.Print(err)
 	}
-	fmt.Println("logged in")
+}
+
+/*
+ * ChangePassword() - calls changePasswordHandler in server to change the user's
+ *					password
+ *
+ * Preconditions: user calling has cookie to be validated by server
+ * Postconditions: password changed on server-side, sessions on other devices
+ *					are invalidated
+ * Parameters: a string representing the current password, and a string
+ *					representing the new password
+ * Returns: an error if request malfunctions
+ */
+func (c *Client) ChangePassword(oldPassword, newPassword string) (err error) {
+	var ret internal.Error
+	// sends cookie, old and new passwords as arguments to handler
+	err = c.server.Call("change_password", &ret, getCookie(), oldPassword, newPassword)
+	if err != nil {
+		return client.MakeFatalError(err)
+	}
+	if ret.Code != internal.OK {
+		return ret
+	}
+	fmt.Println("password changed, other devices were logged out")
+	return nil
+}
+
+/*
+ * ResetPassword() - calls resetPasswordHandler in server to set a new password
+ *					with a reset token from an admin
+ *
+ * Preconditions: none
+ * Postconditions: password changed on server-side, all sessions of the user are
+ *					invalidated, no cookie generated yet
+ * Parameters: a string representing the username, a string representing the
+ *					reset token, and a string representing the new password
+ * Returns: an error if request malfunctions
+ */
+func (c *Client) ResetPassword(username, token, newPassword string) (err error) {
+	var ret internal.Error
+	// sends username, token and new password as arguments to handler
+	err = c.server.Call("reset_password", &ret, username, token, newPassword)
+	if err != nil {
+		return client.MakeFatalError(err)
+	}
+	if ret.Code != internal.OK {
+		return ret
+	}
+	fmt.Println("password reset, please log in")
 	return nil
 }
 
@@ -215,15 +339,85 @@ func (c *Client) LogIn(username string, password string) (err error) {
  * Returns: an error if request malfunctions
  */
 func (c *Client) Upload(path string, body []byte) (err error) {
-	var ret string
+	var ret internal.Error
 	// sends cookie, path, and byte array body as arguments to handler
 	err = c.server.Call("upload", &ret, getCookie(), path, body)
 	// rest of code given by TA's
 	if err != nil {
 		return client.MakeFatalError(err)
 	}
-	if ret != "" {
-		return fmt.Errorf(ret)
+	if ret.Code != internal.OK {
+		return ret
+	}
+	return nil
+}
+
+/*
+ * UploadFrom() - uploads a file in chunks through the upload_begin, upload_chunk
+ * 					and upload_commit handlers in server, resuming an earlier
+ * 					unfinished upload of the same file to the same path
+ *
+ * Preconditions: user calling has cookie to be validated by server
+ * Postconditions: r has been read to the end
+ * Parameters: a string representing the path to upload, and the contents to upload
+ * Returns: an error if request malfunctions
+ */
+func (c *Client) UploadFrom(path string, r io.ReadSeeker) (err error) {
+	// hash the file first, the server checks it when the upload is committed
+	h := sha256.New()
+	size, err := io.Copy(h, r)
+	if err != nil {
+		return err
+	}
+	hash := hex.EncodeToString(h.Sum(nil))
+
+	var ret internal.UploadReturn
+	err = c.server.Call("upload_begin", &ret, getCookie(), path, size, hash)
+	if err != nil {
+		return client.MakeFatalError(err)
+	}
+	if ret.Err.Code != internal.OK {
+		return ret.Err
+	}
+	id := ret.ID
+	offset := ret.Offset
+
+	buf := make([]byte, UPLOAD_CHUNK_SIZE)
+	for offset < size {
+		_, err = r.Seek(offset, io.SeekStart)
+		if err != nil {
+			return err
+		}
+		n, err := io.ReadFull(r, buf)
+		if n == 0 {
+			return fmt.Errorf("file changed while uploading: %v", err)
+		}
+
+		// if the connection drops, ask the server (over a new connection) how
+		// much it received and continue from there
+		ret = internal.UploadReturn{}
+		err = c.server.Call("upload_chunk", &ret, getCookie(), id, offset, buf[:n])
+		for retries := 1; err != nil; retries++ {
+			if retries > TRANSFER_RETRIES {
+				return client.MakeFatalError(err)
+			}
+			time.Sleep(time.Duration(retries) * time.Second)
+			ret = internal.UploadReturn{}
+			err = c.server.Call("upload_status", &ret, getCookie(), id)
+		}
+		if ret.Err.Code != internal.OK {
+			return ret.Err
+		}
+		offset = ret.Offset
+	}
+
+	var ret2 internal.Error
+	err = c.server.Call("upload_commit", &ret2, getCookie(), id, hash)
+	if err != nil {
+		return client.MakeFatalError(err)
+	}
+	if ret2.Code != internal.OK {
+		return ret2
 	}
 	return nil
 }
@@ -244,12 +438,73 @@ func (c *Client) Download(path string) (body []byte, err error) {
 	if err != nil {
 		return nil, client.MakeFatalError(err)
 	}
-	if ret.Err != "" {
-		return nil, fmt.Errorf(ret.Err)
+	if ret.Err.Code != internal.OK {
+		return nil, ret.Err
 	}
 	return ret.Body, nil
 }
 
+/*
+ * DownloadTo() - calls downloadRangeHandler in server to download a file in
+ * 					pieces, writing each piece to w as it arrives
+ *
+ * Preconditions: user calling has cookie to be validated by server
+ * Postconditions: none
+ * Parameters: a string representing the path to download, and where to write it
+ * Returns: an error if request malfunctions
+ */
+func (c *Client) DownloadTo(path string, w io.Writer) (err error) {
+	return c.ResumeDownloadTo(path, 0, w)
+}
+
+/*
+ * ResumeDownloadTo() - like DownloadTo(), but starts offset bytes into the file
+ *
+ * Preconditions: user calling has cookie to be validated by server
+ * Postconditions: none
+ * Parameters: a string representing the path to download, the number of bytes
+ *			already downloaded, and where to write the rest
+ * Returns: an error if request malfunctions
+ */
+func (c *Client) ResumeDownloadTo(path string, offset int64, w io.Writer) (err error) {
+	var mod_time int64
+	for first := true; ; first = false {
+		// if the connection drops, retry the same piece over a new connection
+		var ret internal.RangeReturn
+		err = c.server.Call("download_range", &ret, getCookie(), path, offset, int64(DOWNLOAD_CHUNK_SIZE))
+		for retries := 1; err != nil; retries++ {
+			if retries > TRANSFER_RETRIES {
+				return client.MakeFatalError(err)
+			}
+			time.Sleep(time.Duration(retries) * time.Second)
+			ret = internal.RangeReturn{}
+			err = c.server.Call("download_range", &ret, getCookie(), path, offset, int64(DOWNLOAD_CHUNK_SIZE))
+		}
+		if ret.Err.Code != internal.OK {
+			return ret.Err
+		}
+
+		// pieces of different versions of the file must not be mixed
+		if first {
+			mod_time = ret.ModTime
+		} else if ret.ModTime != mod_time {
+			return fmt.Errorf("file changed on the server while downloading")
+		}
+
+		if len(ret.Body) == 0 {
+			return nil
+		}
+		_, err = w.Write(ret.Body)
+		if err != nil {
+			return err
+		}
+		offset += int64(len(ret.Body))
+		if offset == ret.Size {
+			return nil
+		}
+	}
+}
+
 /*
  * List() - calls listHandler in server to list directory contents
  *
@@ -266,8 +521,8 @@ func (c *Client) List(path string) (entries []client.DirEnt, err error) {
 	if err != nil {
 		return nil, client.MakeFatalError(err)
 	}
-	if ret.Err != "" {
-		return nil, fmt.Errorf(ret.Err)
+	if ret.Err.Code != internal.OK {
+		return nil, ret.Err
 	}
 	var ents []client.DirEnt
 	for _, e := range ret.Entries {
@@ -276,6 +531,28 @@ func (c *Client) List(path string) (entries []client.DirEnt, err error) {
 	return ents, nil
 }
 
+/*
+ * Stat() - calls statHandler in server to get the metadata of a file or directory
+ *
+ * Preconditions: user calling has cookie to be validated by server
+ * Postconditions: none
+ * Parameters: a string representing the path to get metadata of
+ * Returns: a directory entry with size, modification time and hash if successful,
+ *			and an error if request malfunctions
+ */
+func (c *Client) Stat(path string) (entry client.DirEnt, err error) {
+	var ret internal.StatReturn
+	// sends cookie, path as arguments to handler
+	err = c.server.Call("stat", &ret, getCookie(), path)
+	if err != nil {
+		return nil, client.MakeFatalError(err)
+	}
+	if ret.Err.Code != internal.OK {
+		return nil, ret.Err
+	}
+	return ret.Entry, nil
+}
+
 /*
  * Mkdir() - calls mkdirHandler in server to make a directory in a given path
  *
@@ -285,14 +562,14 @@ func (c *Client) List(path string) (entries []client.DirEnt, err error) {
  * Returns: an error if request malfunctions
  */
 func (c *Client) Mkdir(path string) (err error) {
-	var ret string
+	var ret internal.Error
 	// sends cookie, path as arguments to handler
 	err = c.server.Call("mkdir", &ret, getCookie(), path)
 	if err != nil {
 		return client.MakeFatalError(err)
 	}
-	if ret != "" {
-		return fmt.Errorf(ret)
+	if ret.Code != internal.OK {
+		return ret
 	}
 	return nil
 }
@@ -306,14 +583,79 @@ func (c *Client) Mkdir(path string) (err error) {
  * Returns: an error if request malfunctions
  */
 func (c *Client) Remove(path string) (err error) {
-	var ret string
+	var ret internal.Error
 	// sends cookie, path as arguments to handler
 	err = c.server.Call("remove", &ret, getCookie(), path)
 	if err != nil {
 		return client.MakeFatalError(err)
 	}
-	if ret != "" {
-		return fmt.Errorf(ret)
+	if ret.Code != internal.OK {
+		return ret
+	}
+	return nil
+}
+
+/*
+ * RemoveAll() - calls removeAllHandler in server to remove a file or directory tree
+ *
+ * Preconditions: user calling has cookie to be validated by server
+ * Postconditions: none
+ * Parameters: a string representing the path to remove, and a boolean which is true
+ *			to only list what would be removed
+ * Returns: the paths removed (or that would be) if successful, and an error if
+ *			request malfunctions
+ */
+func (c *Client) RemoveAll(path string, dryRun bool) (paths []string, err error) {
+	var ret internal.RemoveAllReturn
+	// sends cookie, path, dry run flag as arguments to handler
+	err = c.server.Call("remove_all", &ret, getCookie(), path, dryRun)
+	if err != nil {
+		return nil, client.MakeFatalError(err)
+	}
+	if ret.Err.Code != internal.OK {
+		return nil, ret.Err
+	}
+	return ret.Paths, nil
+}
+
+/*
+ * Move() - calls moveHandler in server to move or rename a file or directory
+ *
+ * Preconditions: user calling has cookie to be validated by server
+ * Postconditions: none
+ * Parameters: a string representing the path to move, and the path to move it to
+ * Returns: an error if request malfunctions
+ */
+func (c *Client) Move(src, dst string) (err error) {
+	var ret internal.Error
+	// sends cookie, both paths as arguments to handler
+	err = c.server.Call("move", &ret, getCookie(), src, dst)
+	if err != nil {
+		return client.MakeFatalError(err)
+	}
+	if ret.Code != internal.OK {
+		return ret
+	}
+	return nil
+}
+
+/*
+ * Copy() - calls copyHandler in server to copy a file or directory
+ *
+ * Preconditions: user calling has cookie to be validated by server
+ * Postconditions: none
+ * Parameters: a string representing the path to copy, and the path to copy it to
+ * Returns: an error if request malfunctions
+ */
+func (c *Client) Copy(src, dst string) (err error) {
+	var ret internal.Error
+	// sends cookie, both paths as arguments to handler
+	err = c.server.Call("copy", &ret, getCookie(), src, dst)
+	if err != nil {
+		return client.MakeFatalError(err)
+	}
+	if ret.Code != internal.OK {
+		return ret
 	}
 	return nil
 }
@@ -334,8 +676,8 @@ func (c *Client) PWD() (path string, err error) {
 	if err != nil {
 		return "", client.MakeFatalError(err)
 	}
-	if ret.Err != "" {
-		return "", fmt.Errorf(ret.Err)
+	if ret.Err.Code != internal.OK {
+		return "", ret.Err
 	}
 	return ret.Path, nil
 }
@@ -349,29 +691,332 @@ func (c *Client) PWD() (path string, err error) {
  * Returns: an error if request malfunctions
  */
 func (c *Client) CD(path string) (err error) {
-	var ret string
+	var ret internal.Error
 	// sends cookie, path as arguments to handler
 	err = c.server.Call("cd", &ret, getCookie(), path)
 	if err != nil {
 		return client.MakeFatalError(err)
 	}
-	if ret != "" {
-		return fmt.Errorf(ret)
+	if ret.Code != internal.OK {
+		return ret
 	}
 	return nil
 }
 
-// not implemented, we are in cs 166
+/*
+ * Share() - calls shareHandler in server to share a file with another user
+ *
+ * Preconditions: user calling has cookie to be validated by server
+ * Postconditions: the sharee can reach the file as "~<owner>/<path>"
+ * Parameters: a string representing the path of the file, a string representing the
+ *			sharee's username, and a bool which is true for a read/write share
+ * Returns: an error if request malfunctions
+ */
 func (c *Client) Share(path, username string, write bool) (err error) {
-	return client.ErrNotImplemented
+	var ret internal.Error
+	// sends cookie, path, sharee and permission as arguments to handler
+	err = c.server.Call("share", &ret, getCookie(), path, username, write)
+	if err != nil {
+		return client.MakeFatalError(err)
+	}
+	if ret.Code != internal.OK {
+		return ret
+	}
+	return nil
 }
 
-// not implemented, we are in cs 166
+/*
+ * RemoveShare() - calls removeShareHandler in server to stop sharing a file
+ *
+ * Preconditions: user calling has cookie to be validated by server
+ * Postconditions: none
+ * Parameters: a string representing the path of the file, and a string representing
+ *			the sharee's username, or empty to remove all shares on the file
+ * Returns: an error if request malfunctions
+ */
 func (c *Client) RemoveShare(path, username string) (err error) {
-	return client.ErrNotImplemented
+	var ret internal.Error
+	// sends cookie, path, sharee as arguments to handler
+	err = c.server.Call("rm_share", &ret, getCookie(), path, username)
+	if err != nil {
+		return client.MakeFatalError(err)
+	}
+	if ret.Code != internal.OK {
+		return ret
+	}
+	return nil
 }
 
-// not implemented, we are in cs 166
+/*
+ * GetShares() - calls getSharesHandler in server to list the shares on a file
+ *
+ * Preconditions: user calling has cookie to be validated by server
+ * Postconditions: none
+ * Parameters: a string representing the path of the file
+ * Returns: an array of shares if successful, and an error if request malfunctions
+ */
 func (c *Client) GetShares(path string) (shares []client.Share, err error) {
-	return nil, client.ErrNotImplemented
+	var ret internal.SharesReturn
+	// sends cookie, path as arguments to handler
+	err = c.server.Call("get_shares", &ret, getCookie(), path)
+	if err != nil {
+		return nil, client.MakeFatalError(err)
+	}
+	if ret.Err.Code != internal.OK {
+		return nil, ret.Err
+	}
+	for _, s := range ret.Shares {
+		shares = append(shares, s)
+	}
+	return shares, nil
+}
+
+/*
+ * ListSessions() - calls listSessionsHandler in server to list the user's sessions
+ *
+ * Preconditions: user calling has cookie to be validated by server
+ * Postconditions: none
+ * Parameters: none
+ * Returns: an array of sessions if successful, and an error if request malfunctions
+ */
+func (c *Client) ListSessions() (sessions []client.Session, err error) {
+	var ret internal.SessionsReturn
+	// sends cookie as argument to handler
+	err = c.server.Call("list_sessions", &ret, getCookie())
+	if err != nil {
+		return nil, client.MakeFatalError(err)
+	}
+	if ret.Err.Code != internal.OK {
+		return nil, ret.Err
+	}
+	for _, s := range ret.Sessions {
+		sessions = append(sessions, s)
+	}
+	return sessions, nil
+}
+
+/*
+ * ListVersions() - calls listVersionsHandler in server to list the old versions of a file
+ *
+ * Preconditions: user calling has cookie to be validated by server
+ * Postconditions: none
+ * Parameters: a string representing the path of the file
+ * Returns: an array of versions if successful, and an error if request malfunctions
+ */
+func (c *Client) ListVersions(path string) (versions []client.Version, err error) {
+	var ret internal.VersionsReturn
+	// sends cookie, path as arguments to handler
+	err = c.server.Call("list_versions", &ret, getCookie(), path)
+	if err != nil {
+		return nil, client.MakeFatalError(err)
+	}
+	if ret.Err.Code != internal.OK {
+		return nil, ret.Err
+	}
+	for _, v := range ret.Versions {
+		versions = append(versions, v)
+	}
+	return versions, nil
+}
+
+/*
+ * RestoreVersion() - calls restoreVersionHandler in server to bring back an old version of a file
+ *
+ * Preconditions: user calling has cookie to be validated by server
+ * Postconditions: the file has the contents of the version, its previous contents are a new version
+ * Parameters: a string representing the path of the file, and the version number as listed by ListVersions
+ * Returns: an error if request malfunctions
+ */
+func (c *Client) RestoreVersion(path string, version int) (err error) {
+	var ret internal.Error
+	// sends cookie, path, version as arguments to handler
+	err = c.server.Call("restore_version", &ret, getCookie(), path, version)
+	if err != nil {
+		return client.MakeFatalError(err)
+	}
+	if ret.Code != internal.OK {
+		return ret
+	}
+	return nil
+}
+
+/*
+ * TrashList() - calls trashListHandler in server to list the user's removed files
+ *
+ * Preconditions: user calling has cookie to be validated by server
+ * Postconditions: none
+ * Parameters: none
+ * Returns: an array of trash entries if successful, and an error if request malfunctions
+ */
+func (c *Client) TrashList() (entries []client.TrashEnt, err error) {
+	var ret internal.TrashReturn
+	// sends cookie as argument to handler
+	err = c.server.Call("trash_list", &ret, getCookie())
+	if err != nil {
+		return nil, client.MakeFatalError(err)
+	}
+	if ret.Err.Code != internal.OK {
+		return nil, ret.Err
+	}
+	for _, t := range ret.Entries {
+		entries = append(entries, t)
+	}
+	return entries, nil
+}
+
+/*
+ * TrashRestore() - calls trashRestoreHandler in server to move a removed file back
+ *
+ * Preconditions: user calling has cookie to be validated by server
+ * Postconditions: the entry is no longer in the trash
+ * Parameters: a string representing the id of the entry as listed by TrashList, and
+ *			a string representing the path to restore to, or "" for its old path
+ * Returns: an error if request malfunctions
+ */
+func (c *Client) TrashRestore(id, path string) (err error) {
+	var ret internal.Error
+	// sends cookie, id, path as arguments to handler
+	err = c.server.Call("trash_restore", &ret, getCookie(), id, path)
+	if err != nil {
+		return client.MakeFatalError(err)
+	}
+	if ret.Code != internal.OK {
+		return ret
+	}
+	return nil
+}
+
+/*
+ * TrashEmpty() - calls trashEmptyHandler in server to delete the user's removed files for good
+ *
+ * Preconditions: user calling has cookie to be validated by server
+ * Postconditions: the trash is empty
+ * Parameters: none
+ * Returns: an error if request malfunctions
+ */
+func (c *Client) TrashEmpty() (err error) {
+	var ret internal.Error
+	// sends cookie as argument to handler
+	err = c.server.Call("trash_empty", &ret, getCookie())
+	if err != nil {
+		return client.MakeFatalError(err)
+	}
+	if ret.Code != internal.OK {
+		return ret
+	}
+	return nil
+}
+
+/*
+ * Usage() - calls usageHandler in server to get the user's storage usage
+ *
+ * Preconditions: user calling has cookie to be validated by server
+ * Postconditions: none
+ * Parameters: none
+ * Returns: the usage, the largest directories, and an error if request malfunctions
+ */
+func (c *Client) Usage() (usage client.Usage, largest []client.DirUsage, err error) {
+	var ret internal.UsageReturn
+	// sends cookie as argument to handler
+	err = c.server.Call("usage", &ret, getCookie())
+	if err != nil {
+		return nil, nil, client.MakeFatalError(err)
+	}
+	if ret.Err.Code != internal.OK {
+		return nil, nil, ret.Err
+	}
+	for _, d := range ret.Largest {
+		largest = append(largest, d)
+	}
+	return ret.Usage, largest, nil
+}
+
+/*
+ * RevokeSession() - calls revokeSessionHandler in server to log out another device
+ *
+ * Preconditions: user calling has cookie to be validated by server
+ * Postconditions: the session with the given id is invalidated on server-side
+ * Parameters: a string representing the id of the session, as listed by ListSessions
+ * Returns: an error if request malfunctions
+ */
+func (c *Client) RevokeSession(id string) (err error) {
+	var ret internal.Error
+	// sends cookie, session id as arguments to handler
+	err = c.server.Call("revoke_session", &ret, getCookie(), id)
+	if err != nil {
+		return client.MakeFatalError(err)
+	}
+	if ret.Code != internal.OK {
+		return ret
+	}
+	return nil
+}
+
+/*
+ * EnableTwoFactor() - calls totpEnableHandler in server to get a new two-factor
+ *					secret
+ *
+ * Preconditions: user calling has cookie to be validated by server
+ * Postconditions: the secret is stored on server-side, but not used until verified
+ * Parameters: none
+ * Returns: a string representing the secret, a string representing its
+ *					provisioning URI, and an error if request malfunctions
+ */
+func (c *Client) EnableTwoFactor() (secret, uri string, err error) {
+	var ret internal.TwoFactorReturn
+	// sends cookie as argument to handler
+	err = c.server.Call("totp_enable", &ret, getCookie())
+	if err != nil {
+		return "", "", client.MakeFatalError(err)
+	}
+	if ret.Err.Code != internal.OK {
+		return "", "", ret.Err
+	}
+	return ret.Secret, ret.URI, nil
+}
+
+/*
+ * VerifyTwoFactor() - calls totpConfirmHandler in server to turn on two-factor
+ *					authentication
+ *
+ * Preconditions: user calling has cookie to be validated by server, and
+ *					EnableTwoFactor was called
+ * Postconditions: logins of the user need a code from now on
+ * Parameters: a string representing a code made from the new secret
+ * Returns: a slice of strings representing the recovery codes, and an error if
+ *					request malfunctions
+ */
+func (c *Client) VerifyTwoFactor(code string) (recoveryCodes []string, err error) {
+	var ret internal.RecoveryCodesReturn
+	// sends cookie, code as arguments to handler
+	err = c.server.Call("totp_confirm", &ret, getCookie(), code)
+	if err != nil {
+		return nil, client.MakeFatalError(err)
+	}
+	if ret.Err.Code != internal.OK {
+		return nil, ret.Err
+	}
+	return ret.Codes, nil
+}
+
+/*
+ * DisableTwoFactor() - calls totpDisableHandler in server to turn off two-factor
+ *					authentication
+ *
+ * Preconditions: user calling has cookie to be validated by server
+ * Postconditions: logins of the user only need the password again
+ * Parameters: a string representing a code or recovery code
+ * Returns: an error if request malfunctions
+ */
+func (c *Client) DisableTwoFactor(code string) (err error) {
+	var ret internal.Error
+	// sends cookie, code as arguments to handler
+	err = c.server.Call("totp_disable", &ret, getCookie(), code)
+	if err != nil {
+		return client.MakeFatalError(err)
+	}
+	if ret.Code != internal.OK {
+		return ret
+	}
+	return nil
 }
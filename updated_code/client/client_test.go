@@ -12,7 +12,7 @@ import (
 func TestFromClient(t *testing.T) {
 
 	server = rpc.NewServerRemote("localhost:8080")
-	c := Client{server}
+	c := Client{server: server}
 
 	client.TestClient(t, &c)
     
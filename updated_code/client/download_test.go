@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"../internal"
+	"../lib/support/rpc"
+)
+
+// what the fake server serves to download_range, changed by the tests
+var fake_mtx sync.Mutex
+var fake_file []byte
+var fake_mod_time int64
+var fake_calls int
+var fake_change_after int // calls after which the file changes, 0 for never
+
+var fake_once sync.Once
+var fake_server *rpc.ServerRemote
+
+// fakeDownloadRange serves fake_file like the server's downloadRangeHandler
+func fakeDownloadRange(cookie string, path string, offset int64, length int64) internal.RangeReturn {
+	fake_mtx.Lock()
+	defer fake_mtx.Unlock()
+	fake_calls++
+	if fake_change_after != 0 && fake_calls > fake_change_after {
+		fake_mod_time = 2
+	}
+	if path != "f.txt" {
+		return internal.RangeReturn{Err: internal.NewError(internal.NotFound, "coud not read specified file")}
+	}
+	ret := internal.RangeReturn{Size: int64(len(fake_file)), ModTime: fake_mod_time}
+	if offset > int64(len(fake_file)) {
+		ret.Err = internal.NewError(internal.InvalidArgument, "range is outside of the file")
+		return ret
+	}
+	end := offset + length
+	if end > int64(len(fake_file)) {
+		end = int64(len(fake_file))
+	}
+	ret.Body = fake_file[offset:end]
+	return ret
+}
+
+// fakeClient gets a Client talking to a server which only has download_range,
+// serving data
+func fakeClient(t *testing.T, data string, change_after int) *Client {
+	fake_once.Do(func() {
+		l, err := net.Listen("tcp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := l.Addr().String()
+		l.Close()
+		rpc.RegisterHandler("download_range", fakeDownloadRange)
+		rpc.RegisterFinalizer(func() {})
+		go rpc.RunServer(addr)
+		for i := 0; i < 50; i++ {
+			if c, err := net.Dial("tcp4", addr); err == nil {
+				c.Close()
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		fake_server = rpc.NewServerRemote(addr)
+	})
+
+	fake_mtx.Lock()
+	fake_file = []byte(data)
+	fake_mod_time = 1
+	fake_calls = 0
+	fake_change_after = change_after
+	fake_mtx.Unlock()
+	return &Client{server: fake_server}
+}
+
+func TestDownloadTo(t *testing.T) {
+	data := strings.Repeat("0123456789", DOWNLOAD_CHUNK_SIZE / 10 * 5 / 2)
+	c := fakeClient(t, data, 0)
+
+	var b bytes.Buffer
+	err := c.DownloadTo("f.txt", &b)
+	if err != nil || b.String() != data {
+		t.Errorf("DownloadTo() = %v with %v bytes, want nil with %v", err, b.Len(), len(data))
+	}
+	fake_mtx.Lock()
+	calls := fake_calls
+	fake_mtx.Unlock()
+	if calls != 3 {
+		t.Errorf("DownloadTo() made %v calls, want 3 pieces", calls)
+	}
+
+	// resuming only fetches the rest
+	c = fakeClient(t, data, 0)
+	b.Reset()
+	err = c.ResumeDownloadTo("f.txt", DOWNLOAD_CHUNK_SIZE + 5, &b)
+	if err != nil || b.String() != data[DOWNLOAD_CHUNK_SIZE + 5:] {
+		t.Errorf("ResumeDownloadTo() = %v with %v bytes, want nil with %v", err, b.Len(), len(data) - DOWNLOAD_CHUNK_SIZE - 5)
+	}
+	c = fakeClient(t, data, 0)
+	b.Reset()
+	err = c.ResumeDownloadTo("f.txt", int64(len(data)), &b)
+	if err != nil || b.Len() != 0 {
+		t.Errorf("ResumeDownloadTo() at the end = %v with %v bytes, want nil with none", err, b.Len())
+	}
+
+	// empty files and errors from the server
+	c = fakeClient(t, "", 0)
+	b.Reset()
+	if err = c.DownloadTo("f.txt", &b); err != nil || b.Len() != 0 {
+		t.Errorf("DownloadTo() of an empty file = %v with %v bytes, want nil with none", err, b.Len())
+	}
+	if err = c.DownloadTo("missing.txt", &b); !errors.Is(err, internal.ErrNotFound) {
+		t.Errorf("DownloadTo() of a missing file = %v, want ErrNotFound", err)
+	}
+	c = fakeClient(t, "short", 0)
+	if err = c.ResumeDownloadTo("f.txt", 10, &b); !errors.Is(err, internal.ErrInvalidArgument) {
+		t.Errorf("ResumeDownloadTo() past the end = %v, want ErrInvalidArgument", err)
+	}
+}
+
+func TestDownloadToFileChanged(t *testing.T) {
+	// pieces of two versions of a file are never put together
+	data := strings.Repeat("0123456789", DOWNLOAD_CHUNK_SIZE / 10 * 5 / 2)
+	c := fakeClient(t, data, 1)
+	var b bytes.Buffer
+	err := c.DownloadTo("f.txt", &b)
+	if err == nil {
+		t.Errorf("DownloadTo() of a file which changed = nil, want an error")
+	}
+	if b.Len() != DOWNLOAD_CHUNK_SIZE {
+		t.Errorf("DownloadTo() wrote %v bytes, want only the first piece", b.Len())
+	}
+}
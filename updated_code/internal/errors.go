@@ -0,0 +1,81 @@
+package internal
+
+// Every server method reports failure with an Error instead of a free-form
+// string. Callers decide what to do based on its Code, never on its Message,
+// so messages can be reworded without breaking anybody. On the client side an
+// Error is an ordinary Go error which can be checked with errors.Is against
+// the Err* values below.
+
+// ErrorCode identifies the kind of failure. Codes are sent over the wire,
+// so existing values must never be renumbered; add new ones at the end.
+type ErrorCode int
+
+const (
+	OK                 ErrorCode = iota // No error
+	Internal                            // The server failed to carry out a valid request
+	Unauthenticated                     // The cookie does not belong to any session
+	SessionExpired                      // The cookie belongs to a session which has expired
+	InvalidCredentials                  // Wrong username or password
+	PermissionDenied                    // The user may not perform this action
+	NotFound                            // The path, user, share or session does not exist
+	AlreadyExists                       // The username or path is already taken
+	InvalidPath                         // The path or name is malformed or not allowed
+	InvalidArgument                     // Some other argument is malformed
+	QuotaExceeded                       // A storage or directory limit would be exceeded
+	WeakPassword                        // The password does not meet the requirements
+	RateLimited                         // Too many failed logins, wait before trying again
+	AccountLocked                       // The account is locked after too many failed logins
+	SignupLimited                       // Too many signups from the client's address
+	TwoFactorRequired                   // The password was right, a two-factor code is needed as well
+)
+
+// Error is returned by server methods, either on its own or in
+// the Err field of their return type. The zero value (Code OK)
+// means that no error was encountered.
+type Error struct {
+	Code    ErrorCode
+	Message string   // Human readable description, for display only
+	Details []string // Every reason the request failed, if there can be several (e.g. WeakPassword)
+}
+
+// NewError returns an Error with the given code and message.
+func NewError(code ErrorCode, message string) Error {
+	return Error{Code: code, Message: message}
+}
+
+// Error implements the error interface.
+func (e Error) Error() string { return e.Message }
+
+// Is reports whether target is an Error with the same code, which
+// makes errors.Is(err, internal.ErrNotFound) and friends work.
+func (e Error) Is(target error) bool {
+	t, ok := target.(Error)
+	return ok && t.Code == e.Code
+}
+
+// Err returns e as an error, or nil if e's code is OK.
+func (e Error) Err() error {
+	if e.Code == OK {
+		return nil
+	}
+	return e
+}
+
+// Values to compare errors returned by the client against with errors.Is.
+var (
+	ErrInternal           = NewError(Internal, "internal server error")
+	ErrUnauthenticated    = NewError(Unauthenticated, "not authenticated")
+	ErrSessionExpired     = NewError(SessionExpired, "session expired")
+	ErrInvalidCredentials = NewError(InvalidCredentials, "invalid username or password")
+	ErrPermissionDenied   = NewError(PermissionDenied, "permission denied")
+	ErrNotFound           = NewError(NotFound, "not found")
+	ErrAlreadyExists      = NewError(AlreadyExists, "already exists")
+	ErrInvalidPath        = NewError(InvalidPath, "invalid path")
+	ErrInvalidArgument    = NewError(InvalidArgument, "invalid argument")
+	ErrQuotaExceeded      = NewError(QuotaExceeded, "quota exceeded")
+	ErrWeakPassword       = NewError(WeakPassword, "password too weak")
+	ErrRateLimited        = NewError(RateLimited, "too many attempts")
+	ErrAccountLocked      = NewError(AccountLocked, "account locked")
+	ErrSignupLimited      = NewError(SignupLimited, "too many signups")
+	ErrTwoFactorRequired  = NewError(TwoFactorRequired, "two-factor code required")
+)
@@ -0,0 +1,92 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// every code and the value to check it against, in order
+var errValues = []Error{
+	ErrInternal,
+	ErrUnauthenticated,
+	ErrSessionExpired,
+	ErrInvalidCredentials,
+	ErrPermissionDenied,
+	ErrNotFound,
+	ErrAlreadyExists,
+	ErrInvalidPath,
+	ErrInvalidArgument,
+	ErrQuotaExceeded,
+	ErrWeakPassword,
+	ErrRateLimited,
+	ErrAccountLocked,
+	ErrSignupLimited,
+	ErrTwoFactorRequired,
+}
+
+// roundTrip sends an Error the way the rpc library does, with gob
+func roundTrip(t *testing.T, e Error) Error {
+	var b bytes.Buffer
+	err := gob.NewEncoder(&b).Encode(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Error
+	err = gob.NewDecoder(&b).Decode(&got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestErrorCodes(t *testing.T) {
+	// codes are sent over the wire, so they must never be renumbered
+	for i, want := range errValues {
+		if want.Code != ErrorCode(i+1) {
+			t.Errorf("%q has code %v, want %v", want.Message, want.Code, i+1)
+		}
+	}
+}
+
+func TestErrorIs(t *testing.T) {
+	for _, want := range errValues {
+		// what the server returns, as the client gets it
+		got := roundTrip(t, NewError(want.Code, "some message"))
+		for _, other := range errValues {
+			if is := errors.Is(got, other); is != (other.Code == want.Code) {
+				t.Errorf("errors.Is(%v error, %q) = %v", want.Code, other.Message, is)
+			}
+		}
+		if wrapped := fmt.Errorf("upload: %w", got); !errors.Is(wrapped, want) {
+			t.Errorf("errors.Is(wrapped %v error, %q) = false, want true", want.Code, want.Message)
+		}
+		if got.Message != "some message" || got.Error() != "some message" {
+			t.Errorf("message of %v error = %q, want %q", want.Code, got.Message, "some message")
+		}
+	}
+	if errors.Is(fmt.Errorf("not found"), ErrNotFound) {
+		t.Errorf("errors.Is(other error, ErrNotFound) = true, want false")
+	}
+}
+
+func TestErrorErr(t *testing.T) {
+	if err := (Error{}).Err(); err != nil {
+		t.Errorf("Error{}.Err() = %v, want nil", err)
+	}
+	if err := roundTrip(t, Error{}).Err(); err != nil {
+		t.Errorf("Err() of a sent Error{} = %v, want nil", err)
+	}
+	err := NewError(QuotaExceeded, "too big").Err()
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("errors.Is(NewError(QuotaExceeded).Err(), ErrQuotaExceeded) = false, want true")
+	}
+
+	// every reason a request failed survives the trip
+	e := Error{Code: WeakPassword, Message: "weak", Details: []string{"too short", "no digit"}}
+	if got := roundTrip(t, e); fmt.Sprint(got.Details) != fmt.Sprint(e.Details) {
+		t.Errorf("Details = %v after sending, want %v", got.Details, e.Details)
+	}
+}
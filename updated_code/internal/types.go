@@ -3,6 +3,8 @@
 
 package internal
 
+import "time"
+
 // EXAMPLE CODE
 //
 // This code is meant as an example of how to use
@@ -16,13 +18,19 @@ package internal
 // use the type once it gets the method's return
 // value). Thus, put it here in this shared library.
 type DirEnt struct {
-	IsDir_ bool   // True if the entry is a directory; false if it is a file
-	Name_  string // Name of the entry
+	IsDir_   bool   // True if the entry is a directory; false if it is a file
+	Name_    string // Name of the entry
+	Size_    int64  // Size in bytes
+	ModTime_ int64  // Modification time in Unix nanoseconds
+	Hash_    string // Hex encoded SHA-256 of the contents; empty for directories
 }
 
 // DirEnt implements the client.DirEnt interface.
-func (d DirEnt) IsDir() bool  { return d.IsDir_ }
-func (d DirEnt) Name() string { return d.Name_ }
+func (d DirEnt) IsDir() bool        { return d.IsDir_ }
+func (d DirEnt) Name() string       { return d.Name_ }
+func (d DirEnt) Size() int64        { return d.Size_ }
+func (d DirEnt) ModTime() time.Time { return time.Unix(0, d.ModTime_) }
+func (d DirEnt) Hash() string       { return d.Hash_ }
 
 // This type is returned by a method on the server,
 // so it has to be accessible from both the server
@@ -31,7 +39,27 @@ func (d DirEnt) Name() string { return d.Name_ }
 // value). Thus, put it here in this shared library.
 type ListReturn struct {
 	Entries []DirEnt
-	Err     string // If no error was encountered, this will be empty
+	Err     Error // If no error was encountered, its Code will be OK
+}
+
+// This type is returned by a method on the server,
+// so it has to be accessible from both the server
+// (so it can return it) and the client (so it can
+// use the type once it gets the method's return
+// value). Thus, put it here in this shared library.
+type RemoveAllReturn struct {
+	Paths []string // Paths removed (or that would be), each directory before its contents
+	Err   Error    // If no error was encountered, its Code will be OK
+}
+
+// This type is returned by a method on the server,
+// so it has to be accessible from both the server
+// (so it can return it) and the client (so it can
+// use the type once it gets the method's return
+// value). Thus, put it here in this shared library.
+type StatReturn struct {
+	Entry DirEnt
+	Err   Error // If no error was encountered, its Code will be OK
 }
 
 // This type is returned by a method on the server,
@@ -41,7 +69,7 @@ type ListReturn struct {
 // value). Thus, put it here in this shared library.
 type PWDReturn struct {
 	Path string
-	Err  string // If no error was encountered, this will be empty
+	Err  Error // If no error was encountered, its Code will be OK
 }
 
 // This type is returned by a method on the server,
@@ -51,5 +79,234 @@ type PWDReturn struct {
 // value). Thus, put it here in this shared library.
 type DownloadReturn struct {
 	Body []byte
-	Err  string // If no error was encountered, this will be empty
+	Err  Error // If no error was encountered, its Code will be OK
+}
+
+// This type is returned by a method on the server,
+// so it has to be accessible from both the server
+// (so it can return it) and the client (so it can
+// use the type once it gets the method's return
+// value). Thus, put it here in this shared library.
+type RangeReturn struct {
+	Body    []byte
+	Size    int64 // Size of the whole file in bytes
+	ModTime int64 // Modification time of the file in Unix nanoseconds
+	Err     Error // If no error was encountered, its Code will be OK
+}
+
+// This type is returned by a method on the server,
+// so it has to be accessible from both the server
+// (so it can return it) and the client (so it can
+// use the type once it gets the method's return
+// value). Thus, put it here in this shared library.
+type UploadReturn struct {
+	ID     string // Identifies the upload in later calls
+	Offset int64  // Number of bytes received so far, where the next chunk starts
+	Err    Error  // If no error was encountered, its Code will be OK
+}
+
+// This type is returned by a method on the server,
+// so it has to be accessible from both the server
+// (so it can return it) and the client (so it can
+// use the type once it gets the method's return
+// value). Thus, put it here in this shared library.
+type Share struct {
+	Sharee_    string // Username of the user the file is shared with
+	WritePerm_ bool   // True if the share is read/write; false if read-only
+}
+
+// Share implements the client.Share interface.
+func (s Share) Sharee() string  { return s.Sharee_ }
+func (s Share) WritePerm() bool { return s.WritePerm_ }
+
+// This type is returned by a method on the server,
+// so it has to be accessible from both the server
+// (so it can return it) and the client (so it can
+// use the type once it gets the method's return
+// value). Thus, put it here in this shared library.
+type SharesReturn struct {
+	Shares []Share
+	Err    Error // If no error was encountered, its Code will be OK
+}
+
+// This type is returned by a method on the server,
+// so it has to be accessible from both the server
+// (so it can return it) and the client (so it can
+// use the type once it gets the method's return
+// value). Thus, put it here in this shared library.
+type Session struct {
+	ID_      string // Short id of the session, used to revoke it
+	Device_  string // Label of the device the session was created on
+	Created_ int64  // Creation time in Unix nanoseconds (0 if unknown)
+	Expires_ int64  // Expiration time in Unix nanoseconds
+	Current_ bool   // True if this is the session making the request
+}
+
+// Session implements the client.Session interface.
+func (s Session) ID() string     { return s.ID_ }
+func (s Session) Device() string { return s.Device_ }
+func (s Session) Created() time.Time {
+	if s.Created_ == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, s.Created_)
+}
+func (s Session) Expires() time.Time { return time.Unix(0, s.Expires_) }
+func (s Session) Current() bool      { return s.Current_ }
+
+// This type is returned by a method on the server,
+// so it has to be accessible from both the server
+// (so it can return it) and the client (so it can
+// use the type once it gets the method's return
+// value). Thus, put it here in this shared library.
+type SessionsReturn struct {
+	Sessions []Session
+	Err      Error // If no error was encountered, its Code will be OK
+}
+
+// This type is returned by a method on the server,
+// so it has to be accessible from both the server
+// (so it can return it) and the client (so it can
+// use the type once it gets the method's return
+// value). Thus, put it here in this shared library.
+type Version struct {
+	Version_ int    // Version number, used to restore it
+	Size_    int64  // Size in bytes
+	ModTime_ int64  // Modification time of the contents in Unix nanoseconds
+	Saved_   int64  // Time the contents were replaced in Unix nanoseconds
+	Hash_    string // Hex encoded SHA-256 of the contents
+}
+
+// Version implements the client.Version interface.
+func (v Version) Version() int        { return v.Version_ }
+func (v Version) Size() int64         { return v.Size_ }
+func (v Version) ModTime() time.Time  { return time.Unix(0, v.ModTime_) }
+func (v Version) Replaced() time.Time { return time.Unix(0, v.Saved_) }
+func (v Version) Hash() string        { return v.Hash_ }
+
+// This type is returned by a method on the server,
+// so it has to be accessible from both the server
+// (so it can return it) and the client (so it can
+// use the type once it gets the method's return
+// value). Thus, put it here in this shared library.
+type VersionsReturn struct {
+	Versions []Version
+	Err      Error // If no error was encountered, its Code will be OK
+}
+
+// This type is returned by a method on the server,
+// so it has to be accessible from both the server
+// (so it can return it) and the client (so it can
+// use the type once it gets the method's return
+// value). Thus, put it here in this shared library.
+type TrashEnt struct {
+	ID_      string // Id of the entry, used to restore it
+	Path_    string // Path the entry was removed from
+	IsDir_   bool   // True if the entry is a directory; false if it is a file
+	Size_    int64  // Size in bytes (of all files, for a directory)
+	Removed_ int64  // Removal time in Unix nanoseconds
+}
+
+// TrashEnt implements the client.TrashEnt interface.
+func (t TrashEnt) ID() string         { return t.ID_ }
+func (t TrashEnt) Path() string       { return t.Path_ }
+func (t TrashEnt) IsDir() bool        { return t.IsDir_ }
+func (t TrashEnt) Size() int64        { return t.Size_ }
+func (t TrashEnt) Removed() time.Time { return time.Unix(0, t.Removed_) }
+
+// This type is returned by a method on the server,
+// so it has to be accessible from both the server
+// (so it can return it) and the client (so it can
+// use the type once it gets the method's return
+// value). Thus, put it here in this shared library.
+type TrashReturn struct {
+	Entries []TrashEnt
+	Err     Error // If no error was encountered, its Code will be OK
+}
+
+// This type is returned by a method on the server,
+// so it has to be accessible from both the server
+// (so it can return it) and the client (so it can
+// use the type once it gets the method's return
+// value). Thus, put it here in this shared library.
+type Usage struct {
+	Used_     int64 // Bytes charged to the user, including old versions and trash
+	Limit_    int64 // Bytes the user may use
+	Files_    int   // Number of files in the user's root
+	Versions_ int64 // Bytes taken up by old versions of files
+	Trash_    int64 // Bytes taken up by removed files
+}
+
+// Usage implements the client.Usage interface.
+func (u Usage) Used() int64     { return u.Used_ }
+func (u Usage) Limit() int64    { return u.Limit_ }
+func (u Usage) Files() int      { return u.Files_ }
+func (u Usage) Versions() int64 { return u.Versions_ }
+func (u Usage) Trash() int64    { return u.Trash_ }
+
+// This type is returned by a method on the server,
+// so it has to be accessible from both the server
+// (so it can return it) and the client (so it can
+// use the type once it gets the method's return
+// value). Thus, put it here in this shared library.
+type DirUsage struct {
+	Path_ string // Path of the directory
+	Size_ int64  // Bytes taken up by the directory and everything in it
+}
+
+// DirUsage implements the client.DirUsage interface.
+func (d DirUsage) Path() string { return d.Path_ }
+func (d DirUsage) Size() int64  { return d.Size_ }
+
+// This type is returned by a method on the server,
+// so it has to be accessible from both the server
+// (so it can return it) and the client (so it can
+// use the type once it gets the method's return
+// value). Thus, put it here in this shared library.
+type UsageReturn struct {
+	Usage   Usage
+	Largest []DirUsage // Largest directories, largest first
+	Err     Error      // If no error was encountered, its Code will be OK
+}
+
+// This type is returned by a method on the server,
+// so it has to be accessible from both the server
+// (so it can return it) and the client (so it can
+// use the type once it gets the method's return
+// value). Thus, put it here in this shared library.
+type AuthReturn struct {
+	Username string
+	Err      Error // If no error was encountered, its Code will be OK
+}
+
+// This type is returned by a method on the server,
+// so it has to be accessible from both the server
+// (so it can return it) and the client (so it can
+// use the type once it gets the method's return
+// value). Thus, put it here in this shared library.
+type LoginReturn struct {
+	Cookie  string
+	Pending string // With a TwoFactorRequired error, the token to finish the login with login_code
+	Err     Error  // If no error was encountered, its Code will be OK
+}
+
+// This type is returned by a method on the server,
+// so it has to be accessible from both the server
+// (so it can return it) and the client (so it can
+// use the type once it gets the method's return
+// value). Thus, put it here in this shared library.
+type TwoFactorReturn struct {
+	Secret string // base32 encoded, for authenticator apps that cannot read the URI
+	URI    string // otpauth:// provisioning URI
+	Err    Error  // If no error was encountered, its Code will be OK
+}
+
+// This type is returned by a method on the server,
+// so it has to be accessible from both the server
+// (so it can return it) and the client (so it can
+// use the type once it gets the method's return
+// value). Thus, put it here in this shared library.
+type RecoveryCodesReturn struct {
+	Codes []string
+	Err   Error // If no error was encountered, its Code will be OK
 }
@@ -5,12 +5,20 @@ package client
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strconv"
 	"strings"
 )
 
+// downloadRecordSuffix is appended to the local path of a download to name
+// the file holding the hash of the remote file being downloaded, kept until
+// the download completes so "download -c" can tell whether the remote file
+// is still the one partly downloaded.
+const downloadRecordSuffix = ".download"
+
 // RunAuth accepts an already-authenticated Client, and runs a login
 // interface for the user, allowing the user to interact with the Client.
 //
@@ -50,6 +58,38 @@ func RunAuth(c Client) error {
 				break
 			}
 			err := c.LogIn(args[0], args[1])
+			if err != nil {
+				if isFatal(err) {
+					return err
+				}
+				if errors.Is(err, ErrCodeRequired) {
+					fmt.Println("enter the code from your authenticator app, or a recovery code: \"code <code>\"")
+					break
+				}
+				fmt.Printf("error logging in: %v\n", err)
+				break
+			}
+			return nil
+		// if user enters a new password with a reset token from an admin
+		case "reset":
+			if len(args) != 3 {
+				fmt.Printf("Usage: %v <username> <token> <new-password>\n", parts[0])
+				break
+			}
+			err := c.ResetPassword(args[0], args[1], args[2])
+			if err != nil {
+				if isFatal(err) {
+					return err
+				}
+				fmt.Printf("error resetting password: %v\n", err)
+			}
+		// if user enters the two-factor code of a login
+		case "code":
+			if len(args) != 1 {
+				fmt.Printf("Usage: %v <code>\n", parts[0])
+				break
+			}
+			err := c.LogInCode(args[0])
 			if err != nil {
 				if isFatal(err) {
 					return err
@@ -134,13 +174,14 @@ func RunCLI(c Client) error {
 				fmt.Printf("Usage: %v <localpath> <remotepath>\n", parts[0])
 				break
 			}
-			body, err := ioutil.ReadFile(args[0])
+			f, err := os.Open(args[0])
 			if err != nil {
 				fmt.Printf("error reading file: %v\n", err)
 				break
 			}
 
-			err = c.Upload(args[1], body)
+			err = c.UploadFrom(args[1], f)
+			f.Close()
 			if err != nil {
 				if isFatal(err) {
 					return err
@@ -148,11 +189,17 @@ func RunCLI(c Client) error {
 				fmt.Printf("error uploading: %v\n", err)
 			}
 		case "download":
+			resume := len(args) > 0 && args[0] == "-c"
+			if resume {
+				args = args[1:]
+			}
 			if len(args) != 2 {
-				fmt.Printf("Usage: %v <remotepath> <localpath>\n", parts[0])
+				fmt.Printf("Usage: %v [-c] <remotepath> <localpath>\n", parts[0])
 				break
 			}
-			body, err := c.Download(args[0])
+
+			// check the file exists before touching the local one
+			ent, err := c.Stat(args[0])
 			if err != nil {
 				if isFatal(err) {
 					return err
@@ -160,18 +207,64 @@ func RunCLI(c Client) error {
 				fmt.Printf("error downloading: %v\n", err)
 				break
 			}
+			if ent.IsDir() {
+				fmt.Printf("error downloading: %v is a directory\n", args[0])
+				break
+			}
 
-			err = ioutil.WriteFile(args[1], body, 0664)
+			// with -c, keep what an interrupted download already wrote, but
+			// only if it is part of the same remote file
+			record := args[1] + downloadRecordSuffix
+			flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+			if resume {
+				hash, err := ioutil.ReadFile(record)
+				local, err2 := os.Stat(args[1])
+				switch {
+				case err2 != nil:
+					// nothing downloaded yet
+				case err != nil:
+					fmt.Printf("no interrupted download of %v to %v, starting over\n", args[0], args[1])
+				case string(hash) != ent.Hash():
+					fmt.Printf("%v changed since the download was interrupted, starting over\n", args[0])
+				case local.Size() > ent.Size():
+					fmt.Printf("%v is larger than %v, starting over\n", args[1], args[0])
+				default:
+					flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+				}
+			}
+			err = ioutil.WriteFile(record, []byte(ent.Hash()), 0664)
+			if err != nil {
+				fmt.Printf("error writing file: %v\n", err)
+				break
+			}
+			f, err := os.OpenFile(args[1], flags, 0664)
+			if err != nil {
+				fmt.Printf("error writing file: %v\n", err)
+				break
+			}
+			fi, err := f.Stat()
 			if err != nil {
+				f.Close()
 				fmt.Printf("error writing file: %v\n", err)
 				break
 			}
+
+			err = c.ResumeDownloadTo(args[0], fi.Size(), f)
+			f.Close()
+			if err != nil {
+				if isFatal(err) {
+					return err
+				}
+				fmt.Printf("error downloading: %v\n", err)
+				break
+			}
+			os.Remove(record)
 		case "cat":
 			if len(args) != 1 {
 				fmt.Printf("Usage: %v <remotepath>\n", parts[0])
 				break
 			}
-			body, err := c.Download(args[0])
+			err := c.DownloadTo(args[0], os.Stdout)
 			if err != nil {
 				if isFatal(err) {
 					return err
@@ -179,11 +272,13 @@ func RunCLI(c Client) error {
 				fmt.Printf("error downloading: %v\n", err)
 				break
 			}
-
-			os.Stdout.Write(body)
 		case "ls":
+			long := len(args) > 0 && args[0] == "-l"
+			if long {
+				args = args[1:]
+			}
 			if len(args) != 0 && len(args) != 1 {
-				fmt.Printf("Usage: %v [<path>]\n", parts[0])
+				fmt.Printf("Usage: %v [-l] [<path>]\n", parts[0])
 				break
 			}
 			path := "."
@@ -199,7 +294,35 @@ func RunCLI(c Client) error {
 				break
 			}
 			for _, e := range ents {
-				fmt.Println(DirEntString(e))
+				if long {
+					fmt.Println(DirEntLongString(e))
+				} else {
+					fmt.Println(DirEntString(e))
+				}
+			}
+		case "stat":
+			if len(args) != 1 {
+				fmt.Printf("Usage: %v <path>\n", parts[0])
+				break
+			}
+			ent, err := c.Stat(args[0])
+			if err != nil {
+				if isFatal(err) {
+					return err
+				}
+				fmt.Printf("error getting info: %v\n", err)
+				break
+			}
+			kind := "file"
+			if ent.IsDir() {
+				kind = "directory"
+			}
+			fmt.Printf("name:     %v\n", ent.Name())
+			fmt.Printf("type:     %v\n", kind)
+			fmt.Printf("size:     %v\n", ent.Size())
+			fmt.Printf("modified: %v\n", ent.ModTime().Format("2006-01-02 15:04:05"))
+			if !ent.IsDir() {
+				fmt.Printf("sha256:   %v\n", ent.Hash())
 			}
 		case "mkdir":
 			if len(args) != 1 {
@@ -214,16 +337,65 @@ func RunCLI(c Client) error {
 				fmt.Printf("error making directory: %v\n", err)
 			}
 		case "rm":
+			// -n (dry run) only lists what -r would remove
+			recursive := len(args) > 0 && args[0] == "-r"
+			if recursive {
+				args = args[1:]
+			}
+			dryRun := recursive && len(args) > 0 && args[0] == "-n"
+			if dryRun {
+				args = args[1:]
+			}
 			if len(args) != 1 {
-				fmt.Printf("Usage: %v <path>\n", parts[0])
+				fmt.Printf("Usage: %v [-r [-n]] <path>\n", parts[0])
+				break
+			}
+			if !recursive {
+				err := c.Remove(args[0])
+				if err != nil {
+					if isFatal(err) {
+						return err
+					}
+					fmt.Printf("error removing: %v\n", err)
+				}
 				break
 			}
-			err := c.Remove(args[0])
+			paths, err := c.RemoveAll(args[0], dryRun)
 			if err != nil {
 				if isFatal(err) {
 					return err
 				}
 				fmt.Printf("error removing: %v\n", err)
+				break
+			}
+			if dryRun {
+				for _, p := range paths {
+					fmt.Println("would remove " + p)
+				}
+			}
+		case "mv":
+			if len(args) != 2 {
+				fmt.Printf("Usage: %v <src> <dst>\n", parts[0])
+				break
+			}
+			err := c.Move(args[0], args[1])
+			if err != nil {
+				if isFatal(err) {
+					return err
+				}
+				fmt.Printf("error moving: %v\n", err)
+			}
+		case "cp":
+			if len(args) != 2 {
+				fmt.Printf("Usage: %v <src> <dst>\n", parts[0])
+				break
+			}
+			err := c.Copy(args[0], args[1])
+			if err != nil {
+				if isFatal(err) {
+					return err
+				}
+				fmt.Printf("error copying: %v\n", err)
 			}
 		case "pwd":
 			if len(args) != 0 {
@@ -310,6 +482,193 @@ func RunCLI(c Client) error {
 			for _, s := range shares {
 				fmt.Println(ShareString(s))
 			}
+		case "sessions":
+			if len(args) != 0 {
+				fmt.Printf("Usage: %v\n", parts[0])
+				break
+			}
+			sessions, err := c.ListSessions()
+			if err != nil {
+				if isFatal(err) {
+					return err
+				}
+				fmt.Printf("error listing sessions: %v\n", err)
+				break
+			}
+			for _, s := range sessions {
+				fmt.Println(SessionString(s))
+			}
+		case "revoke_session":
+			if len(args) != 1 {
+				fmt.Printf("Usage: %v <id>\n", parts[0])
+				break
+			}
+			err := c.RevokeSession(args[0])
+			if err != nil {
+				if isFatal(err) {
+					return err
+				}
+				fmt.Printf("error revoking session: %v\n", err)
+			}
+		case "passwd":
+			if len(args) != 2 {
+				fmt.Printf("Usage: %v <old-password> <new-password>\n", parts[0])
+				break
+			}
+			err := c.ChangePassword(args[0], args[1])
+			if err != nil {
+				if isFatal(err) {
+					return err
+				}
+				fmt.Printf("error changing password: %v\n", err)
+			}
+		case "2fa":
+			switch {
+			case len(args) == 1 && args[0] == "enable":
+				secret, uri, err := c.EnableTwoFactor()
+				if err != nil {
+					if isFatal(err) {
+						return err
+					}
+					fmt.Printf("error enabling two-factor authentication: %v\n", err)
+					break
+				}
+				fmt.Println("add this account to your authenticator app with the URI")
+				fmt.Println("\t" + uri)
+				fmt.Println("or by entering the secret")
+				fmt.Println("\t" + secret)
+				fmt.Printf("then turn it on with \"%v verify <code>\" and a code it shows\n", parts[0])
+			case len(args) == 2 && args[0] == "verify":
+				codes, err := c.VerifyTwoFactor(args[1])
+				if err != nil {
+					if isFatal(err) {
+						return err
+					}
+					fmt.Printf("error verifying code: %v\n", err)
+					break
+				}
+				fmt.Println("two-factor authentication is on; keep these recovery codes somewhere")
+				fmt.Println("safe, each can be used once in place of a code:")
+				for _, code := range codes {
+					fmt.Println("\t" + code)
+				}
+			case len(args) == 2 && args[0] == "disable":
+				err := c.DisableTwoFactor(args[1])
+				if err != nil {
+					if isFatal(err) {
+						return err
+					}
+					fmt.Printf("error disabling two-factor authentication: %v\n", err)
+					break
+				}
+				fmt.Println("two-factor authentication is off")
+			default:
+				fmt.Printf("Usage: %v enable | %v verify <code> | %v disable <code>\n", parts[0], parts[0], parts[0])
+			}
+		case "versions":
+			if len(args) != 1 {
+				fmt.Printf("Usage: %v <path>\n", parts[0])
+				break
+			}
+			versions, err := c.ListVersions(args[0])
+			if err != nil {
+				if isFatal(err) {
+					return err
+				}
+				fmt.Printf("error listing versions: %v\n", err)
+				break
+			}
+			for _, v := range versions {
+				fmt.Println(VersionString(v))
+			}
+		case "restore":
+			if len(args) != 2 {
+				fmt.Printf("Usage: %v <path> <version>\n", parts[0])
+				break
+			}
+			version, err := strconv.Atoi(args[1])
+			if err != nil {
+				fmt.Printf("Usage: %v <path> <version>\n", parts[0])
+				break
+			}
+			err = c.RestoreVersion(args[0], version)
+			if err != nil {
+				if isFatal(err) {
+					return err
+				}
+				fmt.Printf("error restoring version: %v\n", err)
+			}
+		case "trash":
+			if len(args) != 0 {
+				fmt.Printf("Usage: %v\n", parts[0])
+				break
+			}
+			entries, err := c.TrashList()
+			if err != nil {
+				if isFatal(err) {
+					return err
+				}
+				fmt.Printf("error listing trash: %v\n", err)
+				break
+			}
+			for _, t := range entries {
+				fmt.Println(TrashEntString(t))
+			}
+		case "trash_restore":
+			if len(args) != 1 && len(args) != 2 {
+				fmt.Printf("Usage: %v <id> [<path>]\n", parts[0])
+				break
+			}
+			path := ""
+			if len(args) == 2 {
+				path = args[1]
+			}
+			err := c.TrashRestore(args[0], path)
+			if err != nil {
+				if isFatal(err) {
+					return err
+				}
+				fmt.Printf("error restoring from trash: %v\n", err)
+			}
+		case "trash_empty":
+			if len(args) != 0 {
+				fmt.Printf("Usage: %v\n", parts[0])
+				break
+			}
+			err := c.TrashEmpty()
+			if err != nil {
+				if isFatal(err) {
+					return err
+				}
+				fmt.Printf("error emptying trash: %v\n", err)
+			}
+		case "df", "quota":
+			if len(args) != 0 {
+				fmt.Printf("Usage: %v\n", parts[0])
+				break
+			}
+			usage, largest, err := c.Usage()
+			if err != nil {
+				if isFatal(err) {
+					return err
+				}
+				fmt.Printf("error getting usage: %v\n", err)
+				break
+			}
+			percent := 0.0
+			if usage.Limit() > 0 {
+				percent = 100 * float64(usage.Used()) / float64(usage.Limit())
+			}
+			fmt.Printf("used:     %v of %v bytes (%.1f%%)\n", usage.Used(), usage.Limit(), percent)
+			fmt.Printf("files:    %v\n", usage.Files())
+			fmt.Printf("versions: %v bytes\n", usage.Versions())
+			fmt.Printf("trash:    %v bytes\n", usage.Trash())
+			if len(largest) > 0 {
+				fmt.Println("largest directories:")
+				for _, d := range largest {
+					fmt.Printf("\t%10d %v\n", d.Size(), d.Path())
+				}
+			}
 		case "quit", "exit":
 			if len(args) != 0 {
 				fmt.Printf("Usage: %v\n", parts[0])
@@ -324,16 +683,32 @@ func RunCLI(c Client) error {
 			fmt.Println("Available commands:")
 			cmds := []string{
 				"upload <localpath> <remotepath>",
-				"download <remotepath> <localpath>",
+				"download [-c] <remotepath> <localpath>",
 				"cat <remotepath>",
-				"ls [<path>]",
+				"ls [-l] [<path>]",
+				"stat <path>",
 				"mkdir <path>",
-				"rm <path>",
+				"rm [-r [-n]] <path>",
+				"mv <src> <dst>",
+				"cp <src> <dst>",
 				"pwd",
 				"cd [<path>]",
 				"share [--write] <path> <username>",
 				"rm_share <path> [<username>]",
 				"show_shares <path>",
+				"sessions",
+				"revoke_session <id>",
+				"passwd <old-password> <new-password>",
+				"2fa enable",
+				"2fa verify <code>",
+				"2fa disable <code>",
+				"versions <path>",
+				"restore <path> <version>",
+				"trash",
+				"trash_restore <id> [<path>]",
+				"trash_empty",
+				"df",
+				"quota",
 				"quit",
 				"exit",
 				"help",
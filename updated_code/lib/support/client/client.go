@@ -10,6 +10,8 @@ package client
 import (
 	"errors"
 	"fmt"
+	"io"
+	"time"
 )
 
 // Client represents an authenticated client. All methods should be carried out
@@ -20,20 +22,52 @@ type Client interface {
 
 	SignUp(username string, password string) (err error)
 	LogIn(username string, password string) (err error)
+	// LogInCode finishes a login for which LogIn returned
+	// ErrCodeRequired, with a code from the user's authenticator
+	// app or one of their recovery codes.
+	LogInCode(code string) (err error)
 	LogOut() (err error)
 	Delete() (err error)
 
+	// ChangePassword changes the current user's password, logging
+	// out their sessions on other devices.
+	ChangePassword(oldPassword, newPassword string) (err error)
+
+	// ResetPassword sets a new password for a user who is not
+	// logged in, with a one-time reset token issued by an admin.
+	// All of the user's sessions are logged out.
+	ResetPassword(username, token, newPassword string) (err error)
+
 	// Upload uploads a file with the given contents to the given path,
 	// creating it if it doesn't exist already, and overwriting the old
 	// version if it does.
 	Upload(path string, body []byte) (err error)
 
+	// UploadFrom is like Upload, but reads the contents from r and sends
+	// them in chunks, so they never have to be held in memory at once.
+	// An interrupted upload of the same contents to the same path is
+	// resumed, and the file only changes once all of it has arrived.
+	UploadFrom(path string, r io.ReadSeeker) (err error)
+
 	// Download retrieves the contents of the file given by path.
 	Download(path string) (body []byte, err error)
 
+	// DownloadTo is like Download, but writes the contents to w in
+	// pieces as they arrive, so they never have to be held in memory
+	// at once.
+	DownloadTo(path string, w io.Writer) (err error)
+
+	// ResumeDownloadTo is like DownloadTo, but skips the first offset
+	// bytes of the file, which the caller already has.
+	ResumeDownloadTo(path string, offset int64, w io.Writer) (err error)
+
 	// List returns a list of the entries in the given directory.
 	List(path string) (entries []DirEnt, err error)
 
+	// Stat returns the entry for the file or directory given by
+	// path, without its contents.
+	Stat(path string) (entry DirEnt, err error)
+
 	// Creates a directory at the given path.
 	Mkdir(path string) (err error)
 
@@ -42,6 +76,21 @@ type Client interface {
 	// case an error is returned.
 	Remove(path string) (err error)
 
+	// RemoveAll removes the file or directory identified by path along
+	// with everything in it, all at once, and returns the paths that
+	// were removed. If dryRun is true, nothing is removed, and the paths
+	// that would have been are returned.
+	RemoveAll(path string, dryRun bool) (paths []string, err error)
+
+	// Move moves or renames the file or directory at src to dst. If
+	// dst is an existing directory, src is moved into it. A file may
+	// replace an existing file, but nothing may replace a directory.
+	Move(src, dst string) (err error)
+
+	// Copy is like Move, but leaves src in place, copying directories
+	// with everything in them.
+	Copy(src, dst string) (err error)
+
 	// PWD returns the path to the current working directory.
 	PWD() (path string, err error)
 
@@ -61,6 +110,56 @@ type Client interface {
 
 	// GetShares lists the shares that exist on the given file.
 	GetShares(path string) (shares []Share, err error)
+
+	// ListSessions lists the sessions the current user is logged
+	// in with, one per device, including the current one.
+	ListSessions() (sessions []Session, err error)
+
+	// RevokeSession logs out the session with the given id (as
+	// returned by ListSessions) without affecting the others.
+	RevokeSession(id string) (err error)
+
+	// EnableTwoFactor makes a new two-factor authentication secret,
+	// returned both as is and as an otpauth:// provisioning URI for
+	// authenticator apps. It only takes effect once VerifyTwoFactor
+	// is given a code made from it.
+	EnableTwoFactor() (secret, uri string, err error)
+
+	// VerifyTwoFactor turns on two-factor authentication given a
+	// code made from the secret returned by EnableTwoFactor, and
+	// returns single-use recovery codes which work in place of a
+	// code. They are not shown again.
+	VerifyTwoFactor(code string) (recoveryCodes []string, err error)
+
+	// DisableTwoFactor turns off two-factor authentication, given a
+	// code or a recovery code.
+	DisableTwoFactor(code string) (err error)
+
+	// ListVersions lists the old versions kept of the file at the
+	// given path, newest first.
+	ListVersions(path string) (versions []Version, err error)
+
+	// RestoreVersion replaces the file at the given path with the
+	// old version with the given number (as returned by ListVersions).
+	// The contents it replaces are kept as a new version.
+	RestoreVersion(path string, version int) (err error)
+
+	// TrashList lists the files and directories that were removed
+	// and can still be restored, most recently removed first.
+	TrashList() (entries []TrashEnt, err error)
+
+	// TrashRestore moves the entry with the given id (as returned by
+	// TrashList) out of the trash, to the given path, or to where it
+	// was removed from if path is the empty string.
+	TrashRestore(id, path string) (err error)
+
+	// TrashEmpty permanently deletes everything in the trash.
+	TrashEmpty() (err error)
+
+	// Usage reports how much storage the current user is using
+	// out of their quota, along with the largest directories in
+	// their root, largest first.
+	Usage() (usage Usage, largest []DirUsage, err error)
 }
 
 type Share interface {
@@ -85,11 +184,124 @@ func ShareString(s Share) string {
 	return fmt.Sprintf("r   %v", s.Sharee())
 }
 
+type Session interface {
+	ID() string
+	Device() string
+	// Created returns the zero time if it is not known.
+	Created() time.Time
+	Expires() time.Time
+	// Current returns true for the session making the request.
+	Current() bool
+}
+
+// SessionString returns a string representation of s. If s's
+// type implements the fmt.Stringer interface (that is, has
+// a String() string method), then its String() method is
+// called; otherwise, it is formatted as follows, with a *
+// marking the current session:
+//  <id> * <device> (created <time>, expires <time>)
+func SessionString(s Session) string {
+	if s, ok := s.(fmt.Stringer); ok {
+		return s.String()
+	}
+	mark := " "
+	if s.Current() {
+		mark = "*"
+	}
+	created := "unknown"
+	if !s.Created().IsZero() {
+		created = s.Created().Format("2006-01-02 15:04")
+	}
+	return fmt.Sprintf("%v %v %v (created %v, expires %v)", s.ID(), mark, s.Device(),
+		created, s.Expires().Format("2006-01-02 15:04"))
+}
+
+// Version represents an old version of a file.
+type Version interface {
+	Version() int
+	Size() int64
+	ModTime() time.Time
+	// Replaced returns when the version was overwritten.
+	Replaced() time.Time
+	Hash() string
+}
+
+// VersionString returns a string representation of v. If v's
+// type implements the fmt.Stringer interface (that is, has
+// a String() string method), then its String() method is
+// called; otherwise, it is formatted as follows, with the
+// first 12 characters of the hash:
+//  <version> <size> <modtime> (replaced <time>) <hash>
+func VersionString(v Version) string {
+	if s, ok := v.(fmt.Stringer); ok {
+		return s.String()
+	}
+	hash := v.Hash()
+	if len(hash) > 12 {
+		hash = hash[:12]
+	}
+	return fmt.Sprintf("%3d %10d %s (replaced %s) %s", v.Version(), v.Size(),
+		v.ModTime().Format("2006-01-02 15:04"), v.Replaced().Format("2006-01-02 15:04"), hash)
+}
+
+// TrashEnt represents a removed file or directory.
+type TrashEnt interface {
+	ID() string
+	// Path returns the path the entry was removed from.
+	Path() string
+	IsDir() bool
+	// Size returns the size of the entry in bytes, which for a
+	// directory is the total size of the files in it.
+	Size() int64
+	Removed() time.Time
+}
+
+// TrashEntString returns a string representation of t. If t's
+// type implements the fmt.Stringer interface (that is, has
+// a String() string method), then its String() method is
+// called; otherwise, it is formatted as follows:
+//  <id> d       4096 2006-01-02 15:04 /path/to/foobar
+//  <id> -        123 2006-01-02 15:04 /path/to/foobar
+func TrashEntString(t TrashEnt) string {
+	if s, ok := t.(fmt.Stringer); ok {
+		return s.String()
+	}
+	kind := "-"
+	if t.IsDir() {
+		kind = "d"
+	}
+	return fmt.Sprintf("%s %s %10d %s %s", t.ID(), kind, t.Size(), t.Removed().Format("2006-01-02 15:04"), t.Path())
+}
+
+// Usage represents the storage used by a user.
+type Usage interface {
+	// Used returns the bytes counted against the quota, which
+	// includes old versions of files and the trash.
+	Used() int64
+	Limit() int64
+	Files() int
+	Versions() int64
+	Trash() int64
+}
+
+// DirUsage represents the storage used by a directory and
+// everything in it.
+type DirUsage interface {
+	Path() string
+	Size() int64
+}
+
 // DirEnt represents a directory entry.
 type DirEnt interface {
 	// Name returns the base name of the entry (not the full path).
 	Name() string
 	IsDir() bool
+	// Size returns the size of the entry in bytes.
+	Size() int64
+	ModTime() time.Time
+	// Hash returns the hex encoded SHA-256 of a file's contents,
+	// or the empty string for directories.
+	Hash() string
 }
 
 // DirEntString returns a string representation of d. If d's
@@ -109,8 +321,26 @@ func DirEntString(d DirEnt) string {
 	return fmt.Sprintf("- %s", d.Name())
 }
 
+// DirEntLongString returns a long string representation of d,
+// with its size and modification time, formatted using one of
+// the two following formats depending on whether IsDir returns
+// true or not:
+//  d       4096 2006-01-02 15:04 foobar
+//  -        123 2006-01-02 15:04 foobar
+func DirEntLongString(d DirEnt) string {
+	kind := "-"
+	if d.IsDir() {
+		kind = "d"
+	}
+	return fmt.Sprintf("%s %10d %s %s", kind, d.Size(), d.ModTime().Format("2006-01-02 15:04"), d.Name())
+}
+
 var (
 	ErrNotImplemented = errors.New("not implemented")
+
+	// ErrCodeRequired is returned by LogIn when the password was
+	// right, but the user has two-factor authentication turned on.
+	ErrCodeRequired = errors.New("two-factor code required")
 )
 
 // FatalError is the type of errors which can report whether
@@ -16,6 +16,8 @@ func TestClient(t *testing.T, c Client) {
 	testDir(t, c)
 	testUpload(t, c)
 	testRemove(t, c)
+	testRemoveAll(t, c)
+	testUsage(t, c)
 	testPath(t, c)
 }
 
@@ -133,6 +135,83 @@ func testRemove(t *testing.T, c Client) {
 	}
 }
 
+// test recursive removal
+func testRemoveAll(t *testing.T, c Client) {
+	err := c.Mkdir("/foo")
+	if err != nil {
+		t.Fatalf("testRemoveAll: Mkdir(%q): %v", "/foo", err)
+	}
+	err = c.Mkdir("/foo/bar")
+	if err != nil {
+		t.Fatalf("testRemoveAll: Mkdir(%q): %v", "/foo/bar", err)
+	}
+	err = c.Upload("/foo/bar/baz", []byte("baz"))
+	if err != nil {
+		t.Fatalf("testRemoveAll: Upload(%q, ...): %v", "/foo/bar/baz", err)
+	}
+
+	// a dry run lists the tree but leaves it alone
+	want := fmt.Sprint([]string{"/foo", "/foo/bar", "/foo/bar/baz"})
+	paths, err := c.RemoveAll("/foo", true)
+	if err != nil {
+		t.Fatalf("testRemoveAll: RemoveAll(%q, true): %v", "/foo", err)
+	}
+	if fmt.Sprint(paths) != want {
+		t.Fatalf("testRemoveAll: unexpected paths from dry run: got %v; want %v", paths, want)
+	}
+	ents, err := c.List("/foo/bar")
+	if err != nil {
+		t.Fatalf("testRemoveAll: List(%q): %v", "/foo/bar", err)
+	}
+	if len(ents) != 1 {
+		t.Fatalf("testRemoveAll: unexpected entries when listing /foo/bar after dry run: got %v; want [- baz]", dirEntStrings(ents))
+	}
+
+	paths, err = c.RemoveAll("/foo", false)
+	if err != nil {
+		t.Fatalf("testRemoveAll: RemoveAll(%q, false): %v", "/foo", err)
+	}
+	if fmt.Sprint(paths) != want {
+		t.Fatalf("testRemoveAll: unexpected paths removed: got %v; want %v", paths, want)
+	}
+	ents, err = c.List("/")
+	if err != nil {
+		t.Fatalf("testRemoveAll: List(%q): %v", "/", err)
+	}
+	if len(ents) != 0 {
+		t.Fatalf("testRemoveAll: unexpected entries when listing /: got %v; want []", dirEntStrings(ents))
+	}
+}
+
+// test usage reporting
+func testUsage(t *testing.T, c Client) {
+	err := c.Mkdir("/foo")
+	if err != nil {
+		t.Fatalf("testUsage: Mkdir(%q): %v", "/foo", err)
+	}
+	err = c.Upload("/foo/bar", []byte("bar"))
+	if err != nil {
+		t.Fatalf("testUsage: Upload(%q, ...): %v", "/foo/bar", err)
+	}
+
+	usage, largest, err := c.Usage()
+	if err != nil {
+		t.Fatalf("testUsage: Usage(): %v", err)
+	}
+	if usage.Files() != 1 {
+		t.Fatalf("testUsage: unexpected file count: got %v; want 1", usage.Files())
+	}
+	if usage.Used() < 3 || usage.Used() > usage.Limit() {
+		t.Fatalf("testUsage: unexpected usage: got %v of %v bytes", usage.Used(), usage.Limit())
+	}
+	if len(largest) != 1 || largest[0].Path() != "/foo" || largest[0].Size() < 3 {
+		t.Fatalf("testUsage: unexpected largest directories: got %v; want one for /foo", len(largest))
+	}
+
+	// clean up
+	removeAll(t, c)
+}
+
 // test PWD, CD, and other path-related functionality
 func testPath(t *testing.T, c Client) {
 	err := c.Mkdir("/foo")
@@ -243,12 +322,9 @@ func removeAllHelper(t *testing.T, c Client, dir string) {
 		t.Fatalf("removeAll: List(%q): %v", dir, err)
 	}
 	for _, ent := range ents {
-		if ent.IsDir() {
-			removeAllHelper(t, c, filepath.Join(dir, ent.Name()))
-		}
-		err = c.Remove(filepath.Join(dir, ent.Name()))
+		_, err = c.RemoveAll(filepath.Join(dir, ent.Name()), false)
 		if err != nil {
-			t.Fatalf("removeAll: Remove(%q): %v", filepath.Join(dir, ent.Name()), err)
+			t.Fatalf("removeAll: RemoveAll(%q, false): %v", filepath.Join(dir, ent.Name()), err)
 		}
 	}
 }
@@ -19,22 +19,32 @@ import (
 )
 
 type handler struct {
-	f    reflect.Value
-	args []reflect.Type
-	ret  *reflect.Type
+	f        reflect.Value
+	args     []reflect.Type
+	ret      *reflect.Type
+	withAddr bool // args[0] is the client address, not sent by the client
 }
 
-func handleRequest(h handler, req rpcType.Request, resp *rpcType.Response) error {
-	if len(req.Args) != len(h.args) {
-		return fmt.Errorf("expected %v arguments; got %v", len(h.args), len(req.Args))
+func handleRequest(h handler, addr string, req rpcType.Request, resp *rpcType.Response) error {
+	skip := 0
+	if h.withAddr {
+		skip = 1
+	}
+	if len(req.Args) != len(h.args)-skip {
+		return fmt.Errorf("expected %v arguments; got %v", len(h.args)-skip, len(req.Args))
 	}
 
 	args := make([]reflect.Value, len(h.args))
+	if h.withAddr {
+		args[0] = reflect.New(h.args[0]).Elem()
+		args[0].SetString(addr)
+	}
 	for i, arg := range req.Args {
-		args[i] = reflect.New(h.args[i]).Elem()
+		j := i + skip
+		args[j] = reflect.New(h.args[j]).Elem()
 		b := bytes.NewBuffer(arg)
 		dec := gob.NewDecoder(b)
-		err := dec.DecodeValue(args[i])
+		err := dec.DecodeValue(args[j])
 		if err != nil {
 			return err
 		}
@@ -14,6 +14,7 @@ import (
 	"net/rpc"
 	"os"
 	"os/signal"
+	"reflect"
 	"sync"
 
 	"./internal/rpcType"
@@ -23,7 +24,16 @@ var handlers = make(map[string]handler)
 var finalizer func()
 var mtx sync.Mutex
 
-var invokeMtx sync.Mutex
+// invokeMtx is held for writing by a handler in serialized
+// mode, and for reading by each handler in concurrent mode;
+// either way shutdown takes it for writing to stop new calls.
+var invokeMtx sync.RWMutex
+
+// maxConcurrency is the number of handlers which may run
+// at once; 1 (the default) means serialized mode. workers
+// holds one token per running handler in concurrent mode.
+var maxConcurrency = 1
+var workers chan struct{}
 
 // RegisterHandler registers a handler under the given
 // name. f should be a function satisfying the following
@@ -56,6 +66,28 @@ func RegisterHandler(name string, f interface{}) {
 	handlers[name] = h
 }
 
+// RegisterHandlerWithAddr is like RegisterHandler, except
+// that f's first argument must be a string, in which f
+// receives the address of the client making the request
+// (its IP address, without the port). The client passes
+// only the remaining arguments.
+func RegisterHandlerWithAddr(name string, f interface{}) {
+	mtx.Lock()
+	defer mtx.Unlock()
+	if _, ok := handlers[name]; ok {
+		panic("handler already registered with given name")
+	}
+	h, err := getHandler(f)
+	if err != nil {
+		panic(err)
+	}
+	if len(h.args) == 0 || h.args[0].Kind() != reflect.String {
+		panic("handler must take the client address as its first argument")
+	}
+	h.withAddr = true
+	handlers[name] = h
+}
+
 // RegisterFinalizer registers a function which will
 // be called when the server is shut down.
 func RegisterFinalizer(f func()) {
@@ -67,14 +99,31 @@ func RegisterFinalizer(f func()) {
 	finalizer = f
 }
 
+// SetMaxConcurrency sets the number of method requests
+// which the server may handle at the same time. n <= 1
+// selects the default serialized mode; any larger n opts
+// in to concurrent mode, in which handlers must be safe
+// to run in parallel with each other. It must be called
+// before RunServer.
+func SetMaxConcurrency(n int) {
+	mtx.Lock()
+	defer mtx.Unlock()
+	if n < 1 {
+		n = 1
+	}
+	maxConcurrency = n
+}
+
 // RunServer runs the server. It panics if a finalizer
 // has not been registered.
 //
-// The server listens for incoming method requests,
-// handling each one in order. It is guaranteed that
-// no two method requests will be handled simultaneously
-// (so your handler may assume that no other handlers)
-// are executing concurrently with it.
+// The server listens for incoming method requests. By
+// default it handles each one in order, and it is
+// guaranteed that no two method requests will be handled
+// simultaneously (so your handler may assume that no
+// other handlers are executing concurrently with it).
+// If SetMaxConcurrency was called with n > 1, up to n
+// requests are handled in parallel instead.
 //
 // The server runs until it receives SIGINT (ctrl+C
 // on the command line), at which point it calls the
@@ -91,10 +140,28 @@ func RunServer(addr string) error {
 		return err
 	}
 
-	rpc.Register(&rpcType.Server{request})
+	if maxConcurrency > 1 {
+		workers = make(chan struct{}, maxConcurrency)
+	}
 
+	// each connection gets its own rpc server, so that
+	// requests know which client they came from
 	go func() {
-		rpc.Accept(l)
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			addr := conn.RemoteAddr().String()
+			if host, _, err := net.SplitHostPort(addr); err == nil {
+				addr = host
+			}
+			s := rpc.NewServer()
+			s.Register(&rpcType.Server{func(req rpcType.Request, resp *rpcType.Response) error {
+				return request(addr, req, resp)
+			}})
+			go s.ServeConn(conn)
+		}
 	}()
 
 	c := make(chan os.Signal)
@@ -105,19 +172,27 @@ func RunServer(addr string) error {
 	// server first, but that is difficult, so instead
 	// just take the lock, call the finalizer, and
 	// return. No more RPC calls will be able to proceed.
+	// In concurrent mode this waits for running calls.
 	invokeMtx.Lock()
 	finalizer()
 	return nil
 }
 
-func request(req rpcType.Request, resp *rpcType.Response) error {
-	invokeMtx.Lock()
-	defer invokeMtx.Unlock()
+func request(addr string, req rpcType.Request, resp *rpcType.Response) error {
+	if workers == nil {
+		invokeMtx.Lock()
+		defer invokeMtx.Unlock()
+	} else {
+		invokeMtx.RLock()
+		defer invokeMtx.RUnlock()
+		workers <- struct{}{}
+		defer func() { <-workers }()
+	}
 
 	h, ok := handlers[req.Name]
 	if !ok {
 		return fmt.Errorf("no method with name: %v", req.Name)
 	}
 
-	return handleRequest(h, req, resp)
+	return handleRequest(h, addr, req, resp)
 }
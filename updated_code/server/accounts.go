@@ -0,0 +1,314 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// Creating and deleting an account changes several tables and directories,
+// which have to change together. Each flow first records itself in the
+// pending_ops table, then stages its filesystem changes in PENDING_DIR, and
+// makes all its database changes in one transaction that also removes the
+// pending_ops row. Until that transaction commits the flow can be undone from
+// the staged files; once it has, only leftover staging files remain. If the
+// server stops in between, recoverPendingOps() finishes the job on the next
+// start.
+
+const PENDING_DIR = "pending/" // staging directory for signups and deletions, under abs_base_dir
+
+const (
+	OP_SIGNUP = "signup"
+	OP_DELETE = "delete"
+)
+
+/*
+ * pendingDir() - gets the staging directory of a signup or deletion
+ *
+ * Parameters: root: a string representing the name of the root directory
+ * Returns: a string with the full path to the directory, ending in "/"
+ */
+func pendingDir(root string) string {
+	return abs_base_dir + PENDING_DIR + root + "/"
+}
+
+/*
+ * beginOp() - records that a signup or deletion has started, before anything
+ * 				is changed
+ *
+ * Parameters:
+ * 		- kind: a string, OP_SIGNUP or OP_DELETE
+ * 		- username: a string representing the user's username
+ * 		- root: a string representing the name of the root directory
+ * Returns: an error if it could not be recorded or the staging directory made
+ */
+func beginOp(kind string, username string, root string) error {
+	_, err := db.Exec("INSERT INTO pending_ops (root, kind, username, started) VALUES (?, ?, ?, ?)", root, kind, username, time.Now().UTC().UnixNano())
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(pendingDir(root), 0775)
+	if err != nil {
+		endOp(root)
+	}
+	return err
+}
+
+/*
+ * endOp() - forgets about a signup or deletion which is done or undone, and
+ * 			removes what is left of its staging directory
+ *
+ * Parameters: root: a string representing the name of the root directory
+ * Returns: nothing
+ */
+func endOp(root string) {
+	db.Exec("DELETE FROM pending_ops WHERE root = ?", root)
+	os.RemoveAll(pendingDir(root))
+}
+
+/*
+ * createAccount() - adds a user and their empty root, all or nothing
+ *
+ * Parameters:
+ * 		- username: a string representing the user's username
+ * 		- root: a string representing the name of the new root directory
+ * 		- salt: a string representing the salt of the password
+ * 		- hashword: a string representing the hashed password
+ * 		- algorithm: a string representing how the password was hashed
+ * 		- params: a string representing the parameters it was hashed with
+ * Returns: an error if the account could not be created, nothing is left behind
+ */
+func createAccount(username string, root string, salt string, hashword string, algorithm string, params string) error {
+	err := beginOp(OP_SIGNUP, username, root)
+	if err != nil {
+		return err
+	}
+
+	// make the root in the staging directory and move it into place, so it is
+	// either there whole or not at all
+	err = os.Mkdir(pendingDir(root) + "root", 0775)
+	if err == nil {
+		err = os.Rename(pendingDir(root) + "root", abs_base_dir + root)
+	}
+	if err != nil {
+		endOp(root)
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		undoSignup(root)
+		return err
+	}
+	exec := func(query string, args ...interface{}) {
+		if err == nil {
+			_, err = tx.Exec(query, args...)
+		}
+	}
+	exec("INSERT INTO u_p (username, username_key, salt, hashword, algorithm, params) VALUES (?, ?, ?, ?, ?, ?)", username, usernameKey(username), salt, hashword, algorithm, params)
+	exec("INSERT INTO metadata (username, root) VALUES (?, ?)", username, root)
+	exec("INSERT OR REPLACE INTO usage (root, bytes) VALUES (?, ?)", root, DIR_USAGE)
+	exec("DELETE FROM pending_ops WHERE root = ?", root)
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+	if err != nil {
+		undoSignup(root)
+		return err
+	}
+	os.RemoveAll(pendingDir(root))
+	return nil
+}
+
+/*
+ * undoSignup() - removes the root of a signup which did not commit
+ *
+ * Parameters: root: a string representing the name of the root directory
+ * Returns: nothing
+ */
+func undoSignup(root string) {
+	os.RemoveAll(abs_base_dir + root)
+	endOp(root)
+}
+
+// what a deletion moves into its staging directory, by name in that directory
+func deletedDirs(root string) map[string]string {
+	return map[string]string{
+		"root":     abs_base_dir + root,
+		"versions": versionsDir(root),
+		"trash":    trashDir(root),
+	}
+}
+
+/*
+ * deleteAccount() - deletes a user, their files and everything about them,
+ * 					all or nothing, the root has to be locked by the caller
+ *
+ * Parameters:
+ * 		- username: a string representing the user's username
+ * 		- root: a string representing the name of the user's root directory
+ * Returns: an error if the account could not be deleted, nothing is changed then
+ */
+func deleteAccount(username string, root string) error {
+	// unfinished uploads are staged along with the rest
+	var uploads []string
+	rows, err := db.Query("SELECT upload_id FROM uploads WHERE username = ?", username)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var id string
+		rows.Scan(&id)
+		uploads = append(uploads, id)
+	}
+	rows.Close()
+
+	err = beginOp(OP_DELETE, username, root)
+	if err != nil {
+		return err
+	}
+
+	// move the files out of the way, the root last so the user keeps seeing
+	// their files until everything else is staged
+	err = os.Mkdir(pendingDir(root) + "uploads", 0775)
+	for _, id := range uploads {
+		if err == nil {
+			err = moveIfExists(stagingPath(id), pendingDir(root) + "uploads/" + id)
+		}
+	}
+	for _, name := range []string{"versions", "trash", "root"} {
+		if err == nil {
+			err = moveIfExists(deletedDirs(root)[name], pendingDir(root) + name)
+		}
+	}
+	if err != nil {
+		undoDelete(root)
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		undoDelete(root)
+		return err
+	}
+	exec := func(query string, args ...interface{}) {
+		if err == nil {
+			_, err = tx.Exec(query, args...)
+		}
+	}
+	exec("DELETE FROM session_pwd WHERE session_id IN (SELECT session_id FROM sessions WHERE username = ?)", username)
+	exec("DELETE FROM sessions WHERE username = ?", username)
+	exec("DELETE FROM u_p WHERE username = ?", username)
+	exec("DELETE FROM two_factor WHERE username = ?", username)
+	exec("DELETE FROM recovery_codes WHERE username = ?", username)
+	exec("DELETE FROM pending_logins WHERE username = ?", username)
+	exec("DELETE FROM password_resets WHERE username = ?", username)
+	exec("DELETE FROM password_history WHERE username = ?", username)
+	exec("DELETE FROM metadata WHERE username = ?", username)
+	// shares both by and with the user
+	exec("DELETE FROM shares WHERE owner = ? OR sharee = ?", username, username)
+	exec("DELETE FROM uploads WHERE username = ?", username)
+	exec("DELETE FROM versions WHERE root = ?", root)
+	exec("DELETE FROM trash WHERE root = ?", root)
+	exec("DELETE FROM usage WHERE root = ?", root)
+	exec("DELETE FROM pending_ops WHERE root = ?", root)
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+	if err != nil {
+		undoDelete(root)
+		return err
+	}
+	os.RemoveAll(pendingDir(root))
+	return nil
+}
+
+/*
+ * undoDelete() - moves the staged files of a deletion which did not commit
+ * 				back to where they were
+ *
+ * Parameters: root: a string representing the name of the root directory
+ * Returns: nothing
+ */
+func undoDelete(root string) {
+	for name, dir := range deletedDirs(root) {
+		moveIfExists(pendingDir(root) + name, dir)
+	}
+	files, _ := ioutil.ReadDir(pendingDir(root) + "uploads")
+	for _, fi := range files {
+		moveIfExists(pendingDir(root) + "uploads/" + fi.Name(), stagingPath(fi.Name()))
+	}
+	endOp(root)
+}
+
+/*
+ * moveIfExists() - renames a file or directory, if there is one
+ *
+ * Parameters:
+ * 		- from: a string representing the full path to move
+ * 		- to: a string representing the full path to move it to
+ * Returns: an error if it exists but could not be moved
+ */
+func moveIfExists(from string, to string) error {
+	if _, err := os.Lstat(from); os.IsNotExist(err) {
+		return nil
+	}
+	return os.Rename(from, to)
+}
+
+/*
+ * recoverPendingOps() - finishes or undoes the signups and deletions that were
+ * 						interrupted, and removes unneeded staging files, on startup
+ *
+ * Parameters: none
+ * Returns: an error if the pending operations could not be read
+ */
+func recoverPendingOps() error {
+	rows, err := db.Query("SELECT root, kind, username FROM pending_ops")
+	if err != nil {
+		return err
+	}
+	var roots, kinds, usernames []string
+	for rows.Next() {
+		var root, kind, username string
+		rows.Scan(&root, &kind, &username)
+		roots = append(roots, root)
+		kinds = append(kinds, kind)
+		usernames = append(usernames, username)
+	}
+	rows.Close()
+
+	// a row only remains if the transaction of the flow did not commit, so
+	// nothing in the database changed and the files have to be put back
+	for i, root := range roots {
+		switch kinds[i] {
+		case OP_SIGNUP:
+			undoSignup(root)
+			fmt.Printf("undid interrupted signup of %v\n", usernames[i])
+		case OP_DELETE:
+			undoDelete(root)
+			fmt.Printf("undid interrupted deletion of %v\n", usernames[i])
+		}
+	}
+
+	// whatever is left was staged by flows that did commit
+	os.RemoveAll(abs_base_dir + PENDING_DIR)
+
+	// and no upload or copy is running yet, so staging files without an
+	// upload are left over
+	files, _ := ioutil.ReadDir(abs_base_dir + UPLOAD_DIR)
+	for _, fi := range files {
+		var id string
+		err := db.QueryRow("SELECT upload_id FROM uploads WHERE upload_id = ?", fi.Name()).Scan(&id)
+		if err == sql.ErrNoRows {
+			os.RemoveAll(abs_base_dir + UPLOAD_DIR + fi.Name())
+		}
+	}
+	return nil
+}
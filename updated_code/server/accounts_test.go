@@ -0,0 +1,147 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"../internal"
+)
+
+// pendingOps gets the number of rows in pending_ops
+func pendingOps(t *testing.T) int {
+	var n int
+	err := db.QueryRow("SELECT COUNT(*) FROM pending_ops").Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestRecoverInterruptedSignup(t *testing.T) {
+	setUp(t)
+	root := "r0123456789abcdef0123456789abcdef"
+
+	// stop a signup after its root is in place, before the transaction
+	err := beginOp(OP_SIGNUP, "carol", root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Mkdir(pendingDir(root) + "root", 0775)
+	if err == nil {
+		err = os.Rename(pendingDir(root) + "root", abs_base_dir + root)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = recoverPendingOps()
+	if err != nil {
+		t.Fatalf("recoverPendingOps(): %v", err)
+	}
+	if _, err := os.Stat(abs_base_dir + root); err == nil {
+		t.Errorf("root of the interrupted signup is still there")
+	}
+	if _, err := os.Stat(abs_base_dir + PENDING_DIR); err == nil {
+		t.Errorf("%v is still there after recovery", PENDING_DIR)
+	}
+	if n := pendingOps(t); n != 0 {
+		t.Errorf("%v pending operations after recovery, want 0", n)
+	}
+	err1, _ := rootForUsername("carol")
+	wantCode(t, "rootForUsername() of the interrupted signup", err1, internal.NotFound)
+
+	// the name is free again
+	carol := signUp(t, "carol")
+	mustOK(t, "upload", uploadHandler(carol, "f.txt", []byte("carol")))
+}
+
+func TestRecoverInterruptedDelete(t *testing.T) {
+	setUp(t)
+	alice := signUp(t, "alice")
+	err, root := rootForUsername("alice")
+	mustOK(t, "rootForUsername()", err)
+
+	mustOK(t, "upload f.txt", uploadHandler(alice, "f.txt", []byte("one")))
+	mustOK(t, "upload f.txt again", uploadHandler(alice, "f.txt", []byte("two")))
+	mustOK(t, "upload g.txt", uploadHandler(alice, "g.txt", []byte("trash")))
+	mustOK(t, "remove g.txt", removeHandler(alice, "g.txt"))
+	upload := uploadBeginHandler(alice, "h.txt", 3, sha256Hex("abc"))
+	mustOK(t, "uploadBeginHandler()", upload.Err)
+	mustOK(t, "chunk", uploadChunkHandler(alice, upload.ID, 0, []byte("ab")).Err)
+	usage, _ := getUsage(root)
+
+	// stop a deletion after some of the files are staged, before the transaction
+	err1 := beginOp(OP_DELETE, "alice", root)
+	if err1 == nil {
+		err1 = os.Mkdir(pendingDir(root) + "uploads", 0775)
+	}
+	if err1 == nil {
+		err1 = moveIfExists(stagingPath(upload.ID), pendingDir(root) + "uploads/" + upload.ID)
+	}
+	for _, name := range []string{"versions", "trash"} {
+		if err1 == nil {
+			err1 = moveIfExists(deletedDirs(root)[name], pendingDir(root) + name)
+		}
+	}
+	if err1 != nil {
+		t.Fatal(err1)
+	}
+
+	err1 = recoverPendingOps()
+	if err1 != nil {
+		t.Fatalf("recoverPendingOps(): %v", err1)
+	}
+	if n := pendingOps(t); n != 0 {
+		t.Errorf("%v pending operations after recovery, want 0", n)
+	}
+
+	// everything is back where it was, and still works
+	if got := readFile(rootOf(t, "alice") + "f.txt"); got != "two" {
+		t.Errorf("f.txt = %q after recovery, want %q", got, "two")
+	}
+	mustOK(t, "restoreVersionHandler()", restoreVersionHandler(alice, "f.txt", 1))
+	list := trashListHandler(alice)
+	mustOK(t, "trashListHandler()", list.Err)
+	if len(list.Entries) != 1 {
+		t.Fatalf("%v entries in the trash after recovery, want 1", len(list.Entries))
+	}
+	mustOK(t, "trashRestoreHandler()", trashRestoreHandler(alice, list.Entries[0].ID_, ""))
+	mustOK(t, "last chunk", uploadChunkHandler(alice, upload.ID, 2, []byte("c")).Err)
+	mustOK(t, "uploadCommitHandler()", uploadCommitHandler(alice, upload.ID, sha256Hex("abc")))
+	if got, _ := getUsage(root); got != usage + 3 + 3 {
+		// restoring kept another version, and the upload was committed
+		t.Errorf("getUsage() = %v after recovery, want %v", got, usage + 3 + 3)
+	}
+}
+
+func TestRecoverLeftovers(t *testing.T) {
+	setUp(t)
+	alice := signUp(t, "alice")
+	err, root := rootForUsername("alice")
+	mustOK(t, "rootForUsername()", err)
+	upload := uploadBeginHandler(alice, "h.txt", 3, sha256Hex("abc"))
+	mustOK(t, "uploadBeginHandler()", upload.Err)
+
+	// a deletion that committed but did not get to clean up, and a staging
+	// file of no upload
+	os.MkdirAll(pendingDir("rffffffffffffffffffffffffffffffff") + "root", 0775)
+	ioutil.WriteFile(abs_base_dir + UPLOAD_DIR + "upload123", []byte("left over"), 0664)
+
+	err1 := recoverPendingOps()
+	if err1 != nil {
+		t.Fatalf("recoverPendingOps(): %v", err1)
+	}
+	if _, err := os.Stat(abs_base_dir + PENDING_DIR); err == nil {
+		t.Errorf("%v is still there after recovery", PENDING_DIR)
+	}
+	if _, err := os.Stat(abs_base_dir + UPLOAD_DIR + "upload123"); err == nil {
+		t.Errorf("staging file of no upload is still there after recovery")
+	}
+	if _, err := os.Stat(stagingPath(upload.ID)); err != nil {
+		t.Errorf("staging file of an upload is gone after recovery: %v", err)
+	}
+	if _, err := os.Stat(abs_base_dir + root); err != nil {
+		t.Errorf("root is gone after recovery: %v", err)
+	}
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The server is configured from, in increasing order of precedence, the
+// defaults below, a JSON config file given with -config, command line flags,
+// and the <base-dir> <listen-address> arguments. A config file looks like:
+//
+//	{
+//		"data_dir": "/var/lib/dropbox",
+//		"database": "dropbox.db",
+//		"listen": "localhost:8080",
+//		"max_concurrent_requests": 8,
+//		"user_quota": 5000000,
+//		"total_storage": 100000000,
+//		"session_lifetime": "10m",
+//		"max_name_length": 25,
+//		"max_nesting": 20,
+//		"trash_retention": "720h",
+//		"max_versions": 5,
+//		"login_backoff": "1s",
+//		"max_login_failures": 5,
+//		"lockout_duration": "15m",
+//		"signups_per_hour": 10,
+//		"password_min_length": 8,
+//		"password_classes": ["digit", "lower", "upper"],
+//		"password_deny_list": "common-passwords.txt",
+//		"password_no_username": true,
+//		"password_history": 5,
+//		"argon2_time": 1,
+//		"argon2_memory": 65536,
+//		"argon2_threads": 4,
+//		"argon2_key_len": 32
+//	}
+
+const DEFAULT_USER_QUOTA = 5000000 // in bytes, (5MB storage per user)
+const DEFAULT_TOTAL_STORAGE = 100000000 // in bytes, (100MB total db storage in system)
+const DEFAULT_DATABASE = "dropbox.db" // database file name, relative to the data directory
+const DEFAULT_MAX_CONCURRENT_REQUESTS = 8 // number of rpc requests handled in parallel
+const DEFAULT_SESSION_LIFETIME = 10 * time.Minute // how long a login lasts
+const DEFAULT_MAX_NAME_LENGTH = 25 // longest file or directory name, in bytes
+const DEFAULT_MAX_NESTING = 20 // deepest a directory can be nested in a root
+const DEFAULT_TRASH_RETENTION = 30 * 24 * time.Hour // how long removed files are kept in the trash
+const DEFAULT_MAX_VERSIONS = 5 // number of old versions kept per file
+const DEFAULT_LOGIN_BACKOFF = time.Second // wait after the first failed login, doubling with each one after
+const DEFAULT_MAX_LOGIN_FAILURES = 5 // failed logins in a row before an account is locked
+const DEFAULT_LOCKOUT_DURATION = 15 * time.Minute // how long a locked account stays locked
+const DEFAULT_SIGNUPS_PER_HOUR = 10 // signups allowed from one address per hour
+const DEFAULT_PASSWORD_MIN_LENGTH = 8 // shortest password allowed, in characters
+const DEFAULT_PASSWORD_NO_USERNAME = true // passwords may not contain the username
+const DEFAULT_PASSWORD_HISTORY = 5 // latest passwords of a user that may not be used again
+const DEFAULT_ARGON2_TIME = 1 // argon2id passes over the memory
+const DEFAULT_ARGON2_MEMORY = 64 * 1024 // argon2id memory in KiB (64MB per hash)
+const DEFAULT_ARGON2_THREADS = 4 // argon2id degree of parallelism
+const DEFAULT_ARGON2_KEY_LEN = 32 // argon2id hash length in bytes
+
+var DEFAULT_PASSWORD_CLASSES = []string{"digit", "lower", "upper"} // character classes a password needs one of each of
+
+// a time.Duration which is written as a string like "10m" in the config file
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return fmt.Errorf("durations must be strings like \"10m\" or \"1h30m\"")
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+// a list of names, written comma separated on the command line
+type nameList []string
+
+func (l *nameList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *nameList) Set(s string) error {
+	*l = nil
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name != "" {
+			*l = append(*l, name)
+		}
+	}
+	return nil
+}
+
+type Config struct {
+	DataDir         string   `json:"data_dir"`         // where the roots and everything else are kept
+	Database        string   `json:"database"`         // database file, relative paths are in DataDir
+	Listen          string   `json:"listen"`           // address the rpc server listens on
+	UserQuota       int64    `json:"user_quota"`       // bytes per user, unless the user has a quota of their own
+	TotalStorage    int64    `json:"total_storage"`    // bytes for all users together, no signups beyond it
+	SessionLifetime duration `json:"session_lifetime"` // how long a login lasts
+	MaxNameLength   int      `json:"max_name_length"`  // longest file or directory name, in bytes
+	MaxNesting      int      `json:"max_nesting"`      // deepest a directory can be nested in a root
+	TrashRetention  duration `json:"trash_retention"`  // how long removed files are kept in the trash before they are purged
+	MaxVersions     int      `json:"max_versions"`     // number of old versions kept per file, older ones are dropped
+
+	MaxConcurrent int `json:"max_concurrent_requests"` // number of rpc requests handled in parallel, 1 handles them one at a time
+
+	LoginBackoff     duration `json:"login_backoff"`      // wait after the first failed login, doubling with each one after
+	MaxLoginFailures int      `json:"max_login_failures"` // failed logins in a row before an account is locked
+	LockoutDuration  duration `json:"lockout_duration"`   // how long a locked account stays locked, and the longest backoff
+	SignupsPerHour   int      `json:"signups_per_hour"`   // signups allowed from one address per hour
+
+	PasswordMinLength  int      `json:"password_min_length"`  // shortest password allowed, in characters
+	PasswordClasses    nameList `json:"password_classes"`     // character classes a password needs one of each of, see policy.go
+	PasswordDenyList   string   `json:"password_deny_list"`   // file of passwords that may not be used, relative paths are in DataDir
+	PasswordNoUsername bool     `json:"password_no_username"` // passwords may not contain the username
+	PasswordHistory    int      `json:"password_history"`     // latest passwords of a user that may not be used again
+
+	Argon2Time    int `json:"argon2_time"`    // argon2id passes over the memory for new password hashes
+	Argon2Memory  int `json:"argon2_memory"`  // argon2id memory for new password hashes, in KiB
+	Argon2Threads int `json:"argon2_threads"` // argon2id degree of parallelism for new password hashes
+	Argon2KeyLen  int `json:"argon2_key_len"` // length of new password hashes, in bytes
+}
+
+var config Config // the configuration the server runs with, set by loadConfig()
+
+/*
+ * defaultConfig() - gets the configuration used for anything not configured,
+ * 					data is kept next to the server binary as it always was
+ *
+ * Parameters: none
+ * Returns: a Config with the defaults
+ */
+func defaultConfig() Config {
+	dir, _ := filepath.Abs(filepath.Dir(os.Args[0]))
+	return Config{
+		DataDir:         dir,
+		Database:        DEFAULT_DATABASE,
+		UserQuota:       DEFAULT_USER_QUOTA,
+		TotalStorage:    DEFAULT_TOTAL_STORAGE,
+		SessionLifetime: duration(DEFAULT_SESSION_LIFETIME),
+		MaxNameLength:   DEFAULT_MAX_NAME_LENGTH,
+		MaxNesting:      DEFAULT_MAX_NESTING,
+		TrashRetention:  duration(DEFAULT_TRASH_RETENTION),
+		MaxVersions:     DEFAULT_MAX_VERSIONS,
+
+		MaxConcurrent: DEFAULT_MAX_CONCURRENT_REQUESTS,
+
+		LoginBackoff:     duration(DEFAULT_LOGIN_BACKOFF),
+		MaxLoginFailures: DEFAULT_MAX_LOGIN_FAILURES,
+		LockoutDuration:  duration(DEFAULT_LOCKOUT_DURATION),
+		SignupsPerHour:   DEFAULT_SIGNUPS_PER_HOUR,
+
+		PasswordMinLength:  DEFAULT_PASSWORD_MIN_LENGTH,
+		PasswordClasses:    DEFAULT_PASSWORD_CLASSES,
+		PasswordNoUsername: DEFAULT_PASSWORD_NO_USERNAME,
+		PasswordHistory:    DEFAULT_PASSWORD_HISTORY,
+
+		Argon2Time:    DEFAULT_ARGON2_TIME,
+		Argon2Memory:  DEFAULT_ARGON2_MEMORY,
+		Argon2Threads: DEFAULT_ARGON2_THREADS,
+		Argon2KeyLen:  DEFAULT_ARGON2_KEY_LEN,
+	}
+}
+
+/*
+ * readConfigFile() - reads a JSON config file over a configuration, leaving
+ * 					anything the file does not mention as it is
+ *
+ * Parameters:
+ * 		- file: a string representing the path to the config file
+ * 		- c: the Config to read into
+ * Returns: an error if the file could not be read or has unknown settings
+ */
+func readConfigFile(file string, c *Config) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	err = dec.Decode(c)
+	if err != nil {
+		return fmt.Errorf("%v: %v", file, err)
+	}
+	return nil
+}
+
+/*
+ * validate() - checks that a configuration makes sense, and makes its paths
+ * 				absolute
+ *
+ * Parameters: serving: a boolean, true if the server is going to listen (an
+ * 				address is only needed then)
+ * Returns: an error describing the first problem found
+ */
+func (c *Config) validate(serving bool) error {
+	if c.DataDir == "" {
+		return fmt.Errorf("data_dir must be set")
+	}
+	dir, err := filepath.Abs(c.DataDir)
+	if err != nil {
+		return fmt.Errorf("data_dir %q: %v", c.DataDir, err)
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("data_dir %q does not exist", c.DataDir)
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("data_dir %q is not a directory", c.DataDir)
+	}
+	c.DataDir = dir
+
+	if c.Database == "" {
+		return fmt.Errorf("database must be set")
+	}
+	if !filepath.IsAbs(c.Database) {
+		c.Database = filepath.Join(c.DataDir, c.Database)
+	}
+	if fi, err := os.Stat(c.Database); err == nil && fi.IsDir() {
+		return fmt.Errorf("database %q is a directory", c.Database)
+	}
+
+	if serving && c.Listen == "" {
+		return fmt.Errorf("listen must be set to the address to listen on")
+	}
+	if c.MaxConcurrent < 1 {
+		return fmt.Errorf("max_concurrent_requests must be at least 1, got %v", c.MaxConcurrent)
+	}
+	if c.UserQuota <= 0 {
+		return fmt.Errorf("user_quota must be a positive number of bytes, got %v", c.UserQuota)
+	}
+	if c.TotalStorage < c.UserQuota {
+		return fmt.Errorf("total_storage (%v) must be at least user_quota (%v)", c.TotalStorage, c.UserQuota)
+	}
+	if c.SessionLifetime <= 0 {
+		return fmt.Errorf("session_lifetime must be positive, got %v", time.Duration(c.SessionLifetime))
+	}
+	// the name also has to fit in a path component on disk
+	if c.MaxNameLength < 1 || c.MaxNameLength > 255 {
+		return fmt.Errorf("max_name_length must be between 1 and 255, got %v", c.MaxNameLength)
+	}
+	if c.MaxNesting < 1 {
+		return fmt.Errorf("max_nesting must be at least 1, got %v", c.MaxNesting)
+	}
+	if c.TrashRetention <= 0 {
+		return fmt.Errorf("trash_retention must be positive, got %v", time.Duration(c.TrashRetention))
+	}
+	if c.MaxVersions < 1 {
+		return fmt.Errorf("max_versions must be at least 1, got %v", c.MaxVersions)
+	}
+	if c.LoginBackoff <= 0 {
+		return fmt.Errorf("login_backoff must be positive, got %v", time.Duration(c.LoginBackoff))
+	}
+	if c.MaxLoginFailures < 1 {
+		return fmt.Errorf("max_login_failures must be at least 1, got %v", c.MaxLoginFailures)
+	}
+	if c.LockoutDuration < c.LoginBackoff {
+		return fmt.Errorf("lockout_duration (%v) must be at least login_backoff (%v)", time.Duration(c.LockoutDuration), time.Duration(c.LoginBackoff))
+	}
+	if c.SignupsPerHour < 1 {
+		return fmt.Errorf("signups_per_hour must be at least 1, got %v", c.SignupsPerHour)
+	}
+	if c.PasswordMinLength < 1 {
+		return fmt.Errorf("password_min_length must be at least 1, got %v", c.PasswordMinLength)
+	}
+	for _, name := range c.PasswordClasses {
+		if _, ok := password_classes[name]; !ok {
+			var known []string
+			for class := range password_classes {
+				known = append(known, class)
+			}
+			sort.Strings(known)
+			return fmt.Errorf("password_classes: unknown class %q, must be one of %v", name, strings.Join(known, ", "))
+		}
+	}
+	if c.PasswordDenyList != "" {
+		if !filepath.IsAbs(c.PasswordDenyList) {
+			c.PasswordDenyList = filepath.Join(c.DataDir, c.PasswordDenyList)
+		}
+		if _, err := os.Stat(c.PasswordDenyList); err != nil {
+			return fmt.Errorf("password_deny_list %q does not exist", c.PasswordDenyList)
+		}
+	}
+	if c.PasswordHistory < 0 {
+		return fmt.Errorf("password_history must not be negative, got %v", c.PasswordHistory)
+	}
+	if c.Argon2Time < 1 {
+		return fmt.Errorf("argon2_time must be at least 1, got %v", c.Argon2Time)
+	}
+	if c.Argon2Threads < 1 || c.Argon2Threads > 255 {
+		return fmt.Errorf("argon2_threads must be between 1 and 255, got %v", c.Argon2Threads)
+	}
+	// argon2 needs 8 KiB per thread
+	if c.Argon2Memory < 8 * c.Argon2Threads || uint64(c.Argon2Memory) > math.MaxUint32 {
+		return fmt.Errorf("argon2_memory must be between %v and %v KiB, got %v", 8 * c.Argon2Threads, uint64(math.MaxUint32), c.Argon2Memory)
+	}
+	if c.Argon2KeyLen < 16 || c.Argon2KeyLen > 1024 {
+		return fmt.Errorf("argon2_key_len must be between 16 and 1024 bytes, got %v", c.Argon2KeyLen)
+	}
+	return nil
+}
+
+/*
+ * loadConfig() - works out the configuration from the config file, flags and
+ * 				arguments, and sets config, abs_base_dir and password_policy
+ *
+ * Parameters:
+ * 		- flags: the parsed flag.FlagSet, so flags that were given can be told apart
+ * 				from flags left at their defaults
+ * 		- config_file: a string representing the path to the config file, or ""
+ * 		- overrides: the Config holding the values of the flags
+ * 		- args: the arguments left after the flags, <base-dir> <listen-address> if any
+ * 		- serving: a boolean, true if the server is going to listen
+ * Returns: an error if the configuration could not be read or is invalid
+ */
+func loadConfig(flags *flag.FlagSet, config_file string, overrides Config, args []string, serving bool) error {
+	c := defaultConfig()
+	if config_file != "" {
+		err := readConfigFile(config_file, &c)
+		if err != nil {
+			return err
+		}
+	}
+
+	// only flags that were actually given override the file
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "data-dir":
+			c.DataDir = overrides.DataDir
+		case "db":
+			c.Database = overrides.Database
+		case "listen":
+			c.Listen = overrides.Listen
+		case "max-concurrent-requests":
+			c.MaxConcurrent = overrides.MaxConcurrent
+		case "user-quota":
+			c.UserQuota = overrides.UserQuota
+		case "total-storage":
+			c.TotalStorage = overrides.TotalStorage
+		case "session-lifetime":
+			c.SessionLifetime = overrides.SessionLifetime
+		case "max-name-length":
+			c.MaxNameLength = overrides.MaxNameLength
+		case "max-nesting":
+			c.MaxNesting = overrides.MaxNesting
+		case "trash-retention":
+			c.TrashRetention = overrides.TrashRetention
+		case "max-versions":
+			c.MaxVersions = overrides.MaxVersions
+		case "login-backoff":
+			c.LoginBackoff = overrides.LoginBackoff
+		case "max-login-failures":
+			c.MaxLoginFailures = overrides.MaxLoginFailures
+		case "lockout-duration":
+			c.LockoutDuration = overrides.LockoutDuration
+		case "signups-per-hour":
+			c.SignupsPerHour = overrides.SignupsPerHour
+		case "password-min-length":
+			c.PasswordMinLength = overrides.PasswordMinLength
+		case "password-classes":
+			c.PasswordClasses = overrides.PasswordClasses
+		case "password-deny-list":
+			c.PasswordDenyList = overrides.PasswordDenyList
+		case "password-no-username":
+			c.PasswordNoUsername = overrides.PasswordNoUsername
+		case "password-history":
+			c.PasswordHistory = overrides.PasswordHistory
+		case "argon2-time":
+			c.Argon2Time = overrides.Argon2Time
+		case "argon2-memory":
+			c.Argon2Memory = overrides.Argon2Memory
+		case "argon2-threads":
+			c.Argon2Threads = overrides.Argon2Threads
+		case "argon2-key-len":
+			c.Argon2KeyLen = overrides.Argon2KeyLen
+		}
+	})
+	if len(args) == 2 {
+		c.DataDir = args[0]
+		c.Listen = args[1]
+	}
+
+	err := c.validate(serving)
+	if err != nil {
+		return err
+	}
+	policy, err := newPasswordPolicy(c)
+	if err != nil {
+		return fmt.Errorf("password_deny_list: %v", err)
+	}
+	config = c
+	password_policy = policy
+	abs_base_dir = c.DataDir + "/"
+	return nil
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// keepConfig puts back what loadConfig sets when the test ends
+func keepConfig(t *testing.T) {
+	old_config, old_base_dir, old_policy := config, abs_base_dir, password_policy
+	t.Cleanup(func() {
+		config, abs_base_dir, password_policy = old_config, old_base_dir, old_policy
+	})
+}
+
+// testFlags parses args with some of the flags the server has, the way main()
+// sets them up
+func testFlags(t *testing.T, args ...string) (*flag.FlagSet, Config) {
+	defaults := defaultConfig()
+	var overrides Config
+	flags := flag.NewFlagSet("server", flag.ContinueOnError)
+	flags.StringVar(&overrides.DataDir, "data-dir", defaults.DataDir, "")
+	flags.StringVar(&overrides.Listen, "listen", "", "")
+	flags.IntVar(&overrides.MaxNesting, "max-nesting", defaults.MaxNesting, "")
+	flags.IntVar(&overrides.MaxVersions, "max-versions", defaults.MaxVersions, "")
+	flags.DurationVar((*time.Duration)(&overrides.SessionLifetime), "session-lifetime", time.Duration(defaults.SessionLifetime), "")
+	overrides.PasswordClasses = defaults.PasswordClasses
+	flags.Var(&overrides.PasswordClasses, "password-classes", "")
+	err := flags.Parse(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return flags, overrides
+}
+
+// tempDirs makes n directories which are removed when the test ends
+func tempDirs(t *testing.T, n int) []string {
+	var dirs []string
+	for i := 0; i < n; i++ {
+		dir, err := ioutil.TempDir("", "config")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { os.RemoveAll(dir) })
+		dirs = append(dirs, dir)
+	}
+	return dirs
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	keepConfig(t)
+	dirs := tempDirs(t, 3)
+	file := filepath.Join(dirs[0], "config.json")
+	err := ioutil.WriteFile(file, []byte(`{
+		"data_dir": "` + dirs[0] + `",
+		"listen": "file:1",
+		"max_nesting": 9,
+		"max_versions": 7,
+		"session_lifetime": "1h",
+		"password_history": 0
+	}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaults := defaultConfig()
+
+	// defaults < file < flags < args
+	tests := []struct {
+		what     string
+		file     string
+		flags    []string
+		args     []string
+		dir      string
+		listen   string
+		nesting  int
+		versions int
+		lifetime time.Duration
+	}{
+		{"defaults", "", nil, nil, defaults.DataDir, "", DEFAULT_MAX_NESTING, DEFAULT_MAX_VERSIONS, DEFAULT_SESSION_LIFETIME},
+		{"file", file, nil, nil, dirs[0], "file:1", 9, 7, time.Hour},
+		{"flags", "", []string{"-max-versions", "3", "-listen", "flag:2"}, nil, defaults.DataDir, "flag:2", DEFAULT_MAX_NESTING, 3, DEFAULT_SESSION_LIFETIME},
+		{"flags over the file", file, []string{"-max-versions", "3", "-listen", "flag:2", "-data-dir", dirs[1]}, nil, dirs[1], "flag:2", 9, 3, time.Hour},
+		{"flags given as the default", file, []string{"-max-versions", "5", "-session-lifetime", "10m"}, nil, dirs[0], "file:1", 9, 5, 10 * time.Minute},
+		{"args over flags", file, []string{"-listen", "flag:2", "-data-dir", dirs[1]}, []string{dirs[2], "args:3"}, dirs[2], "args:3", 9, 7, time.Hour},
+	}
+	for _, test := range tests {
+		flags, overrides := testFlags(t, test.flags...)
+		err := loadConfig(flags, test.file, overrides, test.args, false)
+		if err != nil {
+			t.Errorf("%v: loadConfig(): %v", test.what, err)
+			continue
+		}
+		dir, _ := filepath.Abs(test.dir)
+		if config.DataDir != dir || config.Listen != test.listen || config.MaxNesting != test.nesting ||
+			config.MaxVersions != test.versions || time.Duration(config.SessionLifetime) != test.lifetime {
+			t.Errorf("%v: config = %v %q %v %v %v, want %v %q %v %v %v", test.what,
+				config.DataDir, config.Listen, config.MaxNesting, config.MaxVersions, time.Duration(config.SessionLifetime),
+				dir, test.listen, test.nesting, test.versions, test.lifetime)
+		}
+		if abs_base_dir != dir + "/" || config.Database != filepath.Join(dir, DEFAULT_DATABASE) {
+			t.Errorf("%v: abs_base_dir = %q, database %q, want both in %v", test.what, abs_base_dir, config.Database, dir)
+		}
+	}
+
+	// a flag not given leaves the file alone, even with a value of its own
+	flags, overrides := testFlags(t)
+	overrides.MaxVersions = 1
+	err = loadConfig(flags, file, overrides, nil, false)
+	if err != nil || config.MaxVersions != 7 {
+		t.Errorf("loadConfig() with an unset flag = %v, max_versions %v, want nil, 7", err, config.MaxVersions)
+	}
+
+	// and password_policy follows the configuration (without a history, which
+	// needs the database)
+	flags, overrides = testFlags(t, "-password-classes", "digit,symbol")
+	err = loadConfig(flags, file, overrides, nil, false)
+	if err != nil {
+		t.Fatalf("loadConfig() with password classes: %v", err)
+	}
+	if details := checkPasswordPolicy("alice", "abcdefgh").Details; len(details) != 2 {
+		t.Errorf("password policy after loadConfig() = %v, want a digit and a symbol", details)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	keepConfig(t)
+	dir := tempDirs(t, 1)[0]
+	write := func(name string, contents string) string {
+		p := filepath.Join(dir, name)
+		err := ioutil.WriteFile(p, []byte(contents), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	tests := []struct {
+		what  string
+		file  string
+		flags []string
+		want  string
+	}{
+		{"missing file", filepath.Join(dir, "missing.json"), nil, "no such file"},
+		{"unknown setting", write("unknown.json", `{"max_version": 3}`), nil, "unknown field"},
+		{"bad duration", write("duration.json", `{"session_lifetime": "soon"}`), nil, "invalid duration"},
+		{"invalid file value", write("versions.json", `{"max_versions": 0}`), []string{"-listen", "localhost:0"}, "max_versions must be at least 1, got 0"},
+		{"invalid flag", "", []string{"-listen", "localhost:0", "-max-versions", "0"}, "max_versions must be at least 1, got 0"},
+		{"no address to listen on", "", nil, "listen must be set"},
+	}
+	for _, test := range tests {
+		config = Config{MaxVersions: 42}
+		flags, overrides := testFlags(t, test.flags...)
+		err := loadConfig(flags, test.file, overrides, nil, true)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%v: loadConfig() = %v, want an error with %q", test.what, err, test.want)
+		}
+		if config.MaxVersions != 42 {
+			t.Errorf("%v: config was changed by a failed loadConfig()", test.what)
+		}
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	dir := tempDirs(t, 1)[0]
+	file := filepath.Join(dir, "file")
+	err := ioutil.WriteFile(file, nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Mkdir(filepath.Join(dir, "db_dir"), 0775)
+
+	tests := []struct {
+		what   string
+		change func(c *Config)
+		want   string // "" if valid
+	}{
+		{"defaults", func(c *Config) {}, ""},
+		{"no data_dir", func(c *Config) { c.DataDir = "" }, "data_dir must be set"},
+		{"missing data_dir", func(c *Config) { c.DataDir = filepath.Join(dir, "missing") }, "does not exist"},
+		{"data_dir is a file", func(c *Config) { c.DataDir = file }, "is not a directory"},
+		{"no database", func(c *Config) { c.Database = "" }, "database must be set"},
+		{"database is a directory", func(c *Config) { c.Database = "db_dir" }, "is a directory"},
+		{"no listen", func(c *Config) { c.Listen = "" }, "listen must be set"},
+		{"max_concurrent_requests 0", func(c *Config) { c.MaxConcurrent = 0 }, "max_concurrent_requests must be at least 1"},
+		{"user_quota 0", func(c *Config) { c.UserQuota = 0 }, "user_quota must be a positive number"},
+		{"total_storage below user_quota", func(c *Config) { c.TotalStorage = c.UserQuota - 1 }, "total_storage"},
+		{"total_storage at user_quota", func(c *Config) { c.TotalStorage = c.UserQuota }, ""},
+		{"session_lifetime 0", func(c *Config) { c.SessionLifetime = 0 }, "session_lifetime must be positive"},
+		{"max_name_length 0", func(c *Config) { c.MaxNameLength = 0 }, "max_name_length must be between 1 and 255"},
+		{"max_name_length 256", func(c *Config) { c.MaxNameLength = 256 }, "max_name_length must be between 1 and 255"},
+		{"max_name_length 255", func(c *Config) { c.MaxNameLength = 255 }, ""},
+		{"max_nesting 0", func(c *Config) { c.MaxNesting = 0 }, "max_nesting must be at least 1"},
+		{"trash_retention 0", func(c *Config) { c.TrashRetention = 0 }, "trash_retention must be positive"},
+		{"max_versions 0", func(c *Config) { c.MaxVersions = 0 }, "max_versions must be at least 1"},
+		{"max_versions 1", func(c *Config) { c.MaxVersions = 1 }, ""},
+		{"login_backoff 0", func(c *Config) { c.LoginBackoff = 0 }, "login_backoff must be positive"},
+		{"max_login_failures 0", func(c *Config) { c.MaxLoginFailures = 0 }, "max_login_failures must be at least 1"},
+		{"lockout_duration below login_backoff", func(c *Config) { c.LockoutDuration = c.LoginBackoff - 1 }, "lockout_duration"},
+		{"signups_per_hour 0", func(c *Config) { c.SignupsPerHour = 0 }, "signups_per_hour must be at least 1"},
+		{"password_min_length 0", func(c *Config) { c.PasswordMinLength = 0 }, "password_min_length must be at least 1"},
+		{"unknown password class", func(c *Config) { c.PasswordClasses = nameList{"digit", "emoji"} }, `unknown class "emoji"`},
+		{"no password classes", func(c *Config) { c.PasswordClasses = nil }, ""},
+		{"missing password_deny_list", func(c *Config) { c.PasswordDenyList = "missing.txt" }, "password_deny_list"},
+		{"password_deny_list in data_dir", func(c *Config) { c.PasswordDenyList = "file" }, ""},
+		{"password_history -1", func(c *Config) { c.PasswordHistory = -1 }, "password_history must not be negative"},
+		{"password_history 0", func(c *Config) { c.PasswordHistory = 0 }, ""},
+		{"argon2_time 0", func(c *Config) { c.Argon2Time = 0 }, "argon2_time must be at least 1"},
+		{"argon2_threads 0", func(c *Config) { c.Argon2Threads = 0 }, "argon2_threads must be between 1 and 255"},
+		{"argon2_threads 256", func(c *Config) { c.Argon2Threads = 256 }, "argon2_threads must be between 1 and 255"},
+		{"argon2_memory too small", func(c *Config) { c.Argon2Memory = 8 * c.Argon2Threads - 1 }, "argon2_memory must be between"},
+		{"argon2_memory smallest", func(c *Config) { c.Argon2Memory = 8 * c.Argon2Threads }, ""},
+		{"argon2_key_len 15", func(c *Config) { c.Argon2KeyLen = 15 }, "argon2_key_len must be between 16 and 1024"},
+		{"argon2_key_len 1025", func(c *Config) { c.Argon2KeyLen = 1025 }, "argon2_key_len must be between 16 and 1024"},
+	}
+	for _, test := range tests {
+		c := defaultConfig()
+		c.DataDir = dir
+		c.Listen = "localhost:0"
+		test.change(&c)
+		err := c.validate(true)
+		if test.want == "" && err != nil {
+			t.Errorf("%v: validate() = %v, want nil", test.what, err)
+		} else if test.want != "" && (err == nil || !strings.Contains(err.Error(), test.want)) {
+			t.Errorf("%v: validate() = %v, want an error with %q", test.what, err, test.want)
+		}
+	}
+
+	// an address is only needed to listen, and paths come out absolute
+	c := defaultConfig()
+	c.DataDir = dir
+	c.PasswordDenyList = "file"
+	err = c.validate(false)
+	if err != nil {
+		t.Fatalf("validate(false) without listen: %v", err)
+	}
+	if c.Database != filepath.Join(dir, DEFAULT_DATABASE) || c.PasswordDenyList != file {
+		t.Errorf("validate() paths = %q, %q, want them in %v", c.Database, c.PasswordDenyList, dir)
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// --fsck compares the database with the user roots on disk and reports what
+// does not match up; with --repair it also fixes it. Files are never deleted:
+// roots (and their versions and trash) which belong to no user are moved into
+// LOST_DIR for an admin to look at.
+
+const LOST_DIR = "lost+found/" // orphaned roots moved aside by --fsck --repair, under abs_base_dir
+
+// names newToken(TOKEN_ROOT) makes
+var root_name = regexp.MustCompile("^r[0-9a-f]{32}$")
+
+/*
+ * fsck() - checks that the database and the files on disk agree, and prints
+ * 			every problem found
+ *
+ * Parameters: repair: a boolean, true to fix the problems found as well
+ * Returns: an int with the number of problems found, an int with the number
+ * 				repaired, and an error if the check itself could not be done
+ */
+func fsck(repair bool) (int, int, error) {
+	found := 0
+	fixed := 0
+	report := func(problem string, fix func() error) {
+		found++
+		if !repair {
+			fmt.Println(problem)
+			return
+		}
+		err := fix()
+		if err != nil {
+			fmt.Printf("%v (could not repair: %v)\n", problem, err)
+			return
+		}
+		fixed++
+		fmt.Printf("%v (repaired)\n", problem)
+	}
+
+	// users and their roots
+	rows, err := db.Query("SELECT username, root FROM metadata")
+	if err != nil {
+		return found, fixed, err
+	}
+	users := make(map[string]string) // root -> username
+	for rows.Next() {
+		var username, root string
+		rows.Scan(&username, &root)
+		users[root] = username
+	}
+	rows.Close()
+
+	// signups and deletions a running server has in flight, whose roots are
+	// not orphaned yet
+	rows, err = db.Query("SELECT root FROM pending_ops")
+	if err != nil {
+		return found, fixed, err
+	}
+	pending := make(map[string]bool)
+	for rows.Next() {
+		var root string
+		rows.Scan(&root)
+		pending[root] = true
+	}
+	rows.Close()
+
+	// roots without a user, also among the versions and trash kept per root
+	for _, dir := range []string{"", VERSIONS_DIR, TRASH_DIR} {
+		files, _ := ioutil.ReadDir(abs_base_dir + dir)
+		for _, fi := range files {
+			name := fi.Name()
+			if !fi.IsDir() || !root_name.MatchString(name) {
+				continue
+			}
+			if _, ok := users[name]; ok || pending[name] {
+				continue
+			}
+			from := abs_base_dir + dir + name
+			report(fmt.Sprintf("orphaned root: %v belongs to no user", from), func() error {
+				to := abs_base_dir + LOST_DIR + dir + name
+				err := os.MkdirAll(abs_base_dir + LOST_DIR + dir, 0775)
+				if err != nil {
+					return err
+				}
+				if _, err := os.Lstat(to); err == nil {
+					to = fmt.Sprintf("%v.%v", to, time.Now().UTC().UnixNano())
+				}
+				return os.Rename(from, to)
+			})
+		}
+	}
+
+	// users without a root
+	for root, username := range users {
+		fi, err := os.Stat(abs_base_dir + root)
+		if (err == nil && fi.IsDir()) || pending[root] {
+			continue
+		}
+		report(fmt.Sprintf("missing root: %v of user %v does not exist", abs_base_dir + root, username), func() error {
+			if err == nil {
+				return fmt.Errorf("not a directory, move it aside first")
+			}
+			return os.Mkdir(abs_base_dir + root, 0775)
+		})
+	}
+
+	// usernames which belong to the same user, from before they were canonical;
+	// which account should be renamed or deleted is up to an admin
+	rows, err = db.Query("SELECT username FROM u_p")
+	if err != nil {
+		return found, fixed, err
+	}
+	var usernames []string
+	for rows.Next() {
+		var username string
+		rows.Scan(&username)
+		usernames = append(usernames, username)
+	}
+	rows.Close()
+	for _, group := range usernameCollisions(usernames) {
+		report(fmt.Sprintf("username collision: users %v only differ in case or Unicode form", strings.Join(group, ", ")), func() error {
+			return fmt.Errorf("delete all but one of them")
+		})
+	}
+
+	// sessions of users which no longer exist
+	rows, err = db.Query("SELECT session_id, username FROM sessions WHERE username NOT IN (SELECT username FROM metadata)")
+	if err != nil {
+		return found, fixed, err
+	}
+	var sessions, session_users []string
+	for rows.Next() {
+		var session_id, username string
+		rows.Scan(&session_id, &username)
+		sessions = append(sessions, session_id)
+		session_users = append(session_users, username)
+	}
+	rows.Close()
+	for i, session_id := range sessions {
+		report(fmt.Sprintf("stale session: %v... of deleted user %v", session_id[:8], session_users[i]), func() error {
+			return deleteSession(session_id)
+		})
+	}
+
+	// pwds pointing outside of the root, or at nothing
+	rows, err = db.Query("SELECT session_pwd.session_id, session_pwd.pwd, sessions.username, metadata.root FROM session_pwd LEFT JOIN sessions ON sessions.session_id = session_pwd.session_id LEFT JOIN metadata ON metadata.username = sessions.username")
+	if err != nil {
+		return found, fixed, err
+	}
+	var pwd_sessions, pwds, pwd_users, pwd_roots []string
+	for rows.Next() {
+		var session_id, pwd string
+		var username, root *string
+		rows.Scan(&session_id, &pwd, &username, &root)
+		if username != nil && root == nil {
+			// the session of a deleted user, reported above
+			continue
+		}
+		if username == nil {
+			username = new(string)
+			root = new(string)
+		}
+		pwd_sessions = append(pwd_sessions, session_id)
+		pwds = append(pwds, pwd)
+		pwd_users = append(pwd_users, *username)
+		pwd_roots = append(pwd_roots, *root)
+	}
+	rows.Close()
+	for i, session_id := range pwd_sessions {
+		if pwd_roots[i] == "" {
+			report(fmt.Sprintf("stale pwd: session %v... no longer exists", session_id[:8]), func() error {
+				_, err := db.Exec("DELETE FROM session_pwd WHERE session_id = ?", session_id)
+				return err
+			})
+			continue
+		}
+		problem := ""
+		pwd := pwds[i]
+		if !strings.HasPrefix(pwd, "/") || strings.Contains("/" + pwd + "/", "/../") {
+			problem = "points outside of the root"
+		} else if fi, err := os.Stat(abs_base_dir + pwd_roots[i] + pwd); err != nil || !fi.IsDir() {
+			problem = "is not a directory"
+		}
+		if problem == "" {
+			continue
+		}
+		report(fmt.Sprintf("bad pwd: %q of user %v %v", pwd, pwd_users[i], problem), func() error {
+			setSessionPWD(session_id, "/")
+			return nil
+		})
+	}
+
+	// stored usage which drifted from what is on disk, with the root locked so
+	// nothing changes while measuring (not that anything should be running)
+	for root, username := range users {
+		if _, err := os.Stat(abs_base_dir + root); err != nil {
+			continue
+		}
+		unlock := lockRoot(root)
+		stored, err := getUsage(root)
+		usage := measureUsage(root)
+		if err != nil || int64(stored) != usage {
+			old := "none"
+			if err == nil {
+				old = fmt.Sprint(stored)
+			}
+			report(fmt.Sprintf("usage drift: user %v has stored usage %v, on disk %v", username, old, usage), func() error {
+				_, err := db.Exec("INSERT OR REPLACE INTO usage (root, bytes) VALUES (?, ?)", root, usage)
+				return err
+			})
+		}
+		unlock()
+	}
+
+	return found, fixed, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestFsck(t *testing.T) {
+	setUp(t)
+	signUp(t, "alice")
+	signUp(t, "bob")
+	err, alice_root := rootForUsername("alice")
+	mustOK(t, "rootForUsername()", err)
+
+	if found, fixed, err := fsck(false); found != 0 || fixed != 0 || err != nil {
+		t.Fatalf("fsck(false) of a clean tree = %v, %v, %v, want 0, 0, nil", found, fixed, err)
+	}
+
+	orphan := "r" + strings.Repeat("a", 32)
+	in_flight := "r" + strings.Repeat("b", 32)
+	for _, s := range []string{
+		// stale session, and a pwd of a session which is gone
+		"INSERT INTO sessions (session_id, username, expiration_date) VALUES ('ghostsession', 'ghost', 0)",
+		"INSERT INTO session_pwd (session_id, pwd) VALUES ('gonesession', '/')",
+		// bad pwd
+		"INSERT OR REPLACE INTO session_pwd (session_id, pwd) SELECT session_id, '/nowhere' FROM sessions WHERE username = 'alice'",
+		// usage drift
+		"UPDATE usage SET bytes = 1 WHERE root = '" + alice_root + "'",
+		// a signup in flight, which is not orphaned
+		"INSERT INTO pending_ops (root, kind, username, started) VALUES ('" + in_flight + "', 'signup', 'carol', 0)",
+	} {
+		_, err := db.Exec(s)
+		if err != nil {
+			t.Fatalf("%v: %v", s, err)
+		}
+	}
+	// orphaned root and versions, and missing root
+	for _, dir := range []string{orphan, VERSIONS_DIR + orphan, in_flight} {
+		err := os.MkdirAll(abs_base_dir + dir, 0775)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.RemoveAll(rootOf(t, "bob"))
+	const problems = 7
+
+	// checking only reports, bob's pwd too as long as bob's root is missing
+	if found, fixed, err := fsck(false); found != problems + 1 || fixed != 0 || err != nil {
+		t.Errorf("fsck(false) = %v, %v, %v, want %v, 0, nil", found, fixed, err, problems + 1)
+	}
+	if _, err := os.Stat(abs_base_dir + orphan); err != nil {
+		t.Errorf("fsck(false) moved the orphaned root: %v", err)
+	}
+	if _, err := os.Stat(rootOf(t, "bob")); err == nil {
+		t.Errorf("fsck(false) made the missing root")
+	}
+
+	if found, fixed, err := fsck(true); found != problems || fixed != problems || err != nil {
+		t.Errorf("fsck(true) = %v, %v, %v, want %v, %v, nil", found, fixed, err, problems, problems)
+	}
+	for _, dir := range []string{"", VERSIONS_DIR} {
+		if _, err := os.Stat(abs_base_dir + dir + orphan); err == nil {
+			t.Errorf("orphaned root %v is still there after repair", dir + orphan)
+		}
+		if _, err := os.Stat(abs_base_dir + LOST_DIR + dir + orphan); err != nil {
+			t.Errorf("orphaned root %v is not in %v after repair: %v", dir + orphan, LOST_DIR, err)
+		}
+	}
+	if _, err := os.Stat(abs_base_dir + in_flight); err != nil {
+		t.Errorf("root of a signup in flight was moved: %v", err)
+	}
+	if _, err := os.Stat(rootOf(t, "bob")); err != nil {
+		t.Errorf("missing root is still missing after repair: %v", err)
+	}
+	var pwd string
+	db.QueryRow("SELECT pwd FROM session_pwd WHERE session_id IN (SELECT session_id FROM sessions WHERE username = 'alice')").Scan(&pwd)
+	if pwd != "/" {
+		t.Errorf("pwd = %q after repair, want %q", pwd, "/")
+	}
+
+	if found, fixed, err := fsck(false); found != 0 || fixed != 0 || err != nil {
+		t.Errorf("fsck(false) after repair = %v, %v, %v, want 0, 0, nil", found, fixed, err)
+	}
+}
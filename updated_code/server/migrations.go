@@ -0,0 +1,260 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// The database schema is built up by the migrations below, in order. The
+// schema_version table holds the version of the last one applied, so on
+// startup only newer migrations run, each in its own transaction together with
+// the bump of the version. Databases from before schema_version existed are at
+// version 0; every migration up to the first one added after it is written so
+// it can run again over the tables and columns it would create.
+//
+// To change the schema, append a migration; never edit or reorder one that has
+// shipped.
+
+type migration struct {
+	version int
+	name    string
+	apply   func(tx *sql.Tx) error
+}
+
+var migrations = []migration{
+	{1, "create sessions, u_p, metadata and user_pwd tables", func(tx *sql.Tx) error {
+		return execAll(tx,
+			"CREATE TABLE IF NOT EXISTS sessions (session_id TEXT PRIMARY KEY, username TEXT, expiration_date INTEGER)",
+			"CREATE TABLE IF NOT EXISTS u_p (username TEXT PRIMARY KEY, salt TEXT, hashword TEXT)",
+			"CREATE TABLE IF NOT EXISTS metadata (username TEXT PRIMARY KEY, root TEXT)",
+			"CREATE TABLE IF NOT EXISTS user_pwd (username TEXT PRIMARY KEY, pwd TEXT)")
+	}},
+	// sessions are per device, label them
+	{2, "add device and created to sessions", func(tx *sql.Tx) error {
+		err := addColumnIfMissing(tx, "sessions", "device", "TEXT")
+		if err != nil {
+			return err
+		}
+		return addColumnIfMissing(tx, "sessions", "created", "INTEGER")
+	}},
+	// record how each password was hashed, rows without are legacy sha256
+	{3, "add algorithm and params to u_p", func(tx *sql.Tx) error {
+		err := addColumnIfMissing(tx, "u_p", "algorithm", "TEXT")
+		if err != nil {
+			return err
+		}
+		return addColumnIfMissing(tx, "u_p", "params", "TEXT")
+	}},
+	// the present working directory is kept per session (relative to the root),
+	// instead of per username
+	{4, "replace user_pwd with session_pwd", func(tx *sql.Tx) error {
+		return execAll(tx,
+			"CREATE TABLE IF NOT EXISTS session_pwd (session_id TEXT PRIMARY KEY, pwd TEXT)",
+			"DROP TABLE IF EXISTS user_pwd")
+	}},
+	// path is relative to the owner's root
+	{5, "create shares table", func(tx *sql.Tx) error {
+		return execAll(tx,
+			"CREATE TABLE IF NOT EXISTS shares (owner TEXT, path TEXT, sharee TEXT, write_perm INTEGER, PRIMARY KEY (owner, path, sharee))")
+	}},
+	// unfinished chunked uploads (dest is the absolute path the user gave), the
+	// staging files live in UPLOAD_DIR
+	{6, "create uploads table", func(tx *sql.Tx) error {
+		return execAll(tx,
+			"CREATE TABLE IF NOT EXISTS uploads (upload_id TEXT PRIMARY KEY, username TEXT, dest TEXT, root TEXT, size INTEGER, hash TEXT, received INTEGER, updated INTEGER)")
+	}},
+	// old versions of files (path is relative to the root), the files themselves
+	// live in VERSIONS_DIR
+	{7, "create versions table", func(tx *sql.Tx) error {
+		return execAll(tx,
+			"CREATE TABLE IF NOT EXISTS versions (version_id TEXT PRIMARY KEY, root TEXT, path TEXT, version INTEGER, size INTEGER, mod_time INTEGER, saved INTEGER)")
+	}},
+	// removed files (path is where they were removed from, relative to the root),
+	// the files themselves live in TRASH_DIR
+	{8, "create trash table", func(tx *sql.Tx) error {
+		return execAll(tx,
+			"CREATE TABLE IF NOT EXISTS trash (trash_id TEXT PRIMARY KEY, root TEXT, path TEXT, is_dir INTEGER, size INTEGER, removed INTEGER)")
+	}},
+	// the storage charged to each root, filled in from disk by recomputeUsage()
+	{9, "create usage table", func(tx *sql.Tx) error {
+		return execAll(tx,
+			"CREATE TABLE IF NOT EXISTS usage (root TEXT PRIMARY KEY, bytes INTEGER)")
+	}},
+	// per-user quota in bytes, NULL for config.UserQuota
+	{10, "add quota to metadata", func(tx *sql.Tx) error {
+		return addColumnIfMissing(tx, "metadata", "quota", "INTEGER")
+	}},
+	// signups and deletions in progress, see accounts.go
+	{11, "create pending_ops table", func(tx *sql.Tx) error {
+		return execAll(tx,
+			"CREATE TABLE IF NOT EXISTS pending_ops (root TEXT PRIMARY KEY, kind TEXT, username TEXT, started INTEGER)")
+	}},
+	// failed logins per username and per client address, and recent signups
+	// per address, see ratelimit.go
+	{12, "create login_failures and signup_log tables", func(tx *sql.Tx) error {
+		return execAll(tx,
+			"CREATE TABLE IF NOT EXISTS login_failures (key TEXT PRIMARY KEY, failures INTEGER, last INTEGER, locked_until INTEGER)",
+			"CREATE TABLE IF NOT EXISTS signup_log (addr TEXT, created INTEGER)")
+	}},
+	// two-factor secrets (enabled once confirmed), hashed recovery codes, and
+	// logins waiting for a code, see totp.go
+	{13, "create two_factor, recovery_codes and pending_logins tables", func(tx *sql.Tx) error {
+		return execAll(tx,
+			"CREATE TABLE IF NOT EXISTS two_factor (username TEXT PRIMARY KEY, secret TEXT, enabled INTEGER, last_period INTEGER)",
+			"CREATE TABLE IF NOT EXISTS recovery_codes (username TEXT, code_hash TEXT, PRIMARY KEY (username, code_hash))",
+			"CREATE TABLE IF NOT EXISTS pending_logins (token_hash TEXT PRIMARY KEY, username TEXT, device TEXT, expires INTEGER)")
+	}},
+	// one-time password reset tokens issued by --reset-password, see passwd.go
+	{14, "create password_resets table", func(tx *sql.Tx) error {
+		return execAll(tx,
+			"CREATE TABLE IF NOT EXISTS password_resets (username TEXT PRIMARY KEY, token_hash TEXT, expires INTEGER)")
+	}},
+	// earlier password hashes of each user, for the password_history rule of
+	// the password policy, see policy.go
+	{15, "create password_history table", func(tx *sql.Tx) error {
+		return execAll(tx,
+			"CREATE TABLE IF NOT EXISTS password_history (username TEXT, salt TEXT, hashword TEXT, algorithm TEXT, params TEXT, created INTEGER)")
+	}},
+	// the form of each username that decides which user it is, see usernames.go;
+	// users whose names collide are only reported, an admin has to sort them out
+	{16, "add username_key to u_p", func(tx *sql.Tx) error {
+		err := addColumnIfMissing(tx, "u_p", "username_key", "TEXT")
+		if err != nil {
+			return err
+		}
+		rows, err := tx.Query("SELECT username FROM u_p")
+		if err != nil {
+			return err
+		}
+		var usernames []string
+		for rows.Next() {
+			var username string
+			rows.Scan(&username)
+			usernames = append(usernames, username)
+		}
+		rows.Close()
+		for _, username := range usernames {
+			_, err = tx.Exec("UPDATE u_p SET username_key = ? WHERE username = ?", usernameKey(username), username)
+			if err != nil {
+				return err
+			}
+		}
+		for _, group := range usernameCollisions(usernames) {
+			fmt.Printf("warning: users %v only differ in case or Unicode form, each can only log in with its exact name\n", strings.Join(group, ", "))
+		}
+		return execAll(tx, "CREATE INDEX IF NOT EXISTS u_p_username_key ON u_p (username_key)")
+	}},
+}
+
+/*
+ * execAll() - runs statements one after the other in a transaction
+ *
+ * Parameters:
+ * 		- tx: the transaction to run them in
+ * 		- statements: the sql statements
+ * Returns: an error from the first statement that failed
+ */
+func execAll(tx *sql.Tx, statements ...string) error {
+	for _, s := range statements {
+		_, err := tx.Exec(s)
+		if err != nil {
+			return fmt.Errorf("%v: %v", s, err)
+		}
+	}
+	return nil
+}
+
+/*
+ * addColumnIfMissing() - adds a column to a table unless the table has it
+ * 						already (sqlite has no ADD COLUMN IF NOT EXISTS)
+ *
+ * Parameters:
+ * 		- tx: the transaction to add it in
+ * 		- table: a string representing the name of the table
+ * 		- column: a string representing the name of the column
+ * 		- kind: a string representing the type of the column
+ * Returns: an error if the table could not be read or changed
+ */
+func addColumnIfMissing(tx *sql.Tx, table string, column string, kind string) error {
+	rows, err := tx.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return err
+	}
+	found := false
+	for rows.Next() {
+		var name string
+		rows.Scan(&name)
+		if name == column {
+			found = true
+		}
+	}
+	rows.Close()
+	if found {
+		return nil
+	}
+	return execAll(tx, fmt.Sprintf("ALTER TABLE %v ADD COLUMN %v %v", table, column, kind))
+}
+
+/*
+ * schemaVersion() - gets the version of the schema the database is at
+ *
+ * Parameters: none
+ * Returns: an int with the version, 0 for a database from before versioning or
+ * 				a new one, and an error if it could not be read
+ */
+func schemaVersion() (int, error) {
+	_, err := db.Exec("CREATE TABLE IF NOT EXISTS schema_version (version INTEGER)")
+	if err != nil {
+		return 0, err
+	}
+	version := 0
+	err = db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version)
+	return version, err
+}
+
+/*
+ * migrate() - brings the database schema up to date, applying every migration
+ * 			newer than its version in order
+ *
+ * Parameters: none
+ * Returns: an error if the schema is newer than this server knows, or if a
+ * 				migration failed (it is rolled back, earlier ones stay applied)
+ */
+func migrate() error {
+	current, err := schemaVersion()
+	if err != nil {
+		return fmt.Errorf("could not read schema version: %v", err)
+	}
+	latest := migrations[len(migrations) - 1].version
+	if current > latest {
+		return fmt.Errorf("database schema version %v is newer than this server supports (%v), refusing to run", current, latest)
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		err = m.apply(tx)
+		if err == nil {
+			err = execAll(tx, "DELETE FROM schema_version")
+		}
+		if err == nil {
+			_, err = tx.Exec("INSERT INTO schema_version (version) VALUES (?)", m.version)
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %v (%v) failed: %v", m.version, m.name, err)
+		}
+		err = tx.Commit()
+		if err != nil {
+			return fmt.Errorf("migration %v (%v) failed: %v", m.version, m.name, err)
+		}
+		fmt.Printf("applied migration %v: %v\n", m.version, m.name)
+	}
+	return nil
+}
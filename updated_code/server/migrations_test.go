@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"testing"
+)
+
+// a database as the first version of the server left it, before schema_version
+var v1_schema = []string{
+	"CREATE TABLE sessions (session_id TEXT PRIMARY KEY, username TEXT, expiration_date INTEGER)",
+	"CREATE TABLE u_p (username TEXT PRIMARY KEY, salt TEXT, hashword TEXT)",
+	"CREATE TABLE metadata (username TEXT PRIMARY KEY, root TEXT)",
+	"CREATE TABLE user_pwd (username TEXT PRIMARY KEY, pwd TEXT)",
+}
+
+// makeV1DB fills the empty database with the v1 schema and a user "Alice"
+// whose password is hashed the legacy way
+func makeV1DB(t *testing.T) {
+	for _, s := range v1_schema {
+		_, err := db.Exec(s)
+		if err != nil {
+			t.Fatalf("%v: %v", s, err)
+		}
+	}
+	sum := sha256.Sum256([]byte(TEST_PASSWORD + "salt"))
+	root := "r0123456789abcdef0123456789abcdef"
+	_, err := db.Exec("INSERT INTO u_p (username, salt, hashword) VALUES ('Alice', 'salt', ?)", hex.EncodeToString(sum[:]))
+	if err == nil {
+		_, err = db.Exec("INSERT INTO metadata (username, root) VALUES ('Alice', ?)", root)
+	}
+	if err == nil {
+		_, err = db.Exec("INSERT INTO user_pwd (username, pwd) VALUES ('Alice', '/docs')")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(abs_base_dir + root + "/docs", 0775)
+}
+
+func TestMigrateV1(t *testing.T) {
+	setUpUnmigrated(t)
+	makeV1DB(t)
+
+	err := migrate()
+	if err != nil {
+		t.Fatalf("migrate(): %v", err)
+	}
+	latest := migrations[len(migrations) - 1].version
+	if version, _ := schemaVersion(); version != latest {
+		t.Errorf("schemaVersion() = %v after migrate(), want %v", version, latest)
+	}
+
+	// every table the server uses is there, with the columns added later
+	for _, s := range []string{
+		"SELECT session_id, username, expiration_date, device, created FROM sessions",
+		"SELECT username, salt, hashword, algorithm, params, username_key FROM u_p",
+		"SELECT username, root, quota FROM metadata",
+		"SELECT session_id, pwd FROM session_pwd",
+		"SELECT owner, path, sharee, write_perm FROM shares",
+		"SELECT root, bytes FROM usage",
+		"SELECT key, failures, last, locked_until FROM login_failures",
+		"SELECT username, salt, hashword, algorithm, params, created FROM password_history",
+	} {
+		rows, err := db.Query(s)
+		if err != nil {
+			t.Errorf("%v: %v", s, err)
+			continue
+		}
+		rows.Close()
+	}
+	if _, err := db.Exec("SELECT * FROM user_pwd"); err == nil {
+		t.Errorf("user_pwd still exists after migrate()")
+	}
+
+	// the existing user logs in by any form of the name, and is rehashed
+	var key string
+	db.QueryRow("SELECT username_key FROM u_p WHERE username = 'Alice'").Scan(&key)
+	if key != usernameKey("Alice") {
+		t.Errorf("username_key = %q, want %q", key, usernameKey("Alice"))
+	}
+	ret := loginHandler("addr", "alice", TEST_PASSWORD, "test")
+	mustOK(t, "loginHandler()", ret.Err)
+	var algorithm string
+	db.QueryRow("SELECT algorithm FROM u_p WHERE username = 'Alice'").Scan(&algorithm)
+	if algorithm != PASSWORD_ALGO_ARGON2ID {
+		t.Errorf("algorithm = %q after login, want %q", algorithm, PASSWORD_ALGO_ARGON2ID)
+	}
+	mustOK(t, "listHandler()", listHandler(ret.Cookie, "docs").Err)
+
+	// running it again changes nothing
+	err = migrate()
+	if err != nil {
+		t.Errorf("second migrate(): %v", err)
+	}
+	if version, _ := schemaVersion(); version != latest {
+		t.Errorf("schemaVersion() = %v after second migrate(), want %v", version, latest)
+	}
+}
+
+func TestMigrateUnversioned(t *testing.T) {
+	setUpUnmigrated(t)
+	makeV1DB(t)
+
+	// servers from before schema_version added columns and tables on startup,
+	// so version 0 may already have some of them
+	for _, s := range []string{
+		"ALTER TABLE sessions ADD COLUMN device TEXT",
+		"ALTER TABLE u_p ADD COLUMN algorithm TEXT",
+		"CREATE TABLE shares (owner TEXT, path TEXT, sharee TEXT, write_perm INTEGER, PRIMARY KEY (owner, path, sharee))",
+	} {
+		_, err := db.Exec(s)
+		if err != nil {
+			t.Fatalf("%v: %v", s, err)
+		}
+	}
+
+	err := migrate()
+	if err != nil {
+		t.Fatalf("migrate(): %v", err)
+	}
+	latest := migrations[len(migrations) - 1].version
+	if version, _ := schemaVersion(); version != latest {
+		t.Errorf("schemaVersion() = %v after migrate(), want %v", version, latest)
+	}
+}
+
+func TestMigrateNewerSchema(t *testing.T) {
+	setUp(t)
+	latest := migrations[len(migrations) - 1].version
+	_, err := db.Exec("UPDATE schema_version SET version = ?", latest + 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = migrate(); err == nil {
+		t.Errorf("migrate() of a newer schema succeeded, want an error")
+	}
+	if version, _ := schemaVersion(); version != latest + 1 {
+		t.Errorf("schemaVersion() = %v after refusing, want %v", version, latest + 1)
+	}
+}
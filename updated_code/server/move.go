@@ -0,0 +1,328 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"../internal"
+)
+
+/*
+ * walkTree() - gets the space a file or directory tree takes up the way
+ * 				checkSizeName() counts it, and its most nested directory
+ *
+ * Parameters: p: a string representing the full path to a file or directory
+ * Returns: an int with the size of all files in bytes plus that of an empty
+ * 				folder for every directory, and a string with the path of the
+ * 				most nested directory relative to p ("" if there is none below p)
+ */
+func walkTree(p string) (int, string) {
+	size := 0
+	deepest := ""
+	filepath.Walk(p, func(file string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if !fi.IsDir() {
+			size += int(fi.Size())
+			return nil
+		}
+		size += DIR_USAGE
+		rel := strings.TrimPrefix(file, p)
+		if strings.Count(rel, "/") > strings.Count(deepest, "/") {
+			deepest = rel
+		}
+		return nil
+	})
+	return size, deepest
+}
+
+/*
+ * copyFile() - copies the contents of a file to a new file
+ *
+ * Parameters:
+ * 		- src: a string representing the full path to the file to copy
+ * 		- dst: a string representing the full path to the new file
+ * Returns: an error if the file could not be copied
+ */
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY | os.O_CREATE | os.O_TRUNC, 0664)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err1 := out.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
+
+/*
+ * copyTree() - copies the contents of a directory into an existing directory
+ *
+ * Parameters:
+ * 		- src: a string representing the full path to the directory to copy
+ * 		- dst: a string representing the full path to the directory to copy into
+ * Returns: an error if something could not be copied
+ */
+func copyTree(src string, dst string) error {
+	files, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, fi := range files {
+		from := filepath.Join(src, fi.Name())
+		to := filepath.Join(dst, fi.Name())
+		if fi.IsDir() {
+			err = os.Mkdir(to, 0775)
+			if err == nil {
+				err = copyTree(from, to)
+			}
+		} else {
+			err = copyFile(from, to)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+ * resolveDestination() - works out the full path a move or copy ends up at,
+ * 					moving or copying into a directory keeps the name
+ *
+ * Parameters:
+ * 		- src: a string representing the full path to move or copy
+ * 		- src_info: the os.FileInfo of src
+ * 		- dst: a string representing the full destination path from performChecks()
+ *
+ * Returns: a tuple, with an internal.Error in the first part and the path in
+ * 				the second if it is valid, only a file may replace a file
+ */
+func resolveDestination(src string, src_info os.FileInfo, dst string) (internal.Error, string) {
+	if fi, err := os.Stat(dst); err == nil && fi.IsDir() {
+		dst = dst + "/" + filepath.Base(src)
+	}
+
+	if dst == src {
+		return internal.NewError(internal.InvalidArgument, "source and destination are the same"), ""
+	}
+	if strings.HasPrefix(dst, src + "/") {
+		return internal.NewError(internal.InvalidArgument, "cannot move or copy a directory into itself"), ""
+	}
+	if fi, err := os.Stat(dst); err == nil && (fi.IsDir() || src_info.IsDir()) {
+		return internal.NewError(internal.AlreadyExists, "something already exists at specified path"), ""
+	}
+	return internal.Error{}, dst
+}
+
+/*
+ * renamePaths() - points the shares, old versions and session pwds of a moved
+ * 					file or directory (and everything in it) to its new path
+ *
+ * Parameters:
+ * 		- username: a string representing the username of the owner
+ * 		- root: a string representing the owner's root
+ * 		- src_rel: a string representing the old path relative to the root
+ * 		- dst_rel: a string representing the new path relative to the root
+ * Returns: nothing
+ */
+func renamePaths(username string, root string, src_rel string, dst_rel string) {
+	// sqlite counts characters, not bytes
+	n := utf8.RuneCountInString(src_rel)
+
+	statement, _ := db.Prepare("UPDATE shares SET path = ? || substr(path, ?) WHERE owner = ? AND (path = ? OR substr(path, 1, ?) = ?)")
+	statement.Exec(dst_rel, n + 1, username, src_rel, n + 1, src_rel + "/")
+	statement, _ = db.Prepare("UPDATE versions SET path = ? || substr(path, ?) WHERE root = ? AND (path = ? OR substr(path, 1, ?) = ?)")
+	statement.Exec(dst_rel, n + 1, root, src_rel, n + 1, src_rel + "/")
+	statement, _ = db.Prepare("UPDATE session_pwd SET pwd = ? || substr(pwd, ?) WHERE session_id IN (SELECT session_id FROM sessions WHERE username = ?) AND (pwd = ? OR substr(pwd, 1, ?) = ?)")
+	statement.Exec(dst_rel, n + 1, username, src_rel, n + 1, src_rel + "/")
+}
+
+/*
+ * moveHandler() - moves or renames a file or directory within the user's root
+ *
+ * Parameters:
+ * 		- cookie: a string representing the user's cookie
+ * 		- src: a string representing the user-inputted path to move
+ * 		- dst: a string representing the user-inputted path to move to, if it
+ * 				is a directory src is moved into it
+ *
+ * Returns: an internal.Error, with code OK upon success
+ */
+func moveHandler(cookie string, src string, dst string) internal.Error {
+	// perform checks to validate user and action on both paths
+	err0, src := performChecks(cookie, src, ACCESS_OWNER)
+	if err0.Code != internal.OK {
+		return err0
+	}
+	err1, dst := performChecks(cookie, dst, ACCESS_OWNER)
+	if err1.Code != internal.OK {
+		return err1
+	}
+	_, username := authenticateRequest(cookie)
+	_, root := rootForUsername(username)
+	if src == abs_base_dir + root {
+		return internal.NewError(internal.PermissionDenied, "cannot move root directory")
+	}
+
+	unlock := lockRoot(root)
+	defer unlock()
+
+	fi, err := os.Stat(src)
+	if err != nil {
+		return internal.NewError(internal.NotFound, "could not find specified path")
+	}
+	err2, dst := resolveDestination(src, fi, dst)
+	if err2.Code != internal.OK {
+		return err2
+	}
+
+	// moving takes no extra space, but the new name and place have to be valid
+	str := checkName(dst)
+	if str.Code != internal.OK {
+		return str
+	}
+	if fi.IsDir() {
+		_, deepest := walkTree(src)
+		if !checkNestedPath(dst + deepest, root) {
+			return internal.NewError(internal.InvalidPath, fmt.Sprintf("Too many nested files in path, must be at most %v deep", config.MaxNesting))
+		}
+		if filepath.Dir(dst) != filepath.Dir(src) {
+			str = checkSubdirCount(filepath.Dir(dst))
+			if str.Code != internal.OK {
+				return str
+			}
+		}
+	}
+
+	// a file moved over another one takes over its place, history and shares
+	src_rel := strings.TrimPrefix(src, abs_base_dir + root)
+	dst_rel := strings.TrimPrefix(dst, abs_base_dir + root)
+	var replaced int64
+	if old, err := os.Stat(dst); err == nil {
+		err = saveVersion(dst)
+		if err != nil {
+			return internal.NewError(internal.Internal, "could not keep old version of file")
+		}
+		replaced = old.Size()
+		deleteVersionsWhere("root = ? AND path = ?", root, src_rel)
+		deleteSharesForPath(username, src_rel)
+	}
+
+	err = os.Rename(src, dst)
+	if err != nil {
+		return internal.NewError(internal.NotFound, "could not move to specified path, its directory may not exist")
+	}
+	addUsage(db, root, -replaced)
+	renamePaths(username, root, src_rel, dst_rel)
+
+	return internal.Error{}
+}
+
+/*
+ * copyHandler() - copies a file or directory, files shared with the user can
+ * 				be copied into their root, and files shared read/write can
+ * 				be copied over
+ *
+ * Parameters:
+ * 		- cookie: a string representing the user's cookie
+ * 		- src: a string representing the user-inputted path to copy
+ * 		- dst: a string representing the user-inputted path to copy to, if it
+ * 				is a directory src is copied into it
+ *
+ * Returns: an internal.Error, with code OK upon success
+ */
+func copyHandler(cookie string, src string, dst string) internal.Error {
+	// perform checks to validate user and action on both paths
+	err0, src := performChecks(cookie, src, ACCESS_READ)
+	if err0.Code != internal.OK {
+		return err0
+	}
+	err1, dst := performChecks(cookie, dst, ACCESS_WRITE)
+	if err1.Code != internal.OK {
+		return err1
+	}
+
+	// the copy is charged to the root it is made in, which stays locked from
+	// looking at the destination until the copy is in place
+	root := rootForPath(dst)
+	unlock := lockRoot(root)
+	defer unlock()
+
+	fi, err := os.Stat(src)
+	if err != nil {
+		return internal.NewError(internal.NotFound, "could not find specified path")
+	}
+	err2, dst := resolveDestination(src, fi, dst)
+	if err2.Code != internal.OK {
+		return err2
+	}
+	size, deepest := walkTree(src)
+	str := checkSizeName(size, dst)
+	if str.Code != internal.OK {
+		return str
+	}
+
+	if !fi.IsDir() {
+		tmp, err := ioutil.TempFile(abs_base_dir + UPLOAD_DIR, "copy")
+		if err != nil {
+			return internal.NewError(internal.Internal, "could not copy file")
+		}
+		tmp.Close()
+		err = copyFile(src, tmp.Name())
+		if err == nil {
+			err = os.Chmod(tmp.Name(), 0664)
+		}
+		if err != nil {
+			os.Remove(tmp.Name())
+			return internal.NewError(internal.Internal, "could not copy file")
+		}
+		str = replaceFile(tmp.Name(), dst)
+		if str.Code != internal.OK {
+			os.Remove(tmp.Name())
+		}
+		return str
+	}
+
+	// directories are copied next to the staging files, then moved into place
+	// in one go
+	if !checkNestedPath(dst + deepest, root) {
+		return internal.NewError(internal.InvalidPath, fmt.Sprintf("Too many nested files in path, must be at most %v deep", config.MaxNesting))
+	}
+	str = checkSubdirCount(filepath.Dir(dst))
+	if str.Code != internal.OK {
+		return str
+	}
+	tmp, err := ioutil.TempDir(abs_base_dir + UPLOAD_DIR, "copy")
+	if err != nil {
+		return internal.NewError(internal.Internal, "could not copy directory")
+	}
+	err = copyTree(src, tmp)
+	if err == nil {
+		err = os.Chmod(tmp, 0775)
+	}
+	if err != nil {
+		os.RemoveAll(tmp)
+		return internal.NewError(internal.Internal, "could not copy directory")
+	}
+	err = os.Rename(tmp, dst)
+	if err != nil {
+		os.RemoveAll(tmp)
+		return internal.NewError(internal.NotFound, "could not copy to specified path, its directory may not exist")
+	}
+	addUsage(db, root, int64(size))
+
+	return internal.Error{}
+}
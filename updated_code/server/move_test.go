@@ -0,0 +1,90 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"../internal"
+)
+
+func TestMoveCopyConfinement(t *testing.T) {
+	setUp(t)
+	alice := signUp(t, "alice")
+	bob := signUp(t, "bob")
+	err, bob_root := rootForUsername("bob")
+	mustOK(t, "rootForUsername()", err)
+
+	mustOK(t, "mkdir dir", mkdirHandler(alice, "dir"))
+	mustOK(t, "mkdir dir/sub", mkdirHandler(alice, "dir/sub"))
+	mustOK(t, "upload f.txt", uploadHandler(alice, "f.txt", []byte("alice")))
+	mustOK(t, "upload g.txt", uploadHandler(alice, "g.txt", []byte("alice")))
+	mustOK(t, "upload b.txt", uploadHandler(bob, "b.txt", []byte("bob")))
+
+	tests := []struct {
+		what string
+		err  internal.Error
+		want internal.ErrorCode
+	}{
+		// ".." never leaves the root
+		{"move out of the root", moveHandler(alice, "f.txt", "../../../f2.txt"), internal.OK},
+		{"copy out of the root", copyHandler(alice, "g.txt", "dir/../../../g2.txt"), internal.OK},
+		{"copy from bob's root by name", copyHandler(alice, "../" + bob_root + "/b.txt", "b.txt"), internal.NotFound},
+		{"move the root", moveHandler(alice, "/", "dir"), internal.PermissionDenied},
+		{"move the root by ..", moveHandler(alice, "dir/../..", "dir"), internal.PermissionDenied},
+
+		// nothing goes into itself
+		{"move dir onto itself", moveHandler(alice, "dir", "/dir"), internal.InvalidArgument},
+		{"move dir into itself", moveHandler(alice, "dir", "dir/sub"), internal.InvalidArgument},
+		{"move dir below itself", moveHandler(alice, "dir", "dir/sub/dir2"), internal.InvalidArgument},
+		{"copy dir into itself", copyHandler(alice, "dir", "dir/sub"), internal.InvalidArgument},
+		{"copy file onto itself", copyHandler(alice, "g2.txt", "./g2.txt"), internal.InvalidArgument},
+
+		// moves stay in the owner's root, copies need read and write access
+		{"move into bob's root", moveHandler(alice, "g2.txt", "~bob/b.txt"), internal.PermissionDenied},
+		{"move out of bob's root", moveHandler(alice, "~bob/b.txt", "b.txt"), internal.PermissionDenied},
+		{"copy from bob's root", copyHandler(alice, "~bob/b.txt", "b.txt"), internal.NotFound},
+		{"copy into bob's root", copyHandler(alice, "g2.txt", "~bob/b.txt"), internal.NotFound},
+	}
+	for _, test := range tests {
+		wantCode(t, test.what, test.err, test.want)
+	}
+
+	alice_root := rootOf(t, "alice")
+	for _, name := range []string{"f2.txt", "g2.txt"} {
+		if got := readFile(alice_root + name); got != "alice" {
+			t.Errorf("%v = %q in alice's root, want %q", name, got, "alice")
+		}
+		if _, err := os.Stat(abs_base_dir + name); err == nil {
+			t.Errorf("%v was written outside of alice's root", name)
+		}
+	}
+	if _, err := os.Stat(alice_root + "dir/sub"); err != nil {
+		t.Errorf("dir/sub is gone after failed moves: %v", err)
+	}
+
+	// a share lets bob copy out of alice's root, and over the file if it is
+	// read/write, but never move it
+	mustOK(t, "share f2.txt", shareHandler(alice, "f2.txt", "bob", false))
+	mustOK(t, "share g2.txt", shareHandler(alice, "g2.txt", "bob", true))
+	mustOK(t, "bob copies f2.txt", copyHandler(bob, "~alice/f2.txt", "f.txt"))
+	wantCode(t, "bob copies over f2.txt", copyHandler(bob, "b.txt", "~alice/f2.txt"), internal.PermissionDenied)
+	mustOK(t, "bob copies over g2.txt", copyHandler(bob, "b.txt", "~alice/g2.txt"))
+	wantCode(t, "bob moves g2.txt", moveHandler(bob, "~alice/g2.txt", "g.txt"), internal.PermissionDenied)
+	wantCode(t, "bob moves over g2.txt", moveHandler(bob, "b.txt", "~alice/g2.txt"), internal.PermissionDenied)
+
+	if got := readFile(rootOf(t, "bob") + "f.txt"); got != "alice" {
+		t.Errorf("bob's copy of f2.txt = %q, want %q", got, "alice")
+	}
+	if got := readFile(alice_root + "g2.txt"); got != "bob" {
+		t.Errorf("g2.txt = %q after bob copied over it, want %q", got, "bob")
+	}
+
+	// copies are charged to the root they are made in
+	for _, name := range []string{"alice", "bob"} {
+		err, root := rootForUsername(name)
+		mustOK(t, "rootForUsername()", err)
+		if usage, _ := getUsage(root); int64(usage) != measureUsage(root) {
+			t.Errorf("getUsage() of %v = %v, measureUsage() = %v", name, usage, measureUsage(root))
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"time"
+
+	"../internal"
+)
+
+// A logged in user changes their password with change_password, giving the
+// current one. A user who forgot theirs asks an admin, who runs
+// --reset-password to get a one-time reset token for them, valid for
+// RESET_TOKEN_LIFETIME; reset_password then sets a new password with it,
+// without logging in. Either way the new password has to meet the same policy
+// as at signup (see policy.go), and the user's other sessions are logged out.
+// Wrong passwords and tokens count as failed logins (see ratelimit.go).
+
+const RESET_TOKEN_LIFETIME = 24 * time.Hour // how long a password reset token can be used
+
+/*
+ * checkUserPassword() - checks the password of a user, the way loginHandler
+ * 						does but without logging in
+ *
+ * Parameters:
+ * 		- username: a string representing the user's username
+ * 		- password: a string representing the password to check
+ * Returns: a boolean, true if the user exists and the password is theirs
+ */
+func checkUserPassword(username string, password string) bool {
+	var salt_string, hashword string
+	var algorithm, params *string
+	err := db.QueryRow("SELECT salt, hashword, algorithm, params FROM u_p WHERE username = ?", username).Scan(&salt_string, &hashword, &algorithm, &params)
+	if err != nil {
+		return false
+	}
+
+	// legacy rows have no algorithm recorded
+	if algorithm == nil {
+		algorithm = new(string)
+	}
+	if params == nil {
+		params = new(string)
+	}
+	return verifyPassword(password, *algorithm, *params, salt_string, hashword)
+}
+
+/*
+ * setPassword() - stores a new password for a user and logs out their sessions,
+ * 					all or nothing
+ *
+ * Parameters:
+ * 		- username: a string representing the user's username
+ * 		- password: a string representing the new password, which met the policy
+ * 		- keep_session: a string representing the hashed cookie of a session to
+ * 				keep logged in, or "" to log out all of them
+ * Returns: an error if the password could not be changed, nothing is changed then
+ */
+func setPassword(username string, password string, keep_session string) error {
+	salt_string, err := newToken(TOKEN_SALT)
+	if err != nil {
+		return err
+	}
+	algorithm, params, hashword := hashPassword(password, salt_string)
+
+	// the current password counts as the first of the history (and sqlite
+	// takes a negative limit as no limit)
+	keep := config.PasswordHistory - 1
+	if keep < 0 {
+		keep = 0
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	exec := func(query string, args ...interface{}) {
+		if err == nil {
+			_, err = tx.Exec(query, args...)
+		}
+	}
+	// the old password goes into the history the policy checks, which only
+	// keeps what it needs
+	exec("INSERT INTO password_history (username, salt, hashword, algorithm, params, created) SELECT username, salt, hashword, COALESCE(algorithm, ''), COALESCE(params, ''), ? FROM u_p WHERE username = ?", time.Now().UTC().UnixNano(), username)
+	exec("DELETE FROM password_history WHERE username = ? AND rowid NOT IN (SELECT rowid FROM password_history WHERE username = ? ORDER BY created DESC LIMIT ?)", username, username, keep)
+	exec("UPDATE u_p SET salt = ?, hashword = ?, algorithm = ?, params = ? WHERE username = ?", salt_string, hashword, algorithm, params, username)
+	exec("DELETE FROM session_pwd WHERE session_id IN (SELECT session_id FROM sessions WHERE username = ? AND session_id != ?)", username, keep_session)
+	exec("DELETE FROM sessions WHERE username = ? AND session_id != ?", username, keep_session)
+	// logins waiting for a code got there with the old password
+	exec("DELETE FROM pending_logins WHERE username = ?", username)
+	exec("DELETE FROM password_resets WHERE username = ?", username)
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+	return err
+}
+
+/*
+ * changePasswordHandler() - changes the password of the user, logging out their
+ * 						sessions on other devices
+ *
+ * Parameters:
+ * 		- addr: a string representing the client's address, filled in by the rpc layer
+ * 		- cookie: a string representing the user's cookie
+ * 		- old_password: a string representing the user's current password
+ * 		- new_password: a string representing the password to change it to
+ * Returns: an internal.Error, with code OK upon success
+ */
+func changePasswordHandler(addr string, cookie string, old_password string, new_password string) internal.Error {
+	// check that request comes from valid user
+	err0, username := authenticateRequest(cookie)
+	if err0.Code != internal.OK {
+		return err0
+	}
+
+	// a stolen cookie must not be a way around the login throttling
+	unlock := lockLogin(addr, username)
+	defer unlock()
+	err_limit := checkLoginAllowed(addr, username)
+	if err_limit.Code != internal.OK {
+		return err_limit
+	}
+	if !checkUserPassword(username, old_password) {
+		recordLoginFailure(addr, username)
+		return internal.NewError(internal.InvalidCredentials, "current password is incorrect")
+	}
+	clearLoginFailures(addr, username)
+
+	err_policy := checkPasswordPolicy(username, new_password)
+	if err_policy.Code != internal.OK {
+		return err_policy
+	}
+	err := setPassword(username, new_password, hashCookie(cookie))
+	if err != nil {
+		return internal.NewError(internal.Internal, "could not change password")
+	}
+	return internal.Error{}
+}
+
+/*
+ * issueResetToken() - makes a one-time password reset token for a user, for the
+ * 					--reset-password option, replacing any earlier one, and unlocks
+ * 					the account so the token can be used
+ *
+ * Parameters: username: a string representing the user's username
+ * Returns: a string with the token, the time it expires, and an error if the
+ * 				user does not exist or the token could not be stored
+ */
+func issueResetToken(username string) (string, time.Time, error) {
+	username = resolveUsername(username)
+	var root string
+	err := db.QueryRow("SELECT root FROM metadata WHERE username = ?", username).Scan(&root)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("no such user %q", username)
+	}
+	token, err := newToken(TOKEN_RESET)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	expires := time.Now().UTC().Add(RESET_TOKEN_LIFETIME)
+	_, err = db.Exec("INSERT OR REPLACE INTO password_resets (username, token_hash, expires) VALUES (?, ?, ?)", username, hashCookie(token), expires.UnixNano())
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return token, expires, unlockUser(username)
+}
+
+/*
+ * resetPasswordHandler() - sets a new password for a user with a reset token
+ * 						from an admin, logging out all of their sessions
+ *
+ * Parameters:
+ * 		- addr: a string representing the client's address, filled in by the rpc layer
+ * 		- username: a string representing the user's username
+ * 		- token: a string representing the reset token
+ * 		- password: a string representing the new password
+ * Returns: an internal.Error, with code OK upon success
+ */
+func resetPasswordHandler(addr string, username string, token string, password string) internal.Error {
+	username = resolveUsername(username)
+
+	// guessing tokens is throttled like guessing passwords
+	unlock := lockLogin(addr, username)
+	defer unlock()
+	err_limit := checkLoginAllowed(addr, username)
+	if err_limit.Code != internal.OK {
+		return err_limit
+	}
+
+	var token_hash string
+	var expires int64
+	err := db.QueryRow("SELECT token_hash, expires FROM password_resets WHERE username = ?", username).Scan(&token_hash, &expires)
+	if err != nil || subtle.ConstantTimeCompare([]byte(token_hash), []byte(hashCookie(token))) != 1 {
+		recordLoginFailure(addr, username)
+		return internal.NewError(internal.InvalidCredentials, "invalid reset token")
+	}
+	if expires <= time.Now().UTC().UnixNano() {
+		db.Exec("DELETE FROM password_resets WHERE username = ?", username)
+		return internal.NewError(internal.SessionExpired, "reset token expired, ask an admin for a new one")
+	}
+
+	// the token stays usable until a password that meets the policy is set
+	err_policy := checkPasswordPolicy(username, password)
+	if err_policy.Code != internal.OK {
+		return err_policy
+	}
+
+	// then it is used up, and of concurrent redemptions only the one which
+	// deletes it gets to set the password
+	result, err := db.Exec("DELETE FROM password_resets WHERE username = ? AND token_hash = ? AND expires > ?", username, hashCookie(token), time.Now().UTC().UnixNano())
+	if err != nil {
+		return internal.NewError(internal.Internal, "could not reset password")
+	}
+	if n, err := result.RowsAffected(); err != nil || n != 1 {
+		return internal.NewError(internal.InvalidCredentials, "invalid reset token")
+	}
+	err = setPassword(username, password, "")
+	if err != nil {
+		return internal.NewError(internal.Internal, "could not reset password")
+	}
+	clearLoginFailures(addr, username)
+	return internal.Error{}
+}
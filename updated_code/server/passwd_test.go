@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"../internal"
+)
+
+func TestResetPassword(t *testing.T) {
+	setUp(t)
+	alice := signUp(t, "alice")
+	phone := logIn(t, "alice", "phone")
+	bob := signUp(t, "bob")
+
+	if _, _, err := issueResetToken("nobody"); err == nil {
+		t.Errorf("issueResetToken() of a missing user succeeded")
+	}
+	token, expires, err := issueResetToken("Alice")
+	if err != nil {
+		t.Fatalf("issueResetToken(): %v", err)
+	}
+	if wait := time.Until(expires); wait < RESET_TOKEN_LIFETIME - time.Minute || wait > RESET_TOKEN_LIFETIME {
+		t.Errorf("reset token expires in %v, want %v", wait, RESET_TOKEN_LIFETIME)
+	}
+
+	// a wrong token or a weak password leave the token usable
+	wantCode(t, "reset with a wrong token", resetPasswordHandler("r1", "alice", token + "x", "Reset-pass-2"), internal.InvalidCredentials)
+	waitOutBackoff(t, "user:alice")
+	waitOutBackoff(t, "addr:r1")
+	wantCode(t, "reset to a weak password", resetPasswordHandler("r1", "alice", token, "weak"), internal.WeakPassword)
+
+	// the reset logs out every session of the user, and no one else's
+	mustOK(t, "reset", resetPasswordHandler("r1", "alice", token, "Reset-pass-2"))
+	wantCode(t, "desktop after the reset", authenticateHandler(alice).Err, internal.Unauthenticated)
+	wantCode(t, "phone after the reset", authenticateHandler(phone).Err, internal.Unauthenticated)
+	mustOK(t, "bob after the reset", authenticateHandler(bob).Err)
+	wantCode(t, "old password", login("r2", "alice", TEST_PASSWORD), internal.InvalidCredentials)
+	waitOutBackoff(t, "user:alice")
+	mustOK(t, "new password", login("r3", "alice", "Reset-pass-2"))
+
+	// and uses the token up
+	wantCode(t, "reset again", resetPasswordHandler("r1", "alice", token, "Reset-pass-3"), internal.InvalidCredentials)
+	waitOutBackoff(t, "user:alice")
+	mustOK(t, "password after resetting again", login("r3", "alice", "Reset-pass-2"))
+}
+
+func TestResetPasswordExpired(t *testing.T) {
+	setUp(t)
+	alice := signUp(t, "alice")
+
+	token, _, err := issueResetToken("alice")
+	if err != nil {
+		t.Fatalf("issueResetToken(): %v", err)
+	}
+	db.Exec("UPDATE password_resets SET expires = ? WHERE username = 'alice'", time.Now().UTC().UnixNano() - 1)
+	wantCode(t, "reset with an expired token", resetPasswordHandler("r1", "alice", token, "Reset-pass-2"), internal.SessionExpired)
+	wantCode(t, "reset after expiring", resetPasswordHandler("r1", "alice", token, "Reset-pass-2"), internal.InvalidCredentials)
+
+	// nothing changed
+	mustOK(t, "session after expiring", authenticateHandler(alice).Err)
+	waitOutBackoff(t, "user:alice")
+	mustOK(t, "old password", login("r2", "alice", TEST_PASSWORD))
+}
+
+func TestChangePassword(t *testing.T) {
+	setUp(t)
+	alice := signUp(t, "alice")
+	laptop := logIn(t, "alice", "laptop")
+	bob := signUp(t, "bob")
+
+	wantCode(t, "change with a wrong password", changePasswordHandler("c1", alice, "wrong", "Changed-pass-2"), internal.InvalidCredentials)
+	waitOutBackoff(t, "user:alice")
+	waitOutBackoff(t, "addr:c1")
+	wantCode(t, "change to a weak password", changePasswordHandler("c1", alice, TEST_PASSWORD, "weak"), internal.WeakPassword)
+	mustOK(t, "laptop after failed changes", authenticateHandler(laptop).Err)
+
+	// the session changing the password stays, the user's others are logged out
+	mustOK(t, "change", changePasswordHandler("c1", alice, TEST_PASSWORD, "Changed-pass-2"))
+	mustOK(t, "desktop after the change", authenticateHandler(alice).Err)
+	wantCode(t, "laptop after the change", authenticateHandler(laptop).Err, internal.Unauthenticated)
+	mustOK(t, "bob after the change", authenticateHandler(bob).Err)
+	wantCode(t, "old password", login("c2", "alice", TEST_PASSWORD), internal.InvalidCredentials)
+	waitOutBackoff(t, "user:alice")
+	mustOK(t, "new password", login("c3", "alice", "Changed-pass-2"))
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Passwords are stored with the algorithm and its parameters next to the hash
+// in u_p, so the parameters can be tuned (with the argon2_* settings, see
+// config.go) or the algorithm replaced without breaking existing accounts: rows
+// hashed any other way than the current settings are rehashed the next time
+// their user logs in.
+
+const PASSWORD_ALGO_SHA256 = "sha256"     // legacy sha256(password + salt), never used for new hashes
+const PASSWORD_ALGO_ARGON2ID = "argon2id" // memory-hard, current algorithm
+
+/*
+ * argon2Params() - formats argon2id parameters for the params column in u_p
+ *
+ * Parameters: the time, memory, threads and key length parameters
+ * Returns: a string such as "t=1,m=65536,p=4,l=32"
+ */
+func argon2Params(time uint32, memory uint32, threads uint8, key_len uint32) string {
+	return fmt.Sprintf("t=%d,m=%d,p=%d,l=%d", time, memory, threads, key_len)
+}
+
+/*
+ * argon2Config() - gets the argon2id parameters new hashes are made with
+ *
+ * Parameters: none
+ * Returns: the time, memory, threads and key length parameters from config
+ */
+func argon2Config() (uint32, uint32, uint8, uint32) {
+	return uint32(config.Argon2Time), uint32(config.Argon2Memory), uint8(config.Argon2Threads), uint32(config.Argon2KeyLen)
+}
+
+/*
+ * hashPassword() - hashes a password with the current algorithm and parameters
+ *
+ * Parameters:
+ * 		- password: a string representing the user's password
+ * 		- salt: a string representing a freshly generated salt
+ * Returns: the algorithm, the parameters and the hex encoded hash, to be stored
+ * 		in u_p next to the salt
+ */
+func hashPassword(password string, salt string) (string, string, string) {
+	time, memory, threads, key_len := argon2Config()
+	key := argon2.IDKey([]byte(password), []byte(salt), time, memory, threads, key_len)
+	params := argon2Params(time, memory, threads, key_len)
+	return PASSWORD_ALGO_ARGON2ID, params, hex.EncodeToString(key)
+}
+
+/*
+ * verifyPassword() - checks a password against a stored hash in constant time,
+ * 						using the algorithm and parameters stored with it
+ *
+ * Parameters:
+ * 		- password: a string representing the password to check
+ * 		- algorithm: a string representing the stored algorithm ("" for legacy rows)
+ * 		- params: a string representing the stored parameters
+ * 		- salt: a string representing the stored salt
+ * 		- hashword: a string representing the stored hex encoded hash
+ * Returns: a boolean, true if the password matches
+ */
+func verifyPassword(password string, algorithm string, params string, salt string, hashword string) bool {
+	var computed string
+	switch algorithm {
+	case "", PASSWORD_ALGO_SHA256:
+		h := sha256.New()
+		h.Write([]byte(password + salt))
+		computed = hex.EncodeToString(h.Sum(nil))
+	case PASSWORD_ALGO_ARGON2ID:
+		var time, memory, key_len uint32
+		var threads uint8
+		_, err := fmt.Sscanf(params, "t=%d,m=%d,p=%d,l=%d", &time, &memory, &threads, &key_len)
+		if err != nil {
+			return false
+		}
+		key := argon2.IDKey([]byte(password), []byte(salt), time, memory, threads, key_len)
+		computed = hex.EncodeToString(key)
+	default:
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(hashword)) == 1
+}
+
+/*
+ * needsRehash() - checks if a stored hash was made with anything other than the
+ * 						current algorithm and parameters
+ *
+ * Parameters: the algorithm and parameters stored with the hash
+ * Returns: a boolean, true if the password should be hashed again
+ */
+func needsRehash(algorithm string, params string) bool {
+	return algorithm != PASSWORD_ALGO_ARGON2ID || params != argon2Params(argon2Config())
+}
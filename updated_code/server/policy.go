@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"../internal"
+)
+
+// New passwords, at signup, change or reset, have to pass every rule of
+// password_policy, which newPasswordPolicy() builds from the configuration:
+//
+//	password_min_length   at least this many characters
+//	password_classes      a character from each of these classes (see password_classes)
+//	password_deny_list    not in this file of common passwords, one per line
+//	password_no_username  not containing the username
+//	password_history      not one of the user's last this many passwords
+//
+// A password is checked against all of the rules, and every rule it fails is
+// reported, so the user can fix them all at once. To add a rule, write one
+// and append it in newPasswordPolicy().
+
+// a passwordRule checks one requirement, check returns "" if the password
+// meets it, and otherwise what the password must do, like "must contain a digit"
+type passwordRule struct {
+	name  string
+	check func(username string, password string) string
+}
+
+type passwordPolicy []passwordRule
+
+var password_policy passwordPolicy // the policy the server runs with, set by loadConfig()
+
+// the character classes password_classes can require, and how they are named
+// to users
+var password_classes = map[string]struct {
+	describe string
+	is       func(r rune) bool
+}{
+	"digit":  {"a digit", unicode.IsDigit},
+	"lower":  {"a lower-case letter", unicode.IsLower},
+	"upper":  {"an upper-case letter", unicode.IsUpper},
+	"symbol": {"a symbol", func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) }},
+}
+
+// usernames shorter than this would rule out too many passwords
+const MIN_USERNAME_IN_PASSWORD = 3
+
+/*
+ * newPasswordPolicy() - builds the password policy a configuration asks for,
+ * 						reading the deny list
+ *
+ * Parameters: c: the Config, already validated
+ * Returns: the passwordPolicy, and an error if the deny list could not be read
+ */
+func newPasswordPolicy(c Config) (passwordPolicy, error) {
+	var policy passwordPolicy
+
+	min_length := c.PasswordMinLength
+	policy = append(policy, passwordRule{"min_length", func(username string, password string) string {
+		if utf8.RuneCountInString(password) < min_length {
+			return fmt.Sprintf("must be at least %v characters long", min_length)
+		}
+		return ""
+	}})
+
+	for _, name := range c.PasswordClasses {
+		class := password_classes[name]
+		policy = append(policy, passwordRule{"class " + name, func(username string, password string) string {
+			if strings.IndexFunc(password, class.is) < 0 {
+				return "must contain " + class.describe
+			}
+			return ""
+		}})
+	}
+
+	if c.PasswordDenyList != "" {
+		denied, err := readDenyList(c.PasswordDenyList)
+		if err != nil {
+			return nil, err
+		}
+		policy = append(policy, passwordRule{"deny_list", func(username string, password string) string {
+			if denied[strings.ToLower(password)] {
+				return "is too common, choose one that is harder to guess"
+			}
+			return ""
+		}})
+	}
+
+	if c.PasswordNoUsername {
+		policy = append(policy, passwordRule{"no_username", func(username string, password string) string {
+			if utf8.RuneCountInString(username) >= MIN_USERNAME_IN_PASSWORD && strings.Contains(strings.ToLower(password), strings.ToLower(username)) {
+				return "must not contain the username"
+			}
+			return ""
+		}})
+	}
+
+	if c.PasswordHistory > 0 {
+		history := c.PasswordHistory
+		policy = append(policy, passwordRule{"history", func(username string, password string) string {
+			if usedPassword(username, password, history) {
+				return fmt.Sprintf("must not be one of the last %v passwords", history)
+			}
+			return ""
+		}})
+	}
+
+	return policy, nil
+}
+
+/*
+ * readDenyList() - reads a file of passwords that may not be used, one per line,
+ * 					ignoring case, blank lines and lines starting with "#"
+ *
+ * Parameters: file: a string representing the path to the file
+ * Returns: a set of the lower-cased passwords, and an error if the file could
+ * 				not be read
+ */
+func readDenyList(file string) (map[string]bool, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	denied := make(map[string]bool)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		denied[strings.ToLower(line)] = true
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("%v: %v", file, err)
+	}
+	return denied, nil
+}
+
+/*
+ * usedPassword() - checks a password against the current one of a user and
+ * 					the ones kept in password_history
+ *
+ * Parameters:
+ * 		- username: a string representing the user's username
+ * 		- password: a string representing the new password
+ * 		- history: an int representing how many of the latest passwords to check,
+ * 				including the current one
+ * Returns: a boolean, true if the password is one of them
+ */
+func usedPassword(username string, password string, history int) bool {
+	if checkUserPassword(username, password) {
+		return true
+	}
+	rows, err := db.Query("SELECT salt, hashword, algorithm, params FROM password_history WHERE username = ? ORDER BY created DESC LIMIT ?", username, history - 1)
+	if err != nil {
+		return false
+	}
+	var salts, hashwords, algorithms, params []string
+	for rows.Next() {
+		var salt, hashword, algorithm, param string
+		rows.Scan(&salt, &hashword, &algorithm, &param)
+		salts = append(salts, salt)
+		hashwords = append(hashwords, hashword)
+		algorithms = append(algorithms, algorithm)
+		params = append(params, param)
+	}
+	rows.Close()
+
+	// hashing is slow, do it after the rows are closed so others can use the db
+	for i := range salts {
+		if verifyPassword(password, algorithms[i], params[i], salts[i], hashwords[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * checkPasswordPolicy() - checks that a new password meets the password policy,
+ * 						for signups, password changes and resets alike
+ *
+ * Parameters:
+ * 		- username: a string representing the username the password is for
+ * 		- password: a string representing the new password
+ * Returns: an internal.Error, with code OK if the password may be used, or
+ * 				WeakPassword with every rule it failed in Details
+ */
+func checkPasswordPolicy(username string, password string) internal.Error {
+	var failed []string
+	for _, rule := range password_policy {
+		if problem := rule.check(username, password); problem != "" {
+			failed = append(failed, "password " + problem)
+		}
+	}
+	if len(failed) == 0 {
+		return internal.Error{}
+	}
+	err := internal.NewError(internal.WeakPassword, strings.Join(failed, "; "))
+	err.Details = failed
+	return err
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"../internal"
+)
+
+// setPolicy makes password_policy the policy of c until the test ends
+func setPolicy(t *testing.T, c Config) {
+	policy, err := newPasswordPolicy(c)
+	if err != nil {
+		t.Fatalf("newPasswordPolicy(): %v", err)
+	}
+	old := password_policy
+	password_policy = policy
+	t.Cleanup(func() { password_policy = old })
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	f, err := ioutil.TempFile("", "deny")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("# common passwords\nPassword123\n\n")
+	f.Close()
+
+	c := defaultConfig()
+	c.PasswordClasses = nameList{"digit", "lower", "upper", "symbol"}
+	c.PasswordDenyList = f.Name()
+	c.PasswordHistory = 0 // needs the database
+	setPolicy(t, c)
+
+	tests := []struct {
+		username string
+		password string
+		failed   []string
+	}{
+		{"alice", "G00d-enough", nil},
+		{"alice", "Ab1!", []string{"password must be at least 8 characters long"}},
+		{"alice", "abcdefgh", []string{
+			"password must contain a digit",
+			"password must contain an upper-case letter",
+			"password must contain a symbol",
+		}},
+		{"alice", "xAlice-99", []string{"password must not contain the username"}},
+		{"al", "al-Al-1234", nil},
+		{"alice", "password123", []string{
+			"password must contain an upper-case letter",
+			"password must contain a symbol",
+			"password is too common, choose one that is harder to guess",
+		}},
+	}
+	for _, test := range tests {
+		err := checkPasswordPolicy(test.username, test.password)
+		if test.failed == nil {
+			if err.Code != internal.OK {
+				t.Errorf("checkPasswordPolicy(%q, %q) = %v, want OK", test.username, test.password, err)
+			}
+			continue
+		}
+		if err.Code != internal.WeakPassword || !reflect.DeepEqual(err.Details, test.failed) {
+			t.Errorf("checkPasswordPolicy(%q, %q) = %v %q, want WeakPassword %q", test.username, test.password, err.Code, err.Details, test.failed)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"../internal"
+)
+
+// Failed logins are counted in the login_failures table, both per username
+// ("user:" + username) and per client address ("addr:" + address). After n
+// failures in a row the next attempt is refused until config.LoginBackoff *
+// 2^(n-1) has passed (at most config.LockoutDuration), so guessing gets slower
+// and slower whichever account or address it is spread over. An account which
+// reaches config.MaxLoginFailures is locked for config.LockoutDuration, or
+// until an admin runs --unlock. A successful login clears both counters.
+// Attempts for the same username or from the same address are made one at a
+// time under lockLogin(), from the check through recording the outcome, so
+// guesses sent in parallel each see the failures of the ones before them.
+//
+// Signups are logged per address in signup_log, and refused once an address
+// made config.SignupsPerHour of them in the last hour.
+
+// a lock on the login attempts of one key, dropped from login_locks once no
+// attempt holds or waits for it
+type loginLock struct {
+	mtx     sync.Mutex
+	waiters int
+}
+
+var login_locks = make(map[string]*loginLock)
+var login_locks_mtx sync.Mutex
+
+/*
+ * lockLogin() - waits until no other login attempt for the username or from the
+ * 				address is running, and keeps others waiting until unlocked
+ *
+ * Parameters:
+ * 		- addr: a string representing the client's address
+ * 		- username: a string representing the username logging in
+ * Returns: a function that unlocks them again
+ */
+func lockLogin(addr string, username string) func() {
+	// always the username first, so two attempts never wait on each other
+	keys := []string{"user:" + username, "addr:" + addr}
+	for _, key := range keys {
+		login_locks_mtx.Lock()
+		lock, ok := login_locks[key]
+		if !ok {
+			lock = new(loginLock)
+			login_locks[key] = lock
+		}
+		lock.waiters++
+		login_locks_mtx.Unlock()
+
+		lock.mtx.Lock()
+	}
+
+	return func() {
+		for _, key := range keys {
+			login_locks_mtx.Lock()
+			lock := login_locks[key]
+			lock.mtx.Unlock()
+			lock.waiters--
+			if lock.waiters == 0 {
+				delete(login_locks, key)
+			}
+			login_locks_mtx.Unlock()
+		}
+	}
+}
+
+/*
+ * retryIn() - formats how long to wait until a given time
+ *
+ * Parameters:
+ * 		- until: an int64 representing the time in Unix nanoseconds
+ * 		- now: an int64 representing the current time in Unix nanoseconds
+ * Returns: a string like "3s" or "14m0s"
+ */
+func retryIn(until int64, now int64) string {
+	return time.Duration(until - now).Round(time.Second).String()
+}
+
+/*
+ * checkLoginAllowed() - checks that a login may be attempted, before the
+ * 						password is looked at, the caller holds lockLogin()
+ *
+ * Parameters:
+ * 		- addr: a string representing the client's address
+ * 		- username: a string representing the username logging in
+ * Returns: an internal.Error, with code OK if the attempt may go ahead,
+ * 				AccountLocked or RateLimited if not
+ */
+func checkLoginAllowed(addr string, username string) internal.Error {
+	now := time.Now().UTC().UnixNano()
+	for _, key := range []string{"user:" + username, "addr:" + addr} {
+		var failures int
+		var last int64
+		var locked_until int64
+		err := db.QueryRow("SELECT failures, last, locked_until FROM login_failures WHERE key = ?", key).Scan(&failures, &last, &locked_until)
+		if err != nil {
+			// no failures recorded
+			continue
+		}
+		if locked_until > now {
+			return internal.NewError(internal.AccountLocked, fmt.Sprintf("account locked after too many failed logins, try again in %v or ask an admin to unlock it", retryIn(locked_until, now)))
+		}
+		if locked_until != 0 {
+			// the lock ran out, start over
+			continue
+		}
+		if next := last + int64(loginBackoff(failures)); next > now {
+			return internal.NewError(internal.RateLimited, fmt.Sprintf("too many failed logins, try again in %v", retryIn(next, now)))
+		}
+	}
+	return internal.Error{}
+}
+
+/*
+ * loginBackoff() - gets how long to wait after a number of failed logins
+ *
+ * Parameters: failures: an int representing the number of failures in a row
+ * Returns: a time.Duration, doubling from config.LoginBackoff up to
+ * 				config.LockoutDuration
+ */
+func loginBackoff(failures int) time.Duration {
+	backoff := time.Duration(config.LoginBackoff)
+	for i := 1; i < failures && backoff < time.Duration(config.LockoutDuration); i++ {
+		backoff *= 2
+	}
+	if backoff > time.Duration(config.LockoutDuration) {
+		backoff = time.Duration(config.LockoutDuration)
+	}
+	return backoff
+}
+
+/*
+ * recordLoginFailure() - counts a failed login against the username and the
+ * 						address, locking the account if it has failed too often
+ *
+ * Parameters:
+ * 		- addr: a string representing the client's address
+ * 		- username: a string representing the username that failed to log in
+ * Returns: nothing
+ */
+func recordLoginFailure(addr string, username string) {
+	now := time.Now().UTC().UnixNano()
+
+	// forget counters which have not been added to for longer than any backoff
+	db.Exec("DELETE FROM login_failures WHERE last < ? AND locked_until < ?", now - int64(config.LockoutDuration), now)
+
+	for _, key := range []string{"user:" + username, "addr:" + addr} {
+		// a lock that ran out starts the count over
+		db.Exec("DELETE FROM login_failures WHERE key = ? AND locked_until != 0 AND locked_until <= ?", key, now)
+		db.Exec("INSERT OR IGNORE INTO login_failures (key, failures, last, locked_until) VALUES (?, 0, 0, 0)", key)
+		db.Exec("UPDATE login_failures SET failures = failures + 1, last = ? WHERE key = ?", now, key)
+	}
+
+	// only accounts get locked, an address just keeps backing off
+	db.Exec("UPDATE login_failures SET locked_until = ? WHERE key = ? AND failures >= ?", now + int64(config.LockoutDuration), "user:" + username, config.MaxLoginFailures)
+}
+
+/*
+ * clearLoginFailures() - forgets the failed logins of a username and address
+ * 						after a successful login
+ *
+ * Parameters:
+ * 		- addr: a string representing the client's address
+ * 		- username: a string representing the username that logged in
+ * Returns: nothing
+ */
+func clearLoginFailures(addr string, username string) {
+	db.Exec("DELETE FROM login_failures WHERE key IN (?, ?)", "user:" + username, "addr:" + addr)
+}
+
+/*
+ * unlockUser() - unlocks an account and resets its failed logins, for the
+ * 				--unlock option
+ *
+ * Parameters: username: a string representing the user's username
+ * Returns: an error if the user does not exist or could not be unlocked
+ */
+func unlockUser(username string) error {
+	username = resolveUsername(username)
+	var root string
+	err := db.QueryRow("SELECT root FROM metadata WHERE username = ?", username).Scan(&root)
+	if err != nil {
+		return fmt.Errorf("no such user %q", username)
+	}
+	_, err = db.Exec("DELETE FROM login_failures WHERE key = ?", "user:" + username)
+	return err
+}
+
+/*
+ * checkSignupAllowed() - checks that an address has not made too many signups
+ * 						in the last hour, the caller holds signup_mtx
+ *
+ * Parameters: addr: a string representing the client's address
+ * Returns: an internal.Error, with code OK if the signup may go ahead,
+ * 				SignupLimited if not
+ */
+func checkSignupAllowed(addr string) internal.Error {
+	now := time.Now().UTC().UnixNano()
+	hour_ago := now - int64(time.Hour)
+	db.Exec("DELETE FROM signup_log WHERE created < ?", hour_ago)
+
+	var count int
+	var oldest int64
+	err := db.QueryRow("SELECT COUNT(*), COALESCE(MIN(created), 0) FROM signup_log WHERE addr = ?", addr).Scan(&count, &oldest)
+	if err != nil {
+		return internal.NewError(internal.Internal, "Error Signing Up")
+	}
+	if count >= config.SignupsPerHour {
+		return internal.NewError(internal.SignupLimited, fmt.Sprintf("too many signups from this address, try again in %v", retryIn(oldest + int64(time.Hour), now)))
+	}
+	return internal.Error{}
+}
+
+/*
+ * recordSignup() - logs a signup against an address
+ *
+ * Parameters: addr: a string representing the client's address
+ * Returns: nothing
+ */
+func recordSignup(addr string) {
+	db.Exec("INSERT INTO signup_log (addr, created) VALUES (?, ?)", addr, time.Now().UTC().UnixNano())
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"../internal"
+)
+
+// setThrottle sets the login throttling of the test configuration
+func setThrottle(backoff time.Duration, max_failures int, lockout time.Duration) {
+	config.LoginBackoff = duration(backoff)
+	config.MaxLoginFailures = max_failures
+	config.LockoutDuration = duration(lockout)
+}
+
+// failures gets the failed logins counted against a key, and when it is
+// locked until
+func failures(key string) (int, int64) {
+	var n int
+	var locked_until int64
+	db.QueryRow("SELECT failures, locked_until FROM login_failures WHERE key = ?", key).Scan(&n, &locked_until)
+	return n, locked_until
+}
+
+// waitOutBackoff makes the backoff after the failures counted against a key
+// run out, as if the client had waited
+func waitOutBackoff(t *testing.T, key string) {
+	n, _ := failures(key)
+	_, err := db.Exec("UPDATE login_failures SET last = last - ? WHERE key = ?", int64(loginBackoff(n)), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func login(addr string, username string, password string) internal.Error {
+	return loginHandler(addr, username, password, "test").Err
+}
+
+func TestLoginBackoff(t *testing.T) {
+	setUp(t)
+	setThrottle(time.Second, 5, time.Minute)
+
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{6, 32 * time.Second},
+		{7, time.Minute},
+		{100, time.Minute},
+	}
+	for _, test := range tests {
+		if got := loginBackoff(test.failures); got != test.want {
+			t.Errorf("loginBackoff(%v) = %v, want %v", test.failures, got, test.want)
+		}
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	setUp(t)
+	signUp(t, "alice")
+	setThrottle(time.Hour, 3, 24 * time.Hour)
+
+	// every failure makes the next attempt wait, right password or not, from
+	// any address
+	wantCode(t, "failure 1", login("attacker", "alice", "wrong"), internal.InvalidCredentials)
+	wantCode(t, "right password in the backoff", login("attacker", "alice", TEST_PASSWORD), internal.RateLimited)
+	wantCode(t, "other address in the backoff", login("other", "Alice", TEST_PASSWORD), internal.RateLimited)
+	if n, _ := failures("user:alice"); n != 1 {
+		t.Errorf("%v failures after refused attempts, want 1", n)
+	}
+
+	waitOutBackoff(t, "user:alice")
+	waitOutBackoff(t, "addr:attacker")
+	wantCode(t, "failure 2", login("attacker", "alice", "wrong"), internal.InvalidCredentials)
+	waitOutBackoff(t, "user:alice")
+	waitOutBackoff(t, "addr:attacker")
+	wantCode(t, "failure 3", login("attacker", "alice", "wrong"), internal.InvalidCredentials)
+
+	// MaxLoginFailures locks the account for LockoutDuration, backoff or not
+	_, locked_until := failures("user:alice")
+	if wait := time.Until(time.Unix(0, locked_until)); wait < 23 * time.Hour || wait > 24 * time.Hour {
+		t.Errorf("account locked for %v, want 24h", wait)
+	}
+	waitOutBackoff(t, "user:alice")
+	wantCode(t, "right password while locked", login("other", "alice", TEST_PASSWORD), internal.AccountLocked)
+
+	// an address is never locked, it only backs off
+	if _, addr_locked := failures("addr:attacker"); addr_locked != 0 {
+		t.Errorf("address locked until %v, want no lock", addr_locked)
+	}
+
+	// until an admin unlocks it
+	err := unlockUser("ALICE")
+	if err != nil {
+		t.Fatalf("unlockUser(): %v", err)
+	}
+	mustOK(t, "login after unlock", login("other", "alice", TEST_PASSWORD))
+	wantCode(t, "attacker after unlock", login("attacker", "alice", TEST_PASSWORD), internal.RateLimited)
+	if err := unlockUser("nobody"); err == nil {
+		t.Errorf("unlockUser() of a missing user succeeded")
+	}
+}
+
+func TestLoginLockoutExpires(t *testing.T) {
+	setUp(t)
+	signUp(t, "alice")
+	setThrottle(time.Hour, 2, 24 * time.Hour)
+
+	wantCode(t, "failure 1", login("a1", "alice", "wrong"), internal.InvalidCredentials)
+	waitOutBackoff(t, "user:alice")
+	wantCode(t, "failure 2", login("a2", "alice", "wrong"), internal.InvalidCredentials)
+	wantCode(t, "login while locked", login("a3", "alice", TEST_PASSWORD), internal.AccountLocked)
+
+	// a lock that ran out starts the count over
+	db.Exec("UPDATE login_failures SET locked_until = ? WHERE key = 'user:alice'", time.Now().UnixNano() - 1)
+	wantCode(t, "failure after the lock", login("a4", "alice", "wrong"), internal.InvalidCredentials)
+	if n, locked_until := failures("user:alice"); n != 1 || locked_until != 0 {
+		t.Errorf("failures after the lock ran out = %v, locked until %v, want 1, not locked", n, locked_until)
+	}
+
+	// and a successful login clears the counters
+	waitOutBackoff(t, "user:alice")
+	waitOutBackoff(t, "addr:a4")
+	mustOK(t, "login", login("a4", "alice", TEST_PASSWORD))
+	for _, key := range []string{"user:alice", "addr:a4"} {
+		if n, _ := failures(key); n != 0 {
+			t.Errorf("%v failures of %v after logging in, want 0", n, key)
+		}
+	}
+}
+
+func TestLoginAddressBackoff(t *testing.T) {
+	setUp(t)
+	signUp(t, "alice")
+	signUp(t, "bob")
+	setThrottle(time.Hour, 3, 24 * time.Hour)
+
+	// guesses spread over accounts still back off per address
+	wantCode(t, "guess at alice", login("spray", "alice", "wrong"), internal.InvalidCredentials)
+	wantCode(t, "guess at bob", login("spray", "bob", "wrong"), internal.RateLimited)
+	wantCode(t, "guess at nobody", login("spray", "nobody", "wrong"), internal.RateLimited)
+	mustOK(t, "bob from elsewhere", login("elsewhere", "bob", TEST_PASSWORD))
+
+	// failures for users that do not exist count too
+	waitOutBackoff(t, "addr:spray")
+	wantCode(t, "guess at nobody", login("spray", "nobody", "wrong"), internal.InvalidCredentials)
+	if n, _ := failures("addr:spray"); n != 2 {
+		t.Errorf("%v failures of the address, want 2", n)
+	}
+}
+
+func TestLoginParallelGuesses(t *testing.T) {
+	setUp(t)
+	signUp(t, "alice")
+	setThrottle(time.Hour, 3, 24 * time.Hour)
+
+	// guesses sent at once each see the failures of the ones before them
+	var wg sync.WaitGroup
+	codes := make([]internal.ErrorCode, 8)
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes[i] = login("attacker", "alice", "wrong").Code
+		}(i)
+	}
+	wg.Wait()
+	tried := 0
+	for _, code := range codes {
+		if code == internal.InvalidCredentials {
+			tried++
+		} else if code != internal.RateLimited {
+			t.Errorf("parallel guess = %v, want InvalidCredentials or RateLimited", code)
+		}
+	}
+	if tried != 1 {
+		t.Errorf("%v parallel guesses were tried, want 1", tried)
+	}
+}
@@ -1,101 +1,263 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
-	"os/exec"
-
-	"strconv"
 
 	"../internal"
 	"../lib/support/rpc"
 
 	"database/sql"
-	"encoding/binary"
  	_"github.com/mattn/go-sqlite3"
 
  	"crypto/sha256"
  	"time"
 
- 	"math/rand"
  	"encoding/hex"
 
  	"strings"
  	"path"
  	"path/filepath"
 
-	"bytes"
+	"sync"
+	"unicode/utf8"
 )
 
 // global variables:
 
-const MAX_DB_STORAGE = 100000000 // in bytes, (100MB total db storage in system)
-const MAX_USER_STORAGE = 5000000 // (in bytes, (5MB storage per user)
+const MAX_DOWNLOAD_CHUNK = 1000000 // in bytes, most returned by one download_range call
 var db * sql.DB // our sql database
-var abs_base_dir string //directory up to /bin on server (does not change)
+var abs_base_dir string // data directory from the config, ending in "/" (does not change)
+
+// handlers run concurrently, so quota checks and the writes they allow have to
+// happen under a lock on the root being charged, and signups under a global one
+var root_locks = make(map[string]*sync.Mutex)
+var root_locks_mtx sync.Mutex
+var signup_mtx sync.Mutex
+
+// access levels a handler can ask performChecks() for
+const (
+	ACCESS_READ = iota // path is in the user's root, or shared with them
+	ACCESS_WRITE       // path is in the user's root, or shared with them read/write
+	ACCESS_OWNER       // path must be in the user's own root
+)
 
 func main() {
 
-	// initialize dropbox sql database
-
-	dir, _ := filepath.Abs(filepath.Dir(os.Args[0]))
-	abs_base_dir = dir + "/"
+	// parse options, every setting of the config file can also be given as a flag
+
+	defaults := defaultConfig()
+	var overrides Config
+	config_file := flag.String("config", "", "read settings from this JSON `file`")
+	flag.StringVar(&overrides.DataDir, "data-dir", defaults.DataDir, "keep user files and the database in `dir`")
+	flag.StringVar(&overrides.Database, "db", defaults.Database, "database `file`, relative to the data directory")
+	flag.StringVar(&overrides.Listen, "listen", "", "listen on `address`")
+	flag.IntVar(&overrides.MaxConcurrent, "max-concurrent-requests", defaults.MaxConcurrent, "rpc requests handled in parallel")
+	flag.Int64Var(&overrides.UserQuota, "user-quota", defaults.UserQuota, "storage per user in `bytes`, unless set with --set-quota")
+	flag.Int64Var(&overrides.TotalStorage, "total-storage", defaults.TotalStorage, "storage for all users in `bytes`, no signups beyond it")
+	flag.DurationVar((*time.Duration)(&overrides.SessionLifetime), "session-lifetime", time.Duration(defaults.SessionLifetime), "how long a login lasts")
+	flag.IntVar(&overrides.MaxNameLength, "max-name-length", defaults.MaxNameLength, "longest file or directory name")
+	flag.IntVar(&overrides.MaxNesting, "max-nesting", defaults.MaxNesting, "deepest directory nesting in a root")
+	flag.DurationVar((*time.Duration)(&overrides.TrashRetention), "trash-retention", time.Duration(defaults.TrashRetention), "how long removed files are kept in the trash")
+	flag.IntVar(&overrides.MaxVersions, "max-versions", defaults.MaxVersions, "old versions kept per file")
+	flag.DurationVar((*time.Duration)(&overrides.LoginBackoff), "login-backoff", time.Duration(defaults.LoginBackoff), "wait after a failed login, doubling with each one after")
+	flag.IntVar(&overrides.MaxLoginFailures, "max-login-failures", defaults.MaxLoginFailures, "failed logins in a row before an account is locked")
+	flag.DurationVar((*time.Duration)(&overrides.LockoutDuration), "lockout-duration", time.Duration(defaults.LockoutDuration), "how long a locked account stays locked")
+	flag.IntVar(&overrides.SignupsPerHour, "signups-per-hour", defaults.SignupsPerHour, "signups allowed from one address per hour")
+	flag.IntVar(&overrides.PasswordMinLength, "password-min-length", defaults.PasswordMinLength, "shortest password allowed")
+	overrides.PasswordClasses = defaults.PasswordClasses
+	flag.Var(&overrides.PasswordClasses, "password-classes", "comma separated character `classes` a password needs one of each of (digit, lower, upper, symbol)")
+	flag.StringVar(&overrides.PasswordDenyList, "password-deny-list", "", "`file` of common passwords that may not be used, one per line")
+	flag.BoolVar(&overrides.PasswordNoUsername, "password-no-username", defaults.PasswordNoUsername, "refuse passwords containing the username")
+	flag.IntVar(&overrides.PasswordHistory, "password-history", defaults.PasswordHistory, "latest passwords of a user that may not be used again")
+	flag.IntVar(&overrides.Argon2Time, "argon2-time", defaults.Argon2Time, "argon2id passes over the memory for password hashes")
+	flag.IntVar(&overrides.Argon2Memory, "argon2-memory", defaults.Argon2Memory, "argon2id memory for password hashes in `KiB`")
+	flag.IntVar(&overrides.Argon2Threads, "argon2-threads", defaults.Argon2Threads, "argon2id degree of parallelism for password hashes")
+	flag.IntVar(&overrides.Argon2KeyLen, "argon2-key-len", defaults.Argon2KeyLen, "length of password hashes in `bytes`")
+	reset := flag.Bool("reset", false, "delete all users and their files")
+	recompute_usage := flag.Bool("recompute-usage", false, "measure the storage of every user again")
+	set_quota := flag.Bool("set-quota", false, "set the quota of <username> to <bytes> or back to the default")
+	unlock_user := flag.Bool("unlock", false, "unlock <username> after too many failed logins")
+	reset_password := flag.Bool("reset-password", false, "issue a one-time password reset token for <username>")
+	migrate_only := flag.Bool("migrate-only", false, "bring the database schema up to date, then exit")
+	run_fsck := flag.Bool("fsck", false, "check that the database and the user roots on disk agree")
+	repair := flag.Bool("repair", false, "with --fsck, also fix the problems found")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %v [flags] [--reset | --recompute-usage | --migrate-only | --fsck [--repair] | --set-quota <username> <bytes|default> | --unlock <username> | --reset-password <username> | <base-dir> <listen-address>]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	args := flag.Args()
+
+	// at most one of the admin options, or else serve
+	modes := 0
+	for _, set := range []bool{*reset, *recompute_usage, *set_quota, *migrate_only, *run_fsck, *unlock_user, *reset_password} {
+		if set {
+			modes++
+		}
+	}
+	serving := modes == 0
+	switch {
+	case modes > 1,
+		*set_quota && len(args) != 2,
+		(*unlock_user || *reset_password) && len(args) != 1,
+		(*reset || *recompute_usage || *migrate_only || *run_fsck) && len(args) != 0,
+		*repair && !*run_fsck,
+		serving && len(args) != 0 && len(args) != 2:
+		flag.Usage()
+		os.Exit(2)
+	}
+	var config_args []string
+	if serving {
+		config_args = args
+	}
+	err := loadConfig(flag.CommandLine, *config_file, overrides, config_args, serving)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration: %v\n", err)
+		os.Exit(1)
+	}
 
-	db, _ = sql.Open("sqlite3", abs_base_dir + "dropbox.db")
+	// initialize dropbox sql database
 
-	// create sessions table
-	statement, _ := db.Prepare("CREATE TABLE IF NOT EXISTS sessions (session_id TEXT PRIMARY KEY, username TEXT, expiration_date INTEGER)")
-	statement.Exec()
+	db, err = sql.Open("sqlite3", config.Database)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not open database: %v\n", err)
+		os.Exit(1)
+	}
 
-	// create username-password table
-	statement, _ = db.Prepare("CREATE TABLE IF NOT EXISTS u_p (username TEXT PRIMARY KEY, salt TEXT, hashword TEXT)")
-	statement.Exec()
+	// sqlite only allows one writer at a time, so funnel every concurrent handler
+	// through a single connection instead of failing with "database is locked"
+	db.SetMaxOpenConns(1)
 
-	// create metadata table
-	statement, _ = db.Prepare("CREATE TABLE IF NOT EXISTS metadata (username TEXT PRIMARY KEY, root TEXT)")
-	statement.Exec()
+	// create or update the tables, see migrations.go
+	err = migrate()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not migrate database: %v\n", err)
+		os.Exit(1)
+	}
+	if *migrate_only {
+		return
+	}
+	os.MkdirAll(abs_base_dir + UPLOAD_DIR, 0775)
 
-	// create username-present working directory table
-	statement, _ = db.Prepare("CREATE TABLE IF NOT EXISTS user_pwd (username TEXT PRIMARY KEY, pwd TEXT)")
-	statement.Exec()
+	// finish signups and deletions interrupted by a crash, only when serving:
+	// the admin options can run next to a live server, whose signups,
+	// deletions and staging files are still in flight
+	if serving {
+		err = recoverPendingOps()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not recover pending operations: %v\n", err)
+			os.Exit(1)
+		}
+	}
 
-	var listenAddr string
+	// measure the usage of roots created before the usage table
+	recomputeUsage(false)
 
-	// if "--reset" option is called, resets database, otherwise set up base directory and listener
+	// if "--reset" option is called, resets database, otherwise set up listener
 
 	switch {
-	case len(os.Args) == 2 && os.Args[1] == "--reset":
+	case *reset:
 		resetdatabase()
 		return
-	case len(os.Args) == 3 && (len(os.Args[1]) == 0 || os.Args[1][0] != '-'):
-		listenAddr = os.Args[2]
-	default:
-		fmt.Fprintf(os.Stderr, "Usage: %v [--reset | <base-dir> <listen-address>]\n", os.Args[0])
-		os.Exit(1)
+	case *recompute_usage:
+		err := recomputeUsage(true)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not recompute usage: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	case *run_fsck:
+		found, fixed, err := fsck(*repair)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not check consistency: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("%v problems found, %v repaired\n", found, fixed)
+		if found > fixed {
+			os.Exit(1)
+		}
+		return
+	case *unlock_user:
+		err := unlockUser(args[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not unlock: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	case *reset_password:
+		token, expires, err := issueResetToken(args[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not issue reset token: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("reset token for %v: %v\n", args[0], token)
+		fmt.Printf("valid once until %v, redeem it with \"reset %v %v <new-password>\" in the client\n", expires.Local().Format("2006-01-02 15:04"), args[0], token)
+		return
+	case *set_quota:
+		err := setQuota(args[0], args[1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not set quota: %v\n", err)
+			os.Exit(1)
+		}
+		return
 	}
 
 	// declare rpc handlers for client-side calling functionality
 
 	// new rpc handlers from our implementaion
 	rpc.RegisterHandler("authenticate", authenticateHandler)
-	rpc.RegisterHandler("signup", signupHandler)
-	rpc.RegisterHandler("login", loginHandler)
+	rpc.RegisterHandlerWithAddr("signup", signupHandler)
+	rpc.RegisterHandlerWithAddr("login", loginHandler)
+	rpc.RegisterHandlerWithAddr("login_code", loginCodeHandler)
+	rpc.RegisterHandlerWithAddr("reset_password", resetPasswordHandler)
 	rpc.RegisterHandler("logout", logoutHandler)
 	rpc.RegisterHandler("delete", deleteHandler)
+	rpc.RegisterHandler("list_sessions", listSessionsHandler)
+	rpc.RegisterHandler("revoke_session", revokeSessionHandler)
+	rpc.RegisterHandlerWithAddr("change_password", changePasswordHandler)
+	rpc.RegisterHandler("totp_enable", totpEnableHandler)
+	rpc.RegisterHandler("totp_confirm", totpConfirmHandler)
+	rpc.RegisterHandlerWithAddr("totp_disable", totpDisableHandler)
 
 	// rpc handlers given in the stencil code
 	rpc.RegisterHandler("upload", uploadHandler)
+	rpc.RegisterHandler("upload_begin", uploadBeginHandler)
+	rpc.RegisterHandler("upload_chunk", uploadChunkHandler)
+	rpc.RegisterHandler("upload_status", uploadStatusHandler)
+	rpc.RegisterHandler("upload_commit", uploadCommitHandler)
 	rpc.RegisterHandler("download", downloadHandler)
+	rpc.RegisterHandler("download_range", downloadRangeHandler)
+	rpc.RegisterHandler("list_versions", listVersionsHandler)
+	rpc.RegisterHandler("restore_version", restoreVersionHandler)
 	rpc.RegisterHandler("list", listHandler)
+	rpc.RegisterHandler("stat", statHandler)
 	rpc.RegisterHandler("mkdir", mkdirHandler)
 	rpc.RegisterHandler("remove", removeHandler)
+	rpc.RegisterHandler("remove_all", removeAllHandler)
+	rpc.RegisterHandler("move", moveHandler)
+	rpc.RegisterHandler("copy", copyHandler)
+	rpc.RegisterHandler("trash_list", trashListHandler)
+	rpc.RegisterHandler("trash_restore", trashRestoreHandler)
+	rpc.RegisterHandler("trash_empty", trashEmptyHandler)
+	rpc.RegisterHandler("usage", usageHandler)
 	rpc.RegisterHandler("pwd", pwdHandler)
 	rpc.RegisterHandler("cd", cdHandler)
+	rpc.RegisterHandler("share", shareHandler)
+	rpc.RegisterHandler("rm_share", removeShareHandler)
+	rpc.RegisterHandler("get_shares", getSharesHandler)
 	rpc.RegisterFinalizer(finalizer)
+	rpc.SetMaxConcurrency(config.MaxConcurrent)
+
+	// purge old trash and abandoned uploads in the background
+	go purgeTrash()
+	go purgeUploads()
 
 	// runs server
-	err := rpc.RunServer(listenAddr)
+	err = rpc.RunServer(config.Listen)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "could not run server: %v\n", err)
 		os.Exit(1)
@@ -105,7 +267,7 @@ func main() {
 /*
  * checkNestedPath() - checks how much nesting is in a path, for example root/dir1
  *										 would have a nesting of 1, while root/dir1/dir2 would have
- *										 a nesting of 2, and there can be at most 20
+ *										 a nesting of 2, and there can be at most config.MaxNesting
  * Parameters:
  *	- path: a string representing the path to the new directory
  *	- root: a string representing the root of the user
@@ -117,72 +279,132 @@ func checkNestedPath(path string, root string) bool {
 	path_arr := strings.Split(path, root)
 	path = path_arr[1]
 	nested_num := strings.Count(path, "/")
-	if (nested_num > 20) {
+	if (nested_num > config.MaxNesting) {
 		return false
 	}
 	return true
 }
 
 /*
- * checkSizeName() - checks if name of file/folder is less than 25 characters to
- *									 prevent overflow, also checks that the size of the user's
- *									 root directory plus the uploaded file / new directory made
- *									 is less than the user storage limit
+ * checkSubdirCount() - checks that another directory can be added to a directory
+ *										 without exceeding the limit of 20 sub-directories
  *
- * Parameters:
- *	- cookie: a string representing user's cookie
- *  - add_size: an int representing the number of bytes in the upload, or -1 if
- * 							if is a directory
- *  - path: a string representing path to the new file / directory
+ * Parameters: dir: a string representing the full path to the parent directory
+ * Returns: an internal.Error, with code OK if the requirements are passed
+ */
+func checkSubdirCount(dir string) internal.Error {
+	num_directories := 0
+
+	// get array of FileInfo's of the parent directory from ReadDir()
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return internal.NewError(internal.Internal, "Error in ReadDir()")
+	}
+
+	// for all files in the directory, if it's a directory (not a file) increment num_directories
+	for _, file := range files {
+		if file.IsDir() {
+			num_directories++
+		}
+	}
+
+	if num_directories > 19 {
+		return internal.NewError(internal.QuotaExceeded, "Too many sub-directories in this directory")
+	}
+	return internal.Error{}
+}
+
+/*
+ * checkName() - checks if name of file/folder is at most config.MaxNameLength characters to
+ *									 prevent overflow, and not reserved for shared files
  *
- * Returns:
- *	- a boolean representing if the name and size requirements are passed
+ * Parameters: path: a string representing the full path to the file / directory
+ * Returns: an internal.Error, with code OK if the requirements are passed
  */
-func checkSizeName(cookie string, add_size int, path string) string {
+func checkName(path string) internal.Error {
   // get last element in path (the name)
 	path_array := strings.Split(path, "/")
 	len_path_array := len(path_array)
 	name := path_array[len_path_array - 1]
 
-	// check that the name is not greater than 25 characters
-	if (len(name) > 25) {
-		return "name cannot be greater than 25 characters"
+	// check that the name is not greater than the configured limit
+	if (len(name) > config.MaxNameLength) {
+		return internal.NewError(internal.InvalidPath, fmt.Sprintf("name cannot be greater than %v characters", config.MaxNameLength))
+	}
+
+	// names starting with ~ are reserved for addressing shared files
+	if strings.HasPrefix(name, "~") {
+		return internal.NewError(internal.InvalidPath, "name cannot start with ~")
+	}
+	return internal.Error{}
+}
+
+/*
+ * checkSizeName() - checks the name of file/folder with checkName(), also
+ *									 checks that the size of the
+ *									 owning root directory plus the uploaded file / new
+ *									 directory made is less than the owner's quota
+ *
+ * Parameters:
+ *  - add_size: an int representing the number of bytes in the upload, or -1 if
+ * 							if is a directory
+ *  - path: a string representing the full path to the new file / directory, the
+ *					root it is charged to is taken from the path (so uploads to a
+ *					shared file count against the owner)
+ *
+ * Returns:
+ *	- an internal.Error, with code OK if the requirements are passed
+ */
+func checkSizeName(add_size int, path string) internal.Error {
+	str := checkName(path)
+	if str.Code != internal.OK {
+		return str
 	}
 
 	// if it is a folder, set byte size to that of empty folder
 	if (add_size == -1){
-		add_size = 5000
+		add_size = DIR_USAGE
 	}
 
-	// build full path to root
-	_, username := authenticateRequest(cookie)
-	_, root := rootForUsername(username)
-	full_root_path := abs_base_dir + root
-
-	// use full path to root to execute du (disk usage) linux command, "-sk" give size in kilobytes
-	cmd := exec.Command("du", "-sk", full_root_path)
-	var out bytes.Buffer
-	cmd.Stdout = &out
-	err := cmd.Run()
+	// get size and quota of the owning root
+	root := rootForPath(path)
+	cur_byte_size, err := getUsage(root)
 	if err != nil {
-		return "issue getting size"
+		return internal.NewError(internal.Internal, "issue getting size")
 	}
-
-	// get just number from "du" command output, convert to bytes from kb
-	size_array := strings.Split(out.String(), "\t")
-	cur_byte_size, err := strconv.Atoi(size_array[0])
+	quota, err := quotaForRoot(root)
 	if err != nil {
-		return "issue getting size"
+		return internal.NewError(internal.Internal, "issue getting quota")
 	}
-	cur_byte_size = cur_byte_size * 1000
 
-	// if new size is less than max user storage, allow upload or mkdir call
-	new_size := add_size + cur_byte_size
-	if (new_size > MAX_USER_STORAGE){
-		return "user storage exceeded, cannot perform this task"
+	// if new size (including space reserved by unfinished uploads) is less than
+	// the owner's quota, allow upload or mkdir call
+	new_size := add_size + cur_byte_size + reservedForRoot(root)
+	if (int64(new_size) > quota){
+		return internal.NewError(internal.QuotaExceeded, "user storage exceeded, cannot perform this task")
 	}
 
-	return ""
+	return internal.Error{}
+}
+
+/*
+ * lockRoot() - locks a user's root so that checking the storage limit and the
+ * 						write it allows happen without another handler in between
+ *
+ * Parameters: root: a string representing the name of the root directory
+ * Returns: a function which unlocks the root again
+ */
+func lockRoot(root string) func() {
+	root_locks_mtx.Lock()
+	mtx, ok := root_locks[root]
+	if !ok {
+		mtx = new(sync.Mutex)
+		root_locks[root] = mtx
+	}
+	root_locks_mtx.Unlock()
+
+	mtx.Lock()
+	return mtx.Unlock
 }
 
 /*
@@ -200,15 +422,23 @@ func resetdatabase() string {
 	var root string
 	for rows.Next() {
 			rows.Scan(&username, &root)
-			err := os.RemoveAll(root)
+			err := os.RemoveAll(abs_base_dir + root)
 			if err != nil {
 				return "error removing root folers in reset"
 			}
 	}
 	rows.Close()
 
+	// remove staging files of unfinished uploads, signups and deletions, old
+	// versions and the trash
+	os.RemoveAll(abs_base_dir + UPLOAD_DIR)
+	os.RemoveAll(abs_base_dir + VERSIONS_DIR)
+	os.RemoveAll(abs_base_dir + TRASH_DIR)
+	os.RemoveAll(abs_base_dir + PENDING_DIR)
+	os.RemoveAll(abs_base_dir + LOST_DIR)
+
 	// remove dropbox sql database
-	err := os.Remove("dropbox.db")
+	err := os.Remove(config.Database)
 	if err != nil {
 		return "error removing databse in reset"
 	}
@@ -216,34 +446,59 @@ func resetdatabase() string {
 }
 
 /*
- * resetdatabase() - deletes session with given username if it exists
+ * hashCookie() - hashes a cookie the way session ids are stored in the database
+ *
+ * Parameters: cookie: a string representing the user's cookie
+ * Returns: a string with the hex encoded sha256 hash of the cookie
+ */
+func hashCookie(cookie string) string {
+	h := sha256.New()
+	h.Write([]byte(cookie))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+/*
+ * deleteSessionWithUsername() - deletes session with given username if it exists,
+ * 						along with the session's pwd
  *
  * Parameters: username: a string representing the username
  * Returns: nothing
  */
 func deleteSessionWithUsername(username string) {
-	statement, _ := db.Prepare("DELETE FROM sessions WHERE username = ?")
+	statement, _ := db.Prepare("DELETE FROM session_pwd WHERE session_id IN (SELECT session_id FROM sessions WHERE username = ?)")
+	statement.Exec(username)
+	statement, _ = db.Prepare("DELETE FROM sessions WHERE username = ?")
 	statement.Exec(username)
 }
 
 /*
- * resetdatabase() - deletes session with given cookie if it exists
+ * deleteSession() - deletes a single session and its pwd if it exists
+ *
+ * Parameters: session_id: a string representing the hashed cookie of the session
+ * Returns: an error if the session could not be deleted
+ */
+func deleteSession(session_id string) error {
+	statement, _ := db.Prepare("DELETE FROM session_pwd WHERE session_id = ?")
+	statement.Exec(session_id)
+	statement, _ = db.Prepare("DELETE FROM sessions WHERE session_id = ?")
+	_, err := statement.Exec(session_id)
+	return err
+}
+
+/*
+ * logoutHandler() - deletes session with given cookie if it exists, the user's
+ * 						sessions on other devices stay logged in
  *
  * Parameters: cookie: a string representing the user's session id
- * Returns: a string with an error message, or empty upon success
+ * Returns: an internal.Error, with code OK upon success
  */
-func logoutHandler(cookie string) string {
-	// hash cookie so that it matches up in db
-	h := sha256.New()
-	h.Write([]byte(cookie))
-	sha256_hash_cookie := hex.EncodeToString(h.Sum(nil))
-	// delete hashed cookie
-	statement, _ := db.Prepare("DELETE FROM sessions WHERE session_id = ?")
-	_, err2 := statement.Exec(sha256_hash_cookie)
+func logoutHandler(cookie string) internal.Error {
+	// hash cookie so that it matches up in db, then delete it
+	err2 := deleteSession(hashCookie(cookie))
 	if err2 != nil {
-		return "error logging out"
+		return internal.NewError(internal.Internal, "error logging out")
 	} else {
-		return "" // success
+		return internal.Error{} // success
 	}
 }
 
@@ -251,56 +506,35 @@ func logoutHandler(cookie string) string {
  * deleteHandler() - delete all of the user information and their data (API command)
  *
  * Parameters: cookie: a string representing the user
- * Returns: a string with an error message, or empty upon success
+ * Returns: an internal.Error, with code OK upon success
  */
-func deleteHandler(cookie string) string {
+func deleteHandler(cookie string) internal.Error {
 
-	err_message := "could not delete account"
+	err_message := internal.NewError(internal.Internal, "could not delete account")
 
 	// authenticate
 	err0, username := authenticateRequest(cookie)
-	if (err0 != "") {
+	if err0.Code != internal.OK {
 		return err0
 	}
 
 	// get root
 	err1, root := rootForUsername(username)
-	if (err1 != "") {
+	if err1.Code != internal.OK {
 		return err1
 	}
 
-	// delete all table information for that username (i.e. in session, u_p, metadata, and user_pwd)
-	statement, _ := db.Prepare("DELETE FROM sessions WHERE username = ?")
-	_, err := statement.Exec(username)
-	if err != nil {
-		return err_message
-	}
-
-	statement, _  = db.Prepare("DELETE FROM u_p WHERE username = ?")
-	_, err = statement.Exec(username)
-	if err != nil {
-		return err_message
-	}
+	// nothing may write into the root while it is being deleted
+	unlock := lockRoot(root)
+	defer unlock()
 
-	statement, _  = db.Prepare("DELETE FROM metadata WHERE username = ?")
-	_, err = statement.Exec(username)
+	// delete all table information for that username and their files, all at once
+	err := deleteAccount(username, root)
 	if err != nil {
 		return err_message
 	}
 
-	statement, _  = db.Prepare("DELETE FROM user_pwd WHERE username = ?")
-	_, err = statement.Exec(username)
-	if err != nil {
-		return err_message
-	}
-
-	//remove
-	err = os.RemoveAll(abs_base_dir + root)
-	if err != nil {
-		return err_message
-	}
-
-	return ""
+	return internal.Error{}
 }
 
 /*
@@ -308,21 +542,19 @@ func deleteHandler(cookie string) string {
  * 												 the session database
  *
  * Parameters: cookie: a string representing the user's cookie
- * Returns: a string with an error message, or empty upon success
+ * Returns: an internal.AuthReturn with error or the username on success
  */
-func authenticateHandler(cookie string) string {
+func authenticateHandler(cookie string) internal.AuthReturn {
 
 
 	//hash the cookie to validate against the value in the database
-	h := sha256.New()
-	h.Write([]byte(cookie))
-	sha256_hash_cookie := hex.EncodeToString(h.Sum(nil))
+	sha256_hash_cookie := hashCookie(cookie)
 
 	// query for entry with cookie
-	statement, _ := db.Prepare("SELECT * FROM sessions WHERE session_id = ?")
+	statement, _ := db.Prepare("SELECT session_id, username, expiration_date FROM sessions WHERE session_id = ?")
 	rows, err1 := statement.Query(sha256_hash_cookie)
 	if err1 != nil {
-		return err1.Error()
+		return internal.AuthReturn{Err: internal.NewError(internal.Internal, "could not authenticate")}
 	}
 	var session_id string
 	var username string
@@ -333,53 +565,46 @@ func authenticateHandler(cookie string) string {
 		rows.Close()
 		if (expiration_date > time.Now().UTC().UnixNano()){
 
-			// get root from username and move to the root for user
-			err2, root := rootForUsername(username)
-			if err2 != "" {
-				return err2
-			}
-			err := os.Chdir(abs_base_dir + root)
-			if err != nil {
-				return "authentication failed"
+			// make sure the user still has a root
+			err2, _ := rootForUsername(username)
+			if err2.Code != internal.OK {
+				return internal.AuthReturn{Err: err2}
 			}
 
-			// Reset the pwd upon login / authenticate
-			pwd := abs_base_dir + root
-			statement, _ := db.Prepare("update user_pwd set pwd = ? where username = ?")
-			statement.Exec(pwd, username)
+			// Reset the session's pwd to the root upon login / authenticate
+			setSessionPWD(sha256_hash_cookie, "/")
 
-			return username
+			return internal.AuthReturn{Username: username}
 		} else {
 
-			// Delete all sessions for that user because its expired
-			deleteSessionWithUsername(username)
+			// Delete this session because its expired, other devices are unaffected
+			deleteSession(sha256_hash_cookie)
 
-			return "false, session expired"
+			return internal.AuthReturn{Err: internal.NewError(internal.SessionExpired, "session expired")}
 		}
 	} else {
-		return "false, invalid cookie"
+		return internal.AuthReturn{Err: internal.NewError(internal.Unauthenticated, "invalid cookie")}
 	}
 }
 
 /*
- * getUserPWD() - get pwd from username
+ * getSessionPWD() - get pwd of the session a cookie belongs to, relative to the
+ * 						user's root
  *
- * Parameters: username: a string representing the user's username
- * Returns: a string with an error message, or empty upon success
+ * Parameters: cookie: a string representing the user's cookie
+ * Returns: a string with the pwd, or "/" if the session has none yet
  */
-func getUserPWD(username string) string {
-	statement, _ := db.Prepare("SELECT * FROM user_pwd WHERE username = ?")
-	rows2, err := statement.Query(username)
+func getSessionPWD(cookie string) string {
+	statement, _ := db.Prepare("SELECT pwd FROM session_pwd WHERE session_id = ?")
+	rows2, err := statement.Query(hashCookie(cookie))
 	if err != nil {
-		return err.Error()
+		return "/"
 	}
 
-	//grab username and salt, as well as the hashed password
-	var pwd string
+	// grab pwd, default to the root
+	pwd := "/"
 	if rows2.Next() {
-		rows2.Scan(&username, &pwd)
-	} else {
-		return "Username does not exist. Error retrieving pwd."
+		rows2.Scan(&pwd)
 	}
 	rows2.Close()
 
@@ -387,232 +612,256 @@ func getUserPWD(username string) string {
 }
 
 /*
- * signupHandler() - signs up user if space available in database
+ * setSessionPWD() - set pwd of a session, creating the entry if needed
  *
  * Parameters:
+ * 		- session_id: a string representing the hashed cookie of the session
+ * 		- pwd: a string representing the new pwd, relative to the user's root
+ * Returns: nothing
+ */
+func setSessionPWD(session_id string, pwd string) {
+	statement, _ := db.Prepare("INSERT OR REPLACE INTO session_pwd (session_id, pwd) VALUES (?, ?)")
+	statement.Exec(session_id, pwd)
+}
+
+/*
+ * signupHandler() - signs up user if space available in database, and the
+ * 					client has not signed up too many users already
+ *
+ * Parameters:
+ * 		- addr: a string representing the client's address, filled in by the rpc layer
  * 		- username: a string representing the user's username
  * 		- password: a string representing the user's password
- * Returns: a string with an error message, or empty upon success
+ * Returns: an internal.Error, with code OK upon success
  */
-func signupHandler(username string, password string) string {
-	// query all users and sum up size of all root directories
-	rows0, _ := db.Query("SELECT username, root FROM metadata")
-
-	total_root_byte_sum := 0
+func signupHandler(addr string, username string, password string) internal.Error {
+	// one signup at a time, so the total size check and username check hold
+	signup_mtx.Lock()
+	defer signup_mtx.Unlock()
 
-	var username0 string
-	var user_root string
-	for rows0.Next() {
-		rows0.Scan(&username0, &user_root)
-
-		// build root path and find size from disk usage (du) command
-		full_root_path := abs_base_dir + user_root
-		cmd := exec.Command("du", "-sk", full_root_path)
-		var out bytes.Buffer
-		cmd.Stdout = &out
-		err := cmd.Run()
-		if err != nil {
-			return "error in signupHandler!!!"
-		}
-		// split on tab because we just want number part of du output
-		size_array := strings.Split(out.String(), "\t")
-		cur_byte_size, err := strconv.Atoi(size_array[0])
-		if err != nil {
-			return "error in signupHandler!!!"
-		}
-
-		// get byte size and add to total, plus the size of an empty folder
-		cur_byte_size = cur_byte_size * 1000
-		total_root_byte_sum = total_root_byte_sum + cur_byte_size + 4096
+	// refuse clients that sign up accounts in bulk
+	err_limit := checkSignupAllowed(addr)
+	if err_limit.Code != internal.OK {
+		return err_limit
 	}
 
-	rows0.Close()
+	// store the username in its canonical form, see usernames.go
+	username, err_name := canonicalUsername(username)
+	if err_name.Code != internal.OK {
+		return err_name
+	}
 
+	// sum up size of all root directories and everything charged to them
+	total_root_byte_sum := 0
+	err0 := db.QueryRow("SELECT COALESCE(SUM(bytes), 0) FROM usage").Scan(&total_root_byte_sum)
+	if err0 != nil {
+		return internal.NewError(internal.Internal, "error in signupHandler!!!")
+	}
 
-	if (total_root_byte_sum > MAX_DB_STORAGE){
-		return "Database full, cannot sign up new users"
+	if (int64(total_root_byte_sum) > config.TotalStorage){
+		return internal.NewError(internal.QuotaExceeded, "Database full, cannot sign up new users")
 	}
 
-	// now check if username already exists before signup process
-	statement, _ := db.Prepare("SELECT * FROM u_p WHERE username = ?")
-	rows, err1 := statement.Query(username)
+	// now check if username already exists before signup process, in any case
+	// or Unicode form
+	statement, _ := db.Prepare("SELECT username FROM u_p WHERE username_key = ?")
+	rows, err1 := statement.Query(usernameKey(username))
 	if err1 != nil {
-		return err1.Error()
+		return internal.NewError(internal.Internal, "Error Signing Up")
 	}
 	if rows.Next() {
 		rows.Close()
-		return "This username already exists. Please sign up with a different username."
+		return internal.NewError(internal.AlreadyExists, "This username already exists. Please sign up with a different username.")
 	}
 	rows.Close()
 
 	// check password meets password requirments
-	if !strings.ContainsAny(password, "0123456789") {
-		return "password must contain numbers"
-	}
-	lowercase := strings.ContainsAny(password, "abcdefghijklmnopqrstuvwxyz")
-	uppercase := strings.ContainsAny(password, "ABCDEFGHIJKLMNOPQRSTUVWXYZ")
-	if !(lowercase && uppercase) {
-		return "password must contain upper and lowercase letters"
+	err_policy := checkPasswordPolicy(username, password)
+	if err_policy.Code != internal.OK {
+		return err_policy
 	}
 
 	// generate salt
-	var salt_string string = generateRandomHexString()
-
-	// generate new hash function and hash salted password
-	h := sha256.New()
-	h.Write([]byte(password + salt_string))
-	sha256_hash := hex.EncodeToString(h.Sum(nil))
-
-	// insert username with salt and hashed-password into sql table
-	statement, _ = db.Prepare("INSERT INTO u_p (username, salt, hashword) VALUES (?, ?, ?)")
-	_, err2 := statement.Exec(username, salt_string, sha256_hash)
-	if err2 != nil {
-		return "Error Signing Up"
+	salt_string, err3 := newToken(TOKEN_SALT)
+	if err3 != nil {
+		return internal.NewError(internal.Internal, "Error Signing Up")
 	}
 
-	// generate root for the user
-	root := "r" + generateRandomHexString()
+	// hash salted password with the memory-hard kdf
+	algorithm, params, hashword := hashPassword(password, salt_string)
 
-	//add new user informaiton to metadata table
-	statement, _ = db.Prepare("INSERT INTO metadata (username, root) VALUES (?, ?)")
-	_, err2 = statement.Exec(username, root)
-	if err2 != nil {
-		return "Error Signing Up"
+	// generate root for the user
+	root, err3 := newToken(TOKEN_ROOT)
+	if err3 != nil {
+		return internal.NewError(internal.Internal, "Error Signing Up")
 	}
 
-	//create directory for this user at root
-	err := os.Mkdir(abs_base_dir + root, 0775)
+	// insert username with salt, hashed-password and how it was hashed, and the
+	// new user's root (the empty root is all they use), and create the root
+	err := createAccount(username, root, salt_string, hashword, algorithm, params)
 	if err != nil {
-		return "could not make root directory"
+		return internal.NewError(internal.Internal, "Error Signing Up")
 	}
+	recordSignup(addr)
 
-	// initialize present working directory and put in table
-	pwd := abs_base_dir + root
-	statement, _ = db.Prepare("INSERT INTO user_pwd (username, pwd) VALUES (?, ?)")
-	_, err2 = statement.Exec(username, pwd)
-	if err2 != nil {
-		return "Error Signing Up"
-	}
-
-	return ""
+	return internal.Error{}
 }
 
 /*
- * generateRandomHexString() - generates random hex string with pseudo random number
- * 				with 2 sources of randomness, used for salt, cookie, root directory name
- *
- * Parameters: none
- * Returns: random hex string
- */
-func generateRandomHexString() string {
-	// first layer of randomness for seed, a random stream of 8 bytes(64 bits)
-	firstlayer := make([]byte, 8)
-  rand.Read(firstlayer)
-  var firstlayer_int64 int64 = int64(binary.LittleEndian.Uint64(firstlayer))
-
-	//second layer of randomness for seed, current millis epoch time
-  var secondlayer_int64 int64 = time.Now().UTC().UnixNano()
-
-  //set seed and produce random string
-	rand.Seed(firstlayer_int64 + secondlayer_int64)
-	var positive_max_value int64 = 9223372036854775807 // largest positive value of int64
-
-	// generate random int and convert into hex
-	var random int64 = rand.Int63n(positive_max_value)
-	random_string := strconv.FormatInt(random, 16)
-
-	return random_string
-}
-
-/*
- * loginHandler() - logs in user with correct username and password
+ * loginHandler() - logs in user with correct username and password, creating a
+ * 						new session next to any the user has on other devices, unless
+ * 						the username or client failed to log in too often
  *
  * Parameters:
+ * 		- addr: a string representing the client's address, filled in by the rpc layer
  * 		- username: a string representing the user's username
  * 		- password: a string representing the user's password
- * Returns: a string with the cookie to be stored in the client
+ * 		- device: a string representing a label for the device logging in
+ * Returns: an internal.LoginReturn with error or the cookie to be stored in the
+ * 				client on success, for users with two-factor authentication on a
+ * 				TwoFactorRequired error and the token to finish with login_code
  */
-func loginHandler(username string, password string) string {
-	statement, _ := db.Prepare("SELECT * FROM u_p WHERE username = ?")
+func loginHandler(addr string, username string, password string, device string) internal.LoginReturn {
+	// the user may type their name in any case or Unicode form, throttle and
+	// log in the user it belongs to
+	username = resolveUsername(username)
+
+	// back off or stay locked after failed logins, before the password is checked
+	unlock := lockLogin(addr, username)
+	defer unlock()
+	err_limit := checkLoginAllowed(addr, username)
+	if err_limit.Code != internal.OK {
+		return internal.LoginReturn{Err: err_limit}
+	}
+
+	statement, _ := db.Prepare("SELECT username, salt, hashword, algorithm, params FROM u_p WHERE username = ?")
 	rows2, err := statement.Query(username)
 
 	if err != nil {
-		return err.Error()
+		return internal.LoginReturn{Err: internal.NewError(internal.Internal, "could not log in")}
 	}
 
-	// grab username and salt, as well as the hashed password
+	// grab username and salt, as well as the hashed password and how it was hashed
 	var salt_string string
 	var hashword string
+	var algorithm *string
+	var params *string
 	if rows2.Next() {
-		rows2.Scan(&username, &salt_string, &hashword)
+		rows2.Scan(&username, &salt_string, &hashword, &algorithm, &params)
 	} else {
-		return "Username does not exist. Please try again."
+		recordLoginFailure(addr, username)
+		return internal.LoginReturn{Err: internal.NewError(internal.InvalidCredentials, "Username does not exist. Please try again.")}
 	}
 	rows2.Close()
 
+	// legacy rows have no algorithm recorded
+	if algorithm == nil {
+		algorithm = new(string)
+	}
+	if params == nil {
+		params = new(string)
+	}
+
 	// re-hash password with salt and see if it matches hashed password in database
-	h := sha256.New()
-	h.Write([]byte(password + salt_string))
-	sha256_hash := hex.EncodeToString(h.Sum(nil))
-
-	if (0 == strings.Compare(sha256_hash, hashword)){
-			var return_cookie string = generateRandomHexString()
-
-			//hash the cookie to store in actual db, return the non hashed to user
-			h := sha256.New()
-			h.Write([]byte(return_cookie))
-			sha256_hash_cookie := hex.EncodeToString(h.Sum(nil))
-
-			//before adding new user, delete any old sessions for that user if they exist
-			deleteSessionWithUsername(username)
-
-			// add new session
-			statement, _ = db.Prepare("INSERT INTO sessions (session_id, username, expiration_date) VALUES (?, ?, ?)")
-			exp_date := time.Now().UTC().UnixNano() + 600000000000
-			_, err2 := 	statement.Exec(sha256_hash_cookie, username, exp_date)
-			if err2 != nil {
-				return "could not provide session"
+	if verifyPassword(password, *algorithm, *params, salt_string, hashword) {
+			// upgrade legacy or outdated hashes now that we know the password
+			if needsRehash(*algorithm, *params) {
+				rehashPassword(username, password)
 			}
 
-			// RESET the pwd upon login / authenticate
-			_, root := rootForUsername(username)
-			pwd := abs_base_dir + root
-			statement, _ := db.Prepare("update user_pwd set pwd = ? where username = ?")
-			statement.Exec(pwd, username)
-
-			// start in pwd
-			err = os.Chdir(pwd)
-			if err != nil {
-				return "directory not found"
+			// with two-factor authentication on, the password only gets a pending
+			// login, and the failed logins stay counted until a right code is given
+			if twoFactorEnabled(username) {
+				pending, err3 := beginPendingLogin(username, device)
+				if err3 != nil {
+					return internal.LoginReturn{Err: internal.NewError(internal.Internal, "could not log in")}
+				}
+				return internal.LoginReturn{Pending: pending, Err: internal.NewError(internal.TwoFactorRequired, "enter the code from your authenticator app")}
 			}
 
-			return "cookie:" + return_cookie
+			clearLoginFailures(addr, username)
+			return_cookie, err3 := startSession(username, device)
+			if err3.Code != internal.OK {
+				return internal.LoginReturn{Err: err3}
+			}
+			return internal.LoginReturn{Cookie: return_cookie}
 	} else {
-			return "Username/Password Incorrect"
+			recordLoginFailure(addr, username)
+			return internal.LoginReturn{Err: internal.NewError(internal.InvalidCredentials, "Username/Password Incorrect")}
 	}
 }
 
+/*
+ * startSession() - creates a new session for a user who logged in, the user's
+ * 					sessions on other devices are left alone
+ *
+ * Parameters:
+ * 		- username: a string representing the user's username
+ * 		- device: a string representing a label for the device logging in
+ * Returns: a string with the cookie for the client, and an internal.Error with
+ * 				code OK upon success
+ */
+func startSession(username string, device string) (string, internal.Error) {
+	return_cookie, err := newToken(TOKEN_SESSION)
+	if err != nil {
+		return "", internal.NewError(internal.Internal, "could not provide session")
+	}
+
+	//hash the cookie to store in actual db, return the non hashed to user
+	sha256_hash_cookie := hashCookie(return_cookie)
+
+	statement, _ := db.Prepare("INSERT INTO sessions (session_id, username, expiration_date, device, created) VALUES (?, ?, ?, ?, ?)")
+	now := time.Now().UTC().UnixNano()
+	exp_date := now + int64(config.SessionLifetime)
+	_, err = statement.Exec(sha256_hash_cookie, username, exp_date, device, now)
+	if err != nil {
+		return "", internal.NewError(internal.Internal, "could not provide session")
+	}
+
+	// new session starts in the root
+	setSessionPWD(sha256_hash_cookie, "/")
+
+	return return_cookie, internal.Error{}
+}
+
+/*
+ * rehashPassword() - stores a password again with a fresh salt and the current
+ * 						algorithm and parameters
+ *
+ * Parameters:
+ * 		- username: a string representing the user's username
+ * 		- password: a string representing the user's (verified) password
+ * Returns: nothing, the old hash keeps working if this fails
+ */
+func rehashPassword(username string, password string) {
+	salt_string, err := newToken(TOKEN_SALT)
+	if err != nil {
+		return
+	}
+	algorithm, params, hashword := hashPassword(password, salt_string)
+	statement, _ := db.Prepare("UPDATE u_p SET salt = ?, hashword = ?, algorithm = ?, params = ? WHERE username = ?")
+	statement.Exec(salt_string, hashword, algorithm, params, username)
+}
+
 /*
  * authenticateRequest() - take in cookie, make sure it exists in the database so
  * 						the request is valid because it is impossible to forge cookies
  *
  * Parameters:
  * 		- cookie: a string representing the user's cookie
- * Returns: a string tuple, with the error in the first part and the username in the
+ * Returns: a tuple, with an internal.Error in the first part and the username in the
  * 				second if the request is valid
  */
-func authenticateRequest(cookie string) (string, string) {
-	// query for session with given cookie
-	statement, _ := db.Prepare("SELECT username FROM sessions WHERE session_id = ?")
+func authenticateRequest(cookie string) (internal.Error, string) {
+	// query for unexpired session with given cookie
+	statement, _ := db.Prepare("SELECT username FROM sessions WHERE session_id = ? AND expiration_date > ?")
 
 	//hash the cookie to validate against the value in the database
-	h := sha256.New()
-	h.Write([]byte(cookie))
-	sha256_hash_cookie := hex.EncodeToString(h.Sum(nil))
+	sha256_hash_cookie := hashCookie(cookie)
 
-	rows, err1 := statement.Query(sha256_hash_cookie)
+	rows, err1 := statement.Query(sha256_hash_cookie, time.Now().UTC().UnixNano())
 	if err1 != nil {
-		return "could not authenticate request", ""
+		return internal.NewError(internal.Unauthenticated, "could not authenticate request"), ""
 	}
 
 	// if exists then return corresponding username
@@ -620,11 +869,11 @@ func authenticateRequest(cookie string) (string, string) {
 	if rows.Next() {
 		rows.Scan(&username)
 	} else {
-		return "could not authenticate request", ""
+		return internal.NewError(internal.Unauthenticated, "could not authenticate request"), ""
 	}
 	rows.Close()
 
-	return "", username
+	return internal.Error{}, username
 }
 
 /*
@@ -633,15 +882,15 @@ func authenticateRequest(cookie string) (string, string) {
  *
  * Parameters:
  * 		- username: a string representing a valid username
- * Returns: a string tuple, with the error in the first part and the root in the
+ * Returns: a tuple, with an internal.Error in the first part and the root in the
  * 				second if the request is valid
  */
-func rootForUsername(username string) (string, string) {
+func rootForUsername(username string) (internal.Error, string) {
 	// query for entry with given username
 	statement, _ := db.Prepare("SELECT root FROM metadata WHERE username = ?")
 	rows, err1 := statement.Query(username)
 	if err1 != nil {
-		return "could not find root", ""
+		return internal.NewError(internal.NotFound, "could not find root"), ""
 	}
 
 	// if exists then return corresponding root
@@ -649,11 +898,11 @@ func rootForUsername(username string) (string, string) {
 	if rows.Next() {
 		rows.Scan(&root)
 	} else {
-		return "could not find root", ""
+		return internal.NewError(internal.NotFound, "could not find root"), ""
 	}
 	rows.Close()
 
-	return "", root
+	return internal.Error{}, root
 
 }
 
@@ -662,66 +911,85 @@ func rootForUsername(username string) (string, string) {
  *              including edge cases (i.e. ../../etc) so user does not end up outside root,
  *
  * Parameters:
- * 		- pwd: a string representing a valid username
+ * 		- pwd: a string representing the session's pwd, relative to the root
  * 		- p: a string representing the user-inputted path
  * 		- root: a string representing the user's root
  *
- * Returns: a string tuple, with the error in the first part and a path in the
+ * Returns: a tuple, with an internal.Error in the first part and a path in the
  * 				second if the path is valid
  */
-func validatePath(pwd string, p string, root string) (string, string) {
+func validatePath(pwd string, p string, root string) (internal.Error, string) {
 
-	// clean path to account for ".." and see if path already is valid absolute without pwd
-	result := path.Clean(p)
-
-	// if absolue path
-	if strings.HasPrefix(result, "/") {
-		return "", abs_base_dir + root + result
+	// join relative paths onto the pwd, then clean against "/" to account for ".."
+	// (cleaning a path starting with "/" can never go above it)
+	result := p
+	if !strings.HasPrefix(result, "/") {
+		result = path.Join(pwd, p)
 	}
+	result = path.Clean("/" + result)
 
-	// joing the pwd and path
-	result = path.Clean(path.Join(pwd, p))
-
-	// if beyond root, return
-	if strings.HasPrefix(result, abs_base_dir + root) {
-		return "", result
-	} else {
-		return "", abs_base_dir + root
+	// the root itself has no trailing slash
+	if result == "/" {
+		return internal.Error{}, abs_base_dir + root
 	}
+	return internal.Error{}, abs_base_dir + root + result
+}
+
+/*
+ * rootForPath() - get the name of the root directory a validated path lies in
+ *
+ * Parameters:
+ * 		- p: a string representing a full path returned by performChecks()
+ * Returns: a string with the root directory name
+ */
+func rootForPath(p string) string {
+	rel := strings.TrimPrefix(p, abs_base_dir)
+	return strings.Split(rel, "/")[0]
 }
 
 /*
  * performChecks() - calls authenticateRequest() and validatePath() to validate
- * 					user and path selected
+ * 					user and path selected, paths starting with "~<owner>/" are
+ * 					resolved through the shares table instead
  *
  * Parameters:
  * 		- cookie: a string representing the user's cookie
  * 		- path: a string representing the user-inputted path
+ * 		- access: ACCESS_READ, ACCESS_WRITE or ACCESS_OWNER, the access the
+ * 				handler needs to the path
  *
- * Returns: a string tuple, with the error in the first part and a path in the
+ * Returns: a tuple, with an internal.Error in the first part and a path in the
  * 				second if the path is valid
  */
-func performChecks(cookie string, path string) (string, string) {
+func performChecks(cookie string, path string, access int) (internal.Error, string) {
 
 	// authenticate
 	err, username := authenticateRequest(cookie)
-	if (err != "") {
+	if err.Code != internal.OK {
 		return err, ""
 	}
 
+	// shared paths never point into the user's own root
+	if strings.HasPrefix(path, "~") {
+		if access == ACCESS_OWNER {
+			return internal.NewError(internal.PermissionDenied, "cannot perform this action on a shared file"), ""
+		}
+		return resolveSharedPath(username, path, access == ACCESS_WRITE)
+	}
+
 	// get root
 	err, root := rootForUsername(username)
-	if (err != "") {
+	if err.Code != internal.OK {
 		return err, ""
 	}
 
-	// validate path with the root
-	err, path = validatePath(getUserPWD(username), path, root)
-	if (err != "") {
+	// validate path with the root and the session's pwd
+	err, path = validatePath(getSessionPWD(cookie), path, root)
+	if err.Code != internal.OK {
 		return err, ""
 	}
 
-	return "", path
+	return internal.Error{}, path
 }
 
 /*
@@ -732,27 +1000,44 @@ func performChecks(cookie string, path string) (string, string) {
  * 		- path: a string representing the user-inputted path
  * 		- body: a byte array representing the data
  *
- * Returns: a string with an error message, or empty upon success
+ * Returns: an internal.Error, with code OK upon success
  */
-func uploadHandler(cookie string, path string, body []byte) string {
+func uploadHandler(cookie string, path string, body []byte) internal.Error {
 	// perform checks to validate user and action
-	err0, path := performChecks(cookie, path)
-	if err0 != "" {
+	err0, path := performChecks(cookie, path, ACCESS_WRITE)
+	if err0.Code != internal.OK {
 		return err0
 	}
 
-	// check upload size is valid
-	str := checkSizeName(cookie, len(body), path)
-	if (str != "") {
+	// check upload size is valid, and keep the root locked until written
+	unlock := lockRoot(rootForPath(path))
+	defer unlock()
+	str := checkSizeName(len(body), path)
+	if str.Code != internal.OK {
 		return str
 	}
 
-	// use linux commands to write file (code given to us by TAs)
-	err := ioutil.WriteFile(path, body, 0664)
+	// write file next to the other staging files, then move it into place
+	// keeping the old contents as a version
+	tmp, err := ioutil.TempFile(abs_base_dir + UPLOAD_DIR, "upload")
 	if err != nil {
-		return "could not write file"
+		return internal.NewError(internal.Internal, "could not write file")
 	}
-	return ""
+	_, err = tmp.Write(body)
+	tmp.Close()
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0664)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return internal.NewError(internal.Internal, "could not write file")
+	}
+
+	str = replaceFile(tmp.Name(), path)
+	if str.Code != internal.OK {
+		os.Remove(tmp.Name())
+	}
+	return str
 }
 
 /*
@@ -766,19 +1051,71 @@ func uploadHandler(cookie string, path string, body []byte) string {
  */
 func downloadHandler(cookie string, path string) internal.DownloadReturn {
 	// perform checks to validate user and action
-	err0, path := performChecks(cookie, path)
-	if err0 != "" {
+	err0, path := performChecks(cookie, path, ACCESS_READ)
+	if err0.Code != internal.OK {
 		return internal.DownloadReturn{Err: err0}
 	}
 
 	// use linux commands to download contents (code given to us by TAs)
 	body, err := ioutil.ReadFile(path)
 	if err != nil {
-		return internal.DownloadReturn{Err: "coud not read specified file"}
+		return internal.DownloadReturn{Err: internal.NewError(internal.NotFound, "coud not read specified file")}
 	}
 	return internal.DownloadReturn{Body: body}
 }
 
+/*
+ * downloadRangeHandler() - downloads part of a file, so that large files can be
+ * 					downloaded in several calls (and resumed)
+ *
+ * Parameters:
+ * 		- cookie: a string representing the user's cookie
+ * 		- path: a string representing the user-inputted path to download
+ * 		- offset: an int64 representing the first byte to download
+ * 		- length: an int64 representing the number of bytes to download, at
+ * 				most MAX_DOWNLOAD_CHUNK are returned
+ *
+ * Returns: an internal.RangeReturn with error, or the bytes read along with the
+ * 				size and modification time of the whole file on success (the
+ * 				body is short only at the end of the file)
+ */
+func downloadRangeHandler(cookie string, path string, offset int64, length int64) internal.RangeReturn {
+	// perform checks to validate user and action
+	err0, path := performChecks(cookie, path, ACCESS_READ)
+	if err0.Code != internal.OK {
+		return internal.RangeReturn{Err: err0}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return internal.RangeReturn{Err: internal.NewError(internal.NotFound, "coud not read specified file")}
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() {
+		return internal.RangeReturn{Err: internal.NewError(internal.NotFound, "coud not read specified file")}
+	}
+	ret := internal.RangeReturn{Size: fi.Size(), ModTime: fi.ModTime().UnixNano()}
+
+	if offset < 0 || length < 0 || offset > fi.Size() {
+		ret.Err = internal.NewError(internal.InvalidArgument, "range is outside of the file")
+		return ret
+	}
+	if length > MAX_DOWNLOAD_CHUNK {
+		length = MAX_DOWNLOAD_CHUNK
+	}
+	if length > fi.Size() - offset {
+		length = fi.Size() - offset
+	}
+
+	ret.Body = make([]byte, length)
+	_, err = f.ReadAt(ret.Body, offset)
+	if err != nil && err != io.EOF {
+		return internal.RangeReturn{Err: internal.NewError(internal.Internal, "could not read file")}
+	}
+	return ret
+}
+
 /*
  * listHandler() - lists file to a given location
  *
@@ -790,8 +1127,8 @@ func downloadHandler(cookie string, path string) internal.DownloadReturn {
  */
 func listHandler(cookie string, path string) internal.ListReturn {
 	// perform checks to validate user and action
-	err0, path := performChecks(cookie, path)
-	if err0 != "" {
+	err0, path := performChecks(cookie, path, ACCESS_READ)
+	if err0.Code != internal.OK {
 		return internal.ListReturn{Err: err0}
 	}
 
@@ -799,18 +1136,93 @@ func listHandler(cookie string, path string) internal.ListReturn {
 	fis, err := ioutil.ReadDir(path)
 	if err != nil {
 		fmt.Println(err.Error())
-		return internal.ListReturn{Err: "could not read specified path"}
+		return internal.ListReturn{Err: internal.NewError(internal.NotFound, "could not read specified path")}
 	}
 	var entries []internal.DirEnt
 	for _, fi := range fis {
-		entries = append(entries, internal.DirEnt{
-			IsDir_: fi.IsDir(),
-			Name_:  fi.Name(),
-		})
+		entries = append(entries, dirEntForFile(filepath.Join(path, fi.Name()), fi))
 	}
 	return internal.ListReturn{Entries: entries}
 }
 
+/*
+ * dirEntForFile() - builds the directory entry for a file or directory, with
+ * 					its size, modification time and (for files) content hash
+ *
+ * Parameters:
+ * 		- p: a string representing the full path to the file
+ * 		- fi: the os.FileInfo of the file
+ *
+ * Returns: an internal.DirEnt, with an empty hash if the file could not be read
+ */
+func dirEntForFile(p string, fi os.FileInfo) internal.DirEnt {
+	entry := internal.DirEnt{
+		IsDir_:   fi.IsDir(),
+		Name_:    fi.Name(),
+		Size_:    fi.Size(),
+		ModTime_: fi.ModTime().UnixNano(),
+	}
+	if fi.IsDir() {
+		return entry
+	}
+
+	// hash the contents so clients can tell if their copy is up to date
+	hash, err := hashFile(p)
+	if err == nil {
+		entry.Hash_ = hash
+	}
+	return entry
+}
+
+/*
+ * hashFile() - hashes the contents of a file without reading it into memory
+ *
+ * Parameters: p: a string representing the full path to the file
+ * Returns: the hex encoded sha256 hash of the contents, and an error if the
+ * 				file could not be read
+ */
+func hashFile(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+/*
+ * statHandler() - gets the metadata of a single file or directory
+ *
+ * Parameters:
+ * 		- cookie: a string representing the user's cookie
+ * 		- path: a string representing the user-inputted path
+ *
+ * Returns: an internal.StatReturn with error or the DirEnt on success
+ */
+func statHandler(cookie string, path string) internal.StatReturn {
+	// perform checks to validate user and action
+	err0, path := performChecks(cookie, path, ACCESS_READ)
+	if err0.Code != internal.OK {
+		return internal.StatReturn{Err: err0}
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return internal.StatReturn{Err: internal.NewError(internal.NotFound, "could not find specified path")}
+	}
+	entry := dirEntForFile(path, fi)
+
+	// never show the name of the root directory
+	if path == abs_base_dir + rootForPath(path) {
+		entry.Name_ = "/"
+	}
+	return internal.StatReturn{Entry: entry}
+}
+
 /*
  * mkdirHandler() - makes directory at a given location
  *
@@ -818,18 +1230,21 @@ func listHandler(cookie string, path string) internal.ListReturn {
  * 		- cookie: a string representing the user's cookie
  * 		- path: a string representing the user-inputted directory path to list
  *
- * Returns: a string with an error message, or empty upon success
+ * Returns: an internal.Error, with code OK upon success
  */
-func mkdirHandler(cookie string, path string) string {
+func mkdirHandler(cookie string, path string) internal.Error {
 	// perform checks to validate user and action
-	err0, path := performChecks(cookie, path)
-	if err0 != "" {
+	err0, path := performChecks(cookie, path, ACCESS_OWNER)
+	if err0.Code != internal.OK {
 		return err0
 	}
 
-	// make sure enough user storage space left to create directory
-	str := checkSizeName(cookie, -1, path)
-	if (str != "") {
+	// make sure enough user storage space left to create directory, and keep
+	// the root locked until it is made
+	unlock := lockRoot(rootForPath(path))
+	defer unlock()
+	str := checkSizeName(-1, path)
+	if str.Code != internal.OK {
 		return str
 	}
 
@@ -839,50 +1254,94 @@ func mkdirHandler(cookie string, path string) string {
 
 	// make sure directory nesting does not exceed nesting limits
 	if !checkNestedPath(path, root){
-		return "Too many nested files in path, must be less than 20"
+		return internal.NewError(internal.InvalidPath, fmt.Sprintf("Too many nested files in path, must be at most %v deep", config.MaxNesting))
 	}
 
 	// make sure directory addition does not exceed 20 sub-directory limit in one directory
-	num_directories := 0
-
-	// get array of FileInfo's from ReadDir()
-	files, err := ioutil.ReadDir(".")
-	if err != nil {
-		return "Error in ReadDir()"
+	str = checkSubdirCount(filepath.Dir(path))
+	if str.Code != internal.OK {
+		return str
+	}
+	err := os.Mkdir(path, 0775)
+	if os.IsExist(err) {
+		return internal.NewError(internal.AlreadyExists, "something already exists at specified path")
+	} else if err != nil {
+		return internal.NewError(internal.NotFound, "could not make path at specified path")
 	}
+	addUsage(db, root, DIR_USAGE)
+	return internal.Error{}
+}
 
-	// for all files in the directory, if it's a directory (not a file) increment num_directories
-	for _, file := range files {
-		if file.IsDir() {
-			num_directories++
-		}
+/*
+ * removeHandler() - removes file or directory at a given location by moving
+ * 					it to the user's trash
+ *
+ * Parameters:
+ * 		- cookie: a string representing the user's cookie
+ * 		- path: a string representing the user-inputted directory path to list
+ *
+ * Returns: an internal.Error, with code OK upon success
+ */
+func removeHandler(cookie string, path string) internal.Error {
+	// perform checks to validate user and action
+	err0, path := performChecks(cookie, path, ACCESS_OWNER)
+	if err0.Code != internal.OK {
+		return err0
 	}
 
-	// make sure directory addition does not exceed 20 sub-directory limit in one directory
-	if num_directories > 19 {
-		return "Too many sub-directories in this directory"
+	// make sure we are not deleting the root
+	_, username := authenticateRequest(cookie)
+	_, root := rootForUsername(username)
+
+	if path == abs_base_dir + root {
+		return internal.NewError(internal.PermissionDenied, "cannot remove root directory")
 	}
-	err = os.Mkdir(path, 0775)
+
+	unlock := lockRoot(root)
+	defer unlock()
+
+	// only empty directories can be removed
+	fi, err := os.Stat(path)
 	if err != nil {
-		return "could not make path at specified path"
+		return internal.NewError(internal.NotFound, "could not remove at specified path")
 	}
-	return ""
+	if fi.IsDir() {
+		files, err := ioutil.ReadDir(path)
+		if err != nil || len(files) > 0 {
+			return internal.NewError(internal.InvalidArgument, "could not remove at specified path, directory may not be empty")
+		}
+	}
+
+	// move file/directory to the trash instead of deleting it, its old
+	// versions go along
+	err1 := moveToTrash(path)
+	if err1.Code != internal.OK {
+		return err1
+	}
+
+	// a removed file can no longer be shared
+	deleteSharesForPath(username, strings.TrimPrefix(path, abs_base_dir + root))
+	return internal.Error{}
 }
 
 /*
- * removeHandler() - removes file or directory at a given location
+ * removeAllHandler() - removes a file or directory with everything in it by
+ * 					moving it to the user's trash in one go, or just lists what
+ * 					would be removed
  *
  * Parameters:
  * 		- cookie: a string representing the user's cookie
- * 		- path: a string representing the user-inputted directory path to list
+ * 		- path: a string representing the user-inputted path to remove
+ * 		- dry_run: a boolean, true to only list what would be removed
  *
- * Returns: a string with an error message, or empty upon success
+ * Returns: an internal.RemoveAllReturn with error, or the paths removed (or
+ * 				that would be) on success, each directory before its contents
  */
-func removeHandler(cookie string, path string) string {
+func removeAllHandler(cookie string, path string, dry_run bool) internal.RemoveAllReturn {
 	// perform checks to validate user and action
-	err0, path := performChecks(cookie, path)
-	if err0 != "" {
-		return err0
+	err0, path := performChecks(cookie, path, ACCESS_OWNER)
+	if err0.Code != internal.OK {
+		return internal.RemoveAllReturn{Err: err0}
 	}
 
 	// make sure we are not deleting the root
@@ -890,15 +1349,44 @@ func removeHandler(cookie string, path string) string {
 	_, root := rootForUsername(username)
 
 	if path == abs_base_dir + root {
-		return "cannot remove root directory"
+		return internal.RemoveAllReturn{Err: internal.NewError(internal.PermissionDenied, "cannot remove root directory")}
 	}
 
-	// use linux commands to remove file/directory (code given to us by TAs)
-	err := os.Remove(path)
-	if err != nil {
-		return "could not remove at specified path"
+	unlock := lockRoot(root)
+	defer unlock()
+
+	// list the tree as the user sees it
+	var paths []string
+	err := filepath.Walk(path, func(file string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		paths = append(paths, strings.TrimPrefix(file, abs_base_dir + root))
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return internal.RemoveAllReturn{Err: internal.NewError(internal.NotFound, "could not remove at specified path")}
+	} else if err != nil {
+		return internal.RemoveAllReturn{Err: internal.NewError(internal.Internal, "could not read specified path")}
 	}
-	return ""
+	if dry_run {
+		return internal.RemoveAllReturn{Paths: paths}
+	}
+
+	// the whole tree disappears with a single rename
+	err1 := moveToTrash(path)
+	if err1.Code != internal.OK {
+		return internal.RemoveAllReturn{Err: err1}
+	}
+
+	// nothing in the tree can be shared any more (its old versions went to the
+	// trash with it)
+	rel := strings.TrimPrefix(path, abs_base_dir + root)
+	n := utf8.RuneCountInString(rel)
+	statement, _ := db.Prepare("DELETE FROM shares WHERE owner = ? AND (path = ? OR substr(path, 1, ?) = ?)")
+	statement.Exec(username, rel, n + 1, rel + "/")
+
+	return internal.RemoveAllReturn{Paths: paths}
 }
 
 /*
@@ -911,27 +1399,14 @@ func removeHandler(cookie string, path string) string {
  */
 func pwdHandler(cookie string) internal.PWDReturn {
 	// check that request comes from valid user
-	err0, username := authenticateRequest(cookie)
-	if (err0 != "") {
+	err0, _ := authenticateRequest(cookie)
+	if err0.Code != internal.OK {
 		return internal.PWDReturn{Err: err0}
 	}
 
-	// get pwd from user_pwd table
-	path := getUserPWD(username)
-
-	// get root from username
-	err1, root := rootForUsername(username)
-	if (err1 != "") {
-		return internal.PWDReturn{Err: err1}
-	}
-
-	// trim pwd path so only user sees stuff past root directory
-	bad_path := abs_base_dir + root
-	path = strings.TrimPrefix(path, bad_path)
-
-	if path == "" {
-		path = "/"
-	}
+	// get pwd from session_pwd table, it is already relative to the root
+	// so the user only sees stuff past root directory
+	path := getSessionPWD(cookie)
 
 	return internal.PWDReturn{Path: path}
 }
@@ -943,27 +1418,31 @@ func pwdHandler(cookie string) internal.PWDReturn {
  * 		- cookie: a string representing the user's cookie
  * 		- path: a string representing the user-inputted directory path to list
  *
- * Returns: an internal.PWDReturn with error or path on success
+ * Returns: an internal.Error, with code OK upon success
  */
-func cdHandler(cookie string, path string) string {
+func cdHandler(cookie string, path string) internal.Error {
 	// check that request comes from valid user
-	err0, path := performChecks(cookie, path)
-	if err0 != "" {
+	err0, path := performChecks(cookie, path, ACCESS_OWNER)
+	if err0.Code != internal.OK {
 		return err0
 	}
 
-	// valid path and request up to this point
-	err := os.Chdir(path)
-	if err != nil {
-		return "could not change directory to specified path"
+	// valid path and request up to this point, make sure it is a directory
+	fi, err := os.Stat(path)
+	if err != nil || !fi.IsDir() {
+		return internal.NewError(internal.NotFound, "could not change directory to specified path")
 	}
 
-	// update the pwd table
+	// update the session's pwd, stored relative to the root
 	_, username := authenticateRequest(cookie)
-	statement, _ := db.Prepare("update user_pwd set pwd = ? where username = ?")
-	statement.Exec(path, username)
+	_, root := rootForUsername(username)
+	pwd := strings.TrimPrefix(path, abs_base_dir + root)
+	if pwd == "" {
+		pwd = "/"
+	}
+	setSessionPWD(hashCookie(cookie), pwd)
 
-	return ""
+	return internal.Error{}
 }
 
 // given as part of TA code, called when we shut down ./server binary
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"../internal"
+)
+
+const TEST_PASSWORD = "Test-pass-1" // meets the default password policy
+
+// setUp gives the test an empty data directory and database, set up the way
+// main() does, until the test ends
+func setUp(t *testing.T) {
+	setUpUnmigrated(t)
+	err := migrate()
+	if err != nil {
+		t.Fatalf("migrate(): %v", err)
+	}
+}
+
+// setUpUnmigrated is setUp without migrating the database, which is left empty
+func setUpUnmigrated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dropbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old_config, old_base_dir, old_db, old_policy := config, abs_base_dir, db, password_policy
+	t.Cleanup(func() {
+		if db != nil {
+			db.Close()
+		}
+		config, abs_base_dir, db, password_policy = old_config, old_base_dir, old_db, old_policy
+		os.RemoveAll(dir)
+	})
+
+	c := defaultConfig()
+	c.DataDir = dir
+	c.Database = filepath.Join(dir, DEFAULT_DATABASE)
+	// hashing at full cost would only make the tests slow
+	c.Argon2Memory = 64
+	c.Argon2Threads = 1
+	policy, err := newPasswordPolicy(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config = c
+	password_policy = policy
+	abs_base_dir = dir + "/"
+
+	openDB(t)
+	os.MkdirAll(abs_base_dir + UPLOAD_DIR, 0775)
+}
+
+// openDB opens the database of the configuration, the way main() does
+func openDB(t *testing.T) {
+	var err error
+	db, err = sql.Open("sqlite3", config.Database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+}
+
+// signUp makes an account and logs it in, and returns its cookie
+func signUp(t *testing.T, username string) string {
+	err := signupHandler("addr-" + username, username, TEST_PASSWORD)
+	if err.Code != internal.OK {
+		t.Fatalf("signupHandler(%q) = %v", username, err)
+	}
+	return logIn(t, username, "test")
+}
+
+// logIn starts another session of an account, and returns its cookie
+func logIn(t *testing.T, username string, device string) string {
+	ret := loginHandler("addr-" + username, username, TEST_PASSWORD, device)
+	if ret.Err.Code != internal.OK {
+		t.Fatalf("loginHandler(%q) = %v", username, ret.Err)
+	}
+	return ret.Cookie
+}
+
+// rootOf gets the full path to the root of a user, ending in "/"
+func rootOf(t *testing.T, username string) string {
+	err, root := rootForUsername(username)
+	if err.Code != internal.OK {
+		t.Fatalf("rootForUsername(%q) = %v", username, err)
+	}
+	return abs_base_dir + root + "/"
+}
+
+// mustOK fails the test if a handler did not succeed
+func mustOK(t *testing.T, what string, err internal.Error) {
+	t.Helper()
+	if err.Code != internal.OK {
+		t.Fatalf("%v = %v (%v), want OK", what, err.Code, err.Message)
+	}
+}
+
+// wantCode reports an error if a handler did not fail (or succeed) as expected
+func wantCode(t *testing.T, what string, err internal.Error, want internal.ErrorCode) {
+	t.Helper()
+	if err.Code != want {
+		t.Errorf("%v = %v (%v), want %v", what, err.Code, err.Message, want)
+	}
+}
+
+// readFile gets the contents of a file, or "" if there is none
+func readFile(p string) string {
+	b, _ := ioutil.ReadFile(p)
+	return string(b)
+}
+
+// listNames gets the names listed in a directory, in order
+func listNames(t *testing.T, cookie string, p string) []string {
+	ret := listHandler(cookie, p)
+	mustOK(t, fmt.Sprintf("listHandler(%q)", p), ret.Err)
+	var names []string
+	for _, entry := range ret.Entries {
+		names = append(names, entry.Name_)
+	}
+	return names
+}
+
+func TestSessionPWD(t *testing.T) {
+	setUp(t)
+	wd, _ := os.Getwd()
+	alice := signUp(t, "alice")
+	alice2 := logIn(t, "alice", "laptop")
+	bob := signUp(t, "bob")
+
+	for _, dir := range []string{"a", "a/in_a", "b", "b/in_b"} {
+		mustOK(t, "mkdir " + dir, mkdirHandler(alice, dir))
+	}
+	mustOK(t, "bob's mkdir c", mkdirHandler(bob, "c"))
+
+	// each session of each user has a pwd of its own
+	mustOK(t, "cd a", cdHandler(alice, "a"))
+	mustOK(t, "cd b", cdHandler(alice2, "/b"))
+	mustOK(t, "bob's cd c", cdHandler(bob, "c/../c"))
+	for _, test := range []struct {
+		cookie string
+		pwd    string
+		list   string
+	}{
+		{alice, "/a", "in_a"},
+		{alice2, "/b", "in_b"},
+		{bob, "/c", ""},
+	} {
+		if got := pwdHandler(test.cookie).Path; got != test.pwd {
+			t.Errorf("pwd = %q, want %q", got, test.pwd)
+		}
+		if got := fmt.Sprint(listNames(t, test.cookie, ".")); got != "[" + test.list + "]" {
+			t.Errorf("list . in %v = %v, want [%v]", test.pwd, got, test.list)
+		}
+	}
+
+	// relative paths are relative to the session's pwd
+	mustOK(t, "upload", uploadHandler(alice, "f.txt", []byte("in a")))
+	if got := readFile(rootOf(t, "alice") + "a/f.txt"); got != "in a" {
+		t.Errorf("a/f.txt = %q, want %q", got, "in a")
+	}
+	wantCode(t, "download from the other session", downloadHandler(alice2, "f.txt").Err, internal.NotFound)
+	mustOK(t, "download by path", downloadHandler(alice2, "../a/f.txt").Err)
+
+	// cd never leaves the root or goes anywhere but a directory
+	mustOK(t, "cd ../..", cdHandler(bob, "../../.."))
+	if got := pwdHandler(bob).Path; got != "/" {
+		t.Errorf("pwd after cd ../.. = %q, want %q", got, "/")
+	}
+	wantCode(t, "cd to a file", cdHandler(alice, "f.txt"), internal.NotFound)
+	wantCode(t, "cd to a missing directory", cdHandler(alice, "nowhere"), internal.NotFound)
+	wantCode(t, "cd to a shared file", cdHandler(bob, "~alice/a"), internal.PermissionDenied)
+	if got := pwdHandler(alice).Path; got != "/a" {
+		t.Errorf("pwd after failed cds = %q, want %q", got, "/a")
+	}
+
+	// sessions changing directory at the same time do not see each other's pwd
+	var wg sync.WaitGroup
+	for _, session := range []struct {
+		cookie string
+		dirs   []string
+	}{
+		{alice, []string{"/a", "/a/in_a"}},
+		{alice2, []string{"/b", "/b/in_b"}},
+	} {
+		wg.Add(1)
+		go func(cookie string, dirs []string) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				dir := dirs[i % 2]
+				cdHandler(cookie, dir)
+				if got := pwdHandler(cookie).Path; got != dir {
+					t.Errorf("pwd after cd %v = %q", dir, got)
+					return
+				}
+			}
+		}(session.cookie, session.dirs)
+	}
+	wg.Wait()
+
+	// sessions in a removed directory go back to the root, whichever way it
+	// was removed, and other users' sessions stay where they are
+	mustOK(t, "bob's cd c", cdHandler(bob, "/c"))
+	mustOK(t, "remove b/in_b", removeHandler(alice, "/b/in_b"))
+	mustOK(t, "remove a", removeAllHandler(alice2, "/a", false).Err)
+	for _, test := range []struct {
+		cookie string
+		pwd    string
+	}{
+		{alice, "/"},
+		{alice2, "/"},
+		{bob, "/c"},
+	} {
+		if got := pwdHandler(test.cookie).Path; got != test.pwd {
+			t.Errorf("pwd after removing = %q, want %q", got, test.pwd)
+		}
+	}
+
+	if got, _ := os.Getwd(); got != wd {
+		t.Errorf("os.Getwd() = %q after the test, want %q", got, wd)
+	}
+}
+
+func TestStatAndListMetadata(t *testing.T) {
+	setUp(t)
+	alice := signUp(t, "alice")
+	bob := signUp(t, "bob")
+	mustOK(t, "mkdir dir", mkdirHandler(alice, "dir"))
+	mustOK(t, "upload f.txt", uploadHandler(alice, "dir/f.txt", []byte("hello")))
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	os.Chtimes(rootOf(t, "alice") + "dir/f.txt", mtime, mtime)
+
+	want := internal.DirEnt{Name_: "f.txt", Size_: 5, ModTime_: mtime.UnixNano(), Hash_: sha256Hex("hello")}
+	ret := statHandler(alice, "dir/f.txt")
+	mustOK(t, "stat f.txt", ret.Err)
+	if ret.Entry != want {
+		t.Errorf("stat f.txt = %+v, want %+v", ret.Entry, want)
+	}
+
+	// list gives every entry the same metadata as stat
+	list := listHandler(alice, "dir")
+	mustOK(t, "list dir", list.Err)
+	if len(list.Entries) != 1 || list.Entries[0] != want {
+		t.Errorf("list dir = %+v, want [%+v]", list.Entries, want)
+	}
+
+	// directories have no hash, and the root is never shown by its name
+	for _, test := range []struct {
+		path string
+		name string
+	}{
+		{"dir", "dir"},
+		{"/", "/"},
+		{"dir/..", "/"},
+	} {
+		ret := statHandler(alice, test.path)
+		mustOK(t, "stat " + test.path, ret.Err)
+		if !ret.Entry.IsDir_ || ret.Entry.Name_ != test.name || ret.Entry.Hash_ != "" {
+			t.Errorf("stat %v = %+v, want directory %q without a hash", test.path, ret.Entry, test.name)
+		}
+	}
+	wantCode(t, "stat of a missing file", statHandler(alice, "dir/nothing").Err, internal.NotFound)
+
+	// a shared file looks the same to the sharee
+	mustOK(t, "share f.txt", shareHandler(alice, "dir/f.txt", "bob", false))
+	ret = statHandler(bob, "~alice/dir/f.txt")
+	mustOK(t, "bob's stat f.txt", ret.Err)
+	if ret.Entry != want {
+		t.Errorf("bob's stat f.txt = %+v, want %+v", ret.Entry, want)
+	}
+	wantCode(t, "bob's stat dir", statHandler(bob, "~alice/dir").Err, internal.NotFound)
+
+	// a new upload changes the hash, so clients know to download again
+	mustOK(t, "upload f.txt again", uploadHandler(alice, "dir/f.txt", []byte("hello!")))
+	if got := statHandler(alice, "dir/f.txt").Entry; got.Hash_ != sha256Hex("hello!") || got.Size_ != 6 {
+		t.Errorf("stat f.txt after upload = %+v, want size 6 and the new hash", got)
+	}
+}
+
+func TestDownloadRange(t *testing.T) {
+	setUp(t)
+	alice := signUp(t, "alice")
+	data := strings.Repeat("0123456789", MAX_DOWNLOAD_CHUNK / 10 * 3 / 2)
+	mustOK(t, "upload", uploadHandler(alice, "big.txt", []byte(data)))
+	size := int64(len(data))
+	fi, _ := os.Stat(rootOf(t, "alice") + "big.txt")
+
+	for _, test := range []struct {
+		offset int64
+		length int64
+		want   string
+		code   internal.ErrorCode
+	}{
+		{0, 10, data[:10], internal.OK},
+		{5, 2 * MAX_DOWNLOAD_CHUNK, data[5:5 + MAX_DOWNLOAD_CHUNK], internal.OK},
+		{MAX_DOWNLOAD_CHUNK, MAX_DOWNLOAD_CHUNK, data[MAX_DOWNLOAD_CHUNK:], internal.OK},
+		{size, 10, "", internal.OK},
+		{size + 1, 10, "", internal.InvalidArgument},
+		{-1, 10, "", internal.InvalidArgument},
+		{0, -1, "", internal.InvalidArgument},
+	} {
+		ret := downloadRangeHandler(alice, "big.txt", test.offset, test.length)
+		what := fmt.Sprintf("download_range(%v, %v)", test.offset, test.length)
+		wantCode(t, what, ret.Err, test.code)
+		if string(ret.Body) != test.want {
+			t.Errorf("%v returned %v bytes, want %v", what, len(ret.Body), len(test.want))
+		}
+		// the size and modification time come with errors about the range too
+		if ret.Size != size || ret.ModTime != fi.ModTime().UnixNano() {
+			t.Errorf("%v size, mod time = %v, %v, want %v, %v", what, ret.Size, ret.ModTime, size, fi.ModTime().UnixNano())
+		}
+	}
+	wantCode(t, "download_range of a directory", downloadRangeHandler(alice, "/", 0, 10).Err, internal.NotFound)
+	wantCode(t, "download_range of a missing file", downloadRangeHandler(alice, "nothing", 0, 10).Err, internal.NotFound)
+
+	// a new upload has a new modification time, which is how clients notice
+	// the file changed under a resumed download
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	os.Chtimes(rootOf(t, "alice") + "big.txt", mtime, mtime)
+	mustOK(t, "upload again", uploadHandler(alice, "big.txt", []byte(data)))
+	if ret := downloadRangeHandler(alice, "big.txt", 0, 10); ret.ModTime == mtime.UnixNano() {
+		t.Errorf("mod time did not change with a new upload")
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"time"
+
+	"../internal"
+)
+
+// Sessions are shown to their user by a prefix of the stored (hashed) session
+// id, which identifies them without revealing anything that could be used as a
+// cookie.
+const SESSION_ID_DISPLAY_LEN = 12
+
+/*
+ * listSessionsHandler() - lists the unexpired sessions of the user, one per
+ * 						device they are logged in on
+ *
+ * Parameters:
+ * 		- cookie: a string representing the user's cookie
+ *
+ * Returns: an internal.SessionsReturn with error or sessions on success
+ */
+func listSessionsHandler(cookie string) internal.SessionsReturn {
+	// check that request comes from valid user
+	err0, username := authenticateRequest(cookie)
+	if err0.Code != internal.OK {
+		return internal.SessionsReturn{Err: err0}
+	}
+	current := hashCookie(cookie)
+
+	statement, _ := db.Prepare("SELECT session_id, device, created, expiration_date FROM sessions WHERE username = ? AND expiration_date > ? ORDER BY created")
+	rows, err := statement.Query(username, time.Now().UTC().UnixNano())
+	if err != nil {
+		return internal.SessionsReturn{Err: internal.NewError(internal.Internal, "could not list sessions")}
+	}
+	var sessions []internal.Session
+	for rows.Next() {
+		var session_id string
+		var device *string
+		var created *int64
+		var session internal.Session
+		rows.Scan(&session_id, &device, &created, &session.Expires_)
+
+		// sessions from before devices were recorded have no label
+		session.ID_ = session_id[:SESSION_ID_DISPLAY_LEN]
+		session.Device_ = "unknown"
+		if device != nil && *device != "" {
+			session.Device_ = *device
+		}
+		if created != nil {
+			session.Created_ = *created
+		}
+		session.Current_ = session_id == current
+		sessions = append(sessions, session)
+	}
+	rows.Close()
+
+	return internal.SessionsReturn{Sessions: sessions}
+}
+
+/*
+ * revokeSessionHandler() - logs the user out on another device
+ *
+ * Parameters:
+ * 		- cookie: a string representing the user's cookie
+ * 		- id: a string representing the session id as shown by list_sessions
+ *
+ * Returns: an internal.Error, with code OK upon success
+ */
+func revokeSessionHandler(cookie string, id string) internal.Error {
+	// check that request comes from valid user
+	err0, username := authenticateRequest(cookie)
+	if err0.Code != internal.OK {
+		return err0
+	}
+	if len(id) != SESSION_ID_DISPLAY_LEN {
+		return internal.NewError(internal.InvalidArgument, "invalid session id")
+	}
+	if hashCookie(cookie)[:SESSION_ID_DISPLAY_LEN] == id {
+		return internal.NewError(internal.InvalidArgument, "cannot revoke the current session, use logout instead")
+	}
+
+	// only ever look at the user's own sessions
+	statement, _ := db.Prepare("SELECT session_id FROM sessions WHERE username = ? AND substr(session_id, 1, ?) = ?")
+	rows, err := statement.Query(username, SESSION_ID_DISPLAY_LEN, id)
+	if err != nil {
+		return internal.NewError(internal.Internal, "could not revoke session")
+	}
+	var session_ids []string
+	for rows.Next() {
+		var session_id string
+		rows.Scan(&session_id)
+		session_ids = append(session_ids, session_id)
+	}
+	rows.Close()
+
+	if len(session_ids) == 0 {
+		return internal.NewError(internal.NotFound, "no session with that id")
+	}
+	for _, session_id := range session_ids {
+		if deleteSession(session_id) != nil {
+			return internal.NewError(internal.Internal, "could not revoke session")
+		}
+	}
+	return internal.Error{}
+}
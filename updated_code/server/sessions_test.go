@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+
+	"../internal"
+)
+
+func TestSessions(t *testing.T) {
+	setUp(t)
+	desktop := signUp(t, "alice")
+	laptop := logIn(t, "alice", "laptop")
+	phone := logIn(t, "alice", "phone")
+	bob := signUp(t, "bob")
+
+	// every device is listed, oldest first, and only the caller's is current
+	ret := listSessionsHandler(laptop)
+	mustOK(t, "listSessionsHandler()", ret.Err)
+	if len(ret.Sessions) != 3 {
+		t.Fatalf("%v sessions listed, want 3", len(ret.Sessions))
+	}
+	ids := make(map[string]string)
+	for i, device := range []string{"test", "laptop", "phone"} {
+		session := ret.Sessions[i]
+		if session.Device_ != device || session.Current_ != (device == "laptop") || len(session.ID_) != SESSION_ID_DISPLAY_LEN {
+			t.Errorf("session %v = %+v, want device %q, current only for the laptop", i, session, device)
+		}
+		ids[device] = session.ID_
+	}
+	bob_ret := listSessionsHandler(bob)
+	mustOK(t, "bob's listSessionsHandler()", bob_ret.Err)
+	if len(bob_ret.Sessions) != 1 {
+		t.Fatalf("%v sessions listed for bob, want 1", len(bob_ret.Sessions))
+	}
+
+	wantCode(t, "revoke the current session", revokeSessionHandler(laptop, ids["laptop"]), internal.InvalidArgument)
+	wantCode(t, "revoke by a short id", revokeSessionHandler(laptop, ids["phone"][:4]), internal.InvalidArgument)
+	wantCode(t, "revoke bob's session", revokeSessionHandler(laptop, bob_ret.Sessions[0].ID_), internal.NotFound)
+	mustOK(t, "bob is still logged in", authenticateHandler(bob).Err)
+
+	// a revoked device is logged out, the others are not
+	mustOK(t, "revoke the phone", revokeSessionHandler(laptop, ids["phone"]))
+	wantCode(t, "phone after revoking", listSessionsHandler(phone).Err, internal.Unauthenticated)
+	wantCode(t, "revoke the phone again", revokeSessionHandler(laptop, ids["phone"]), internal.NotFound)
+	mustOK(t, "desktop after revoking", listSessionsHandler(desktop).Err)
+
+	mustOK(t, "logout", logoutHandler(laptop))
+	ret = listSessionsHandler(desktop)
+	mustOK(t, "listSessionsHandler() after logout", ret.Err)
+	if len(ret.Sessions) != 1 || ret.Sessions[0].Device_ != "test" || !ret.Sessions[0].Current_ {
+		t.Errorf("sessions after logout = %+v, want only the current one", ret.Sessions)
+	}
+}
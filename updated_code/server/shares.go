@@ -0,0 +1,203 @@
+package main
+
+import (
+	"os"
+	"path"
+	"strings"
+
+	"../internal"
+)
+
+// A shared file is addressed by its owner's name and its path inside the
+// owner's root, i.e. "~alice/docs/notes.txt" is /docs/notes.txt in alice's
+// root. Only the shares table decides whether the caller may reach it.
+
+/*
+ * resolveSharedPath() - turns a "~<owner>/<path>" path into a full path in the
+ * 					owner's root, if that file is shared with the user
+ *
+ * Parameters:
+ * 		- username: a string representing the user making the request
+ * 		- p: a string representing the user-inputted path, starting with "~"
+ * 		- write: a boolean, true if the handler is going to modify the file
+ *
+ * Returns: a tuple, with an internal.Error in the first part and a path in the
+ * 				second if the path is valid
+ */
+func resolveSharedPath(username string, p string, write bool) (internal.Error, string) {
+	// split "~owner/rest" into owner and rest, cleaning rest against "/"
+	parts := strings.SplitN(strings.TrimPrefix(p, "~"), "/", 2)
+	owner := resolveUsername(parts[0])
+	rel := "/"
+	if len(parts) == 2 {
+		rel = path.Clean("/" + parts[1])
+	}
+
+	err, root := rootForUsername(owner)
+	if err.Code != internal.OK {
+		return internal.NewError(internal.NotFound, "shared file not found"), ""
+	}
+
+	// "~<self>/..." is just a path in the user's own root
+	if owner == username {
+		return internal.Error{}, abs_base_dir + root + rel
+	}
+
+	statement, _ := db.Prepare("SELECT write_perm FROM shares WHERE owner = ? AND path = ? AND sharee = ?")
+	rows, err1 := statement.Query(owner, rel, username)
+	if err1 != nil {
+		return internal.NewError(internal.NotFound, "shared file not found"), ""
+	}
+	var write_perm bool
+	if rows.Next() {
+		rows.Scan(&write_perm)
+	} else {
+		rows.Close()
+		return internal.NewError(internal.NotFound, "shared file not found"), ""
+	}
+	rows.Close()
+
+	if write && !write_perm {
+		return internal.NewError(internal.PermissionDenied, "file is shared read-only"), ""
+	}
+
+	return internal.Error{}, abs_base_dir + root + rel
+}
+
+/*
+ * deleteSharesForPath() - deletes all shares on a file if any exist
+ *
+ * Parameters:
+ * 		- owner: a string representing the username of the file's owner
+ * 		- rel: a string representing the file's path relative to the owner's root
+ * Returns: nothing
+ */
+func deleteSharesForPath(owner string, rel string) {
+	statement, _ := db.Prepare("DELETE FROM shares WHERE owner = ? AND path = ?")
+	statement.Exec(owner, rel)
+}
+
+/*
+ * shareHandler() - shares a file in the user's root with another user,
+ * 					overwriting the permissions of an existing share
+ *
+ * Parameters:
+ * 		- cookie: a string representing the user's cookie
+ * 		- path: a string representing the user-inputted path of the file
+ * 		- sharee: a string representing the username to share with
+ * 		- write: a boolean, true for a read/write share, false for read-only
+ *
+ * Returns: an internal.Error, with code OK upon success
+ */
+func shareHandler(cookie string, path string, sharee string, write bool) internal.Error {
+	// perform checks to validate user and action
+	err0, path := performChecks(cookie, path, ACCESS_OWNER)
+	if err0.Code != internal.OK {
+		return err0
+	}
+
+	_, username := authenticateRequest(cookie)
+	_, root := rootForUsername(username)
+
+	// sharee has to be somebody else with an account, named in any case or
+	// Unicode form
+	sharee = resolveUsername(sharee)
+	if sharee == username {
+		return internal.NewError(internal.InvalidArgument, "cannot share a file with yourself")
+	}
+	if err1, _ := rootForUsername(sharee); err1.Code != internal.OK {
+		return internal.NewError(internal.NotFound, "user to share with does not exist")
+	}
+
+	// only regular files can be shared
+	fi, err := os.Stat(path)
+	if err != nil {
+		return internal.NewError(internal.NotFound, "could not find file at specified path")
+	}
+	if !fi.Mode().IsRegular() {
+		return internal.NewError(internal.InvalidPath, "only files can be shared")
+	}
+
+	// insert or overwrite the share
+	rel := strings.TrimPrefix(path, abs_base_dir + root)
+	statement, _ := db.Prepare("INSERT OR REPLACE INTO shares (owner, path, sharee, write_perm) VALUES (?, ?, ?, ?)")
+	_, err = statement.Exec(username, rel, sharee, write)
+	if err != nil {
+		return internal.NewError(internal.Internal, "could not share file")
+	}
+	return internal.Error{}
+}
+
+/*
+ * removeShareHandler() - removes the share on a file from a user, or every
+ * 					share on the file if sharee is empty
+ *
+ * Parameters:
+ * 		- cookie: a string representing the user's cookie
+ * 		- path: a string representing the user-inputted path of the file
+ * 		- sharee: a string representing the username, or empty for all users
+ *
+ * Returns: an internal.Error, with code OK upon success
+ */
+func removeShareHandler(cookie string, path string, sharee string) internal.Error {
+	// perform checks to validate user and action
+	err0, path := performChecks(cookie, path, ACCESS_OWNER)
+	if err0.Code != internal.OK {
+		return err0
+	}
+
+	_, username := authenticateRequest(cookie)
+	_, root := rootForUsername(username)
+	rel := strings.TrimPrefix(path, abs_base_dir + root)
+
+	if sharee == "" {
+		deleteSharesForPath(username, rel)
+		return internal.Error{}
+	}
+
+	statement, _ := db.Prepare("DELETE FROM shares WHERE owner = ? AND path = ? AND sharee = ?")
+	result, err := statement.Exec(username, rel, resolveUsername(sharee))
+	if err != nil {
+		return internal.NewError(internal.Internal, "could not remove share")
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return internal.NewError(internal.NotFound, "file is not shared with that user")
+	}
+	return internal.Error{}
+}
+
+/*
+ * getSharesHandler() - lists the shares on a file in the user's root
+ *
+ * Parameters:
+ * 		- cookie: a string representing the user's cookie
+ * 		- path: a string representing the user-inputted path of the file
+ *
+ * Returns: an internal.SharesReturn with error or shares on success
+ */
+func getSharesHandler(cookie string, path string) internal.SharesReturn {
+	// perform checks to validate user and action
+	err0, path := performChecks(cookie, path, ACCESS_OWNER)
+	if err0.Code != internal.OK {
+		return internal.SharesReturn{Err: err0}
+	}
+
+	_, username := authenticateRequest(cookie)
+	_, root := rootForUsername(username)
+	rel := strings.TrimPrefix(path, abs_base_dir + root)
+
+	statement, _ := db.Prepare("SELECT sharee, write_perm FROM shares WHERE owner = ? AND path = ? ORDER BY sharee")
+	rows, err := statement.Query(username, rel)
+	if err != nil {
+		return internal.SharesReturn{Err: internal.NewError(internal.Internal, "could not get shares")}
+	}
+	var shares []internal.Share
+	for rows.Next() {
+		var share internal.Share
+		rows.Scan(&share.Sharee_, &share.WritePerm_)
+		shares = append(shares, share)
+	}
+	rows.Close()
+
+	return internal.SharesReturn{Shares: shares}
+}
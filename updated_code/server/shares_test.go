@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+
+	"../internal"
+)
+
+func TestSharePermissions(t *testing.T) {
+	setUp(t)
+	alice := signUp(t, "alice")
+	bob := signUp(t, "bob")
+	carol := signUp(t, "carol")
+
+	mustOK(t, "upload ro.txt", uploadHandler(alice, "ro.txt", []byte("read only")))
+	mustOK(t, "upload rw.txt", uploadHandler(alice, "rw.txt", []byte("read write")))
+	mustOK(t, "upload private.txt", uploadHandler(alice, "private.txt", []byte("private")))
+	mustOK(t, "mkdir dir", mkdirHandler(alice, "dir"))
+	mustOK(t, "share ro.txt", shareHandler(alice, "ro.txt", "bob", false))
+	mustOK(t, "share rw.txt", shareHandler(alice, "/rw.txt", "Bob", true))
+
+	// only files, with somebody else who exists
+	wantCode(t, "share dir", shareHandler(alice, "dir", "bob", false), internal.InvalidPath)
+	wantCode(t, "share with self", shareHandler(alice, "ro.txt", "alice", false), internal.InvalidArgument)
+	wantCode(t, "share with nobody", shareHandler(alice, "ro.txt", "nobody", false), internal.NotFound)
+
+	tests := []struct {
+		what string
+		err  internal.Error
+		want internal.ErrorCode
+	}{
+		// read
+		{"bob downloads ro.txt", downloadHandler(bob, "~alice/ro.txt").Err, internal.OK},
+		{"bob downloads rw.txt", downloadHandler(bob, "~ALICE/rw.txt").Err, internal.OK},
+		{"bob downloads private.txt", downloadHandler(bob, "~alice/private.txt").Err, internal.NotFound},
+		{"carol downloads ro.txt", downloadHandler(carol, "~alice/ro.txt").Err, internal.NotFound},
+		{"bob downloads out of the root", downloadHandler(bob, "~alice/../../ro.txt").Err, internal.OK},
+		{"bob downloads from nobody", downloadHandler(bob, "~nobody/ro.txt").Err, internal.NotFound},
+		{"bob lists alice's root", listHandler(bob, "~alice/").Err, internal.NotFound},
+
+		// write
+		{"bob uploads ro.txt", uploadHandler(bob, "~alice/ro.txt", []byte("changed")), internal.PermissionDenied},
+		{"bob uploads rw.txt", uploadHandler(bob, "~alice/rw.txt", []byte("changed")), internal.OK},
+		{"bob uploads next to rw.txt", uploadHandler(bob, "~alice/new.txt", []byte("new")), internal.NotFound},
+
+		// owner only
+		{"bob removes rw.txt", removeHandler(bob, "~alice/rw.txt"), internal.PermissionDenied},
+		{"bob shares ro.txt on", shareHandler(bob, "~alice/ro.txt", "carol", false), internal.PermissionDenied},
+		{"bob moves rw.txt", moveHandler(bob, "~alice/rw.txt", "rw.txt"), internal.PermissionDenied},
+		{"bob removes the share", removeShareHandler(bob, "~alice/ro.txt", "bob"), internal.PermissionDenied},
+	}
+	for _, test := range tests {
+		wantCode(t, test.what, test.err, test.want)
+	}
+
+	if got := readFile(rootOf(t, "alice") + "ro.txt"); got != "read only" {
+		t.Errorf("ro.txt = %q after bob wrote to it, want %q", got, "read only")
+	}
+	if got := readFile(rootOf(t, "alice") + "rw.txt"); got != "changed" {
+		t.Errorf("rw.txt = %q after bob wrote to it, want %q", got, "changed")
+	}
+
+	// a removed share, or a removed file, no longer lets bob in
+	mustOK(t, "rm_share ro.txt", removeShareHandler(alice, "ro.txt", "bob"))
+	wantCode(t, "bob downloads ro.txt after rm_share", downloadHandler(bob, "~alice/ro.txt").Err, internal.NotFound)
+	mustOK(t, "remove rw.txt", removeHandler(alice, "rw.txt"))
+	mustOK(t, "upload rw.txt again", uploadHandler(alice, "rw.txt", []byte("new file")))
+	wantCode(t, "bob downloads a new rw.txt", downloadHandler(bob, "~alice/rw.txt").Err, internal.NotFound)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// Every random value the server hands out or stores comes from newToken(),
+// which reads crypto/rand. Each purpose has its own length and format, so a
+// token of one kind can never be mistaken for (or used as) another kind.
+// Cookies issued before this format keep working: sessions are looked up by
+// the hash of whatever cookie the client sends.
+const (
+	TOKEN_SESSION  = iota // session cookies: "s" + 64 hex characters (256 bits)
+	TOKEN_SALT            // password salts: 32 hex characters (128 bits)
+	TOKEN_ROOT            // user root directory names: "r" + 32 hex characters (128 bits)
+	TOKEN_UPLOAD          // upload session ids: "u" + 32 hex characters (128 bits)
+	TOKEN_VERSION         // old file version names: "v" + 32 hex characters (128 bits)
+	TOKEN_TRASH           // trash entry ids, typed by users: "t" + 12 hex characters (48 bits)
+	TOKEN_PENDING         // logins waiting for a two-factor code: "p" + 64 hex characters (256 bits)
+	TOKEN_RECOVERY        // two-factor recovery codes, typed by users: 16 hex characters (64 bits)
+	TOKEN_RESET           // password reset tokens, typed by users: 24 hex characters (96 bits)
+)
+
+// number of random bytes and prefix for each token purpose
+var token_formats = map[int]struct {
+	prefix string
+	size   int
+}{
+	TOKEN_SESSION:  {"s", 32},
+	TOKEN_SALT:     {"", 16},
+	TOKEN_ROOT:     {"r", 16},
+	TOKEN_UPLOAD:   {"u", 16},
+	TOKEN_VERSION:  {"v", 16},
+	TOKEN_TRASH:    {"t", 6},
+	TOKEN_PENDING:  {"p", 32},
+	TOKEN_RECOVERY: {"", 8},
+	TOKEN_RESET:    {"", 12},
+}
+
+/*
+ * newToken() - generates a random token for the given purpose from a
+ * 						cryptographically secure source
+ *
+ * Parameters: purpose: one of the TOKEN_ constants
+ * Returns: the token, and an error if no randomness could be read
+ */
+func newToken(purpose int) (string, error) {
+	format := token_formats[purpose]
+	b := make([]byte, format.size)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return format.prefix + hex.EncodeToString(b), nil
+}
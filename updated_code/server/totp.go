@@ -0,0 +1,411 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"../internal"
+)
+
+// Users can turn on two-factor authentication with time-based one-time
+// passwords (RFC 6238), the codes authenticator apps show. It takes two steps:
+// totp_enable makes a secret and hands it out as a provisioning URI, and
+// totp_confirm turns it on once it is given a code made from that secret,
+// handing out RECOVERY_CODES single-use codes which work in place of a code.
+// Only hashes of the recovery codes are stored, the secret itself has to be
+// kept to check codes against.
+//
+// With two-factor authentication on, the right password only gets the client
+// a pending login, which login_code turns into a session given a code within
+// PENDING_LOGIN_LIFETIME. Wrong codes count as failed logins (see
+// ratelimit.go), and a code is never accepted twice.
+
+const TOTP_PERIOD = 30 // seconds each code is valid for
+const TOTP_DIGITS = 6 // digits in a code
+const TOTP_SKEW = 1 // periods before and after the current one whose codes are accepted, for clocks that are off
+const TOTP_SECRET_SIZE = 20 // bytes in a secret, the size of an HMAC-SHA1 key
+const TOTP_ISSUER = "dropbox" // shown by authenticator apps next to the username
+const RECOVERY_CODES = 10 // recovery codes handed out when two-factor authentication is turned on
+const PENDING_LOGIN_LIFETIME = 5 * time.Minute // how long a login waits for its code
+
+// the clock codes and pending logins go by, tests replace it
+var timeNow = time.Now
+
+// secrets are written the way authenticator apps expect them
+var totp_encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+/*
+ * hotp() - makes the one-time password for a counter (RFC 4226)
+ *
+ * Parameters:
+ * 		- secret: the shared secret
+ * 		- counter: a uint64 representing the counter, the period for TOTP
+ * 		- digits: an int representing how many digits the code has, at most 9
+ * Returns: a string with the code, padded with leading zeros
+ */
+func hotp(secret []byte, counter uint64, digits int) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, counter)
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	// dynamic truncation: 31 bits from an offset given by the last nibble
+	offset := sum[len(sum) - 1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:offset + 4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, value % mod)
+}
+
+/*
+ * totpPeriod() - gets the TOTP period a time falls in
+ *
+ * Parameters: t: the time
+ * Returns: an int64 with the number of periods since the Unix epoch
+ */
+func totpPeriod(t time.Time) int64 {
+	return t.Unix() / TOTP_PERIOD
+}
+
+/*
+ * checkTOTP() - checks a code against a secret, around the current time
+ *
+ * Parameters:
+ * 		- secret: the shared secret
+ * 		- code: a string representing the code the user gave
+ * 		- last: an int64 representing the period of the last code accepted, codes
+ * 				from it and earlier periods are refused so none is used twice
+ * Returns: an int64 with the period the code is from, and a boolean, true if
+ * 				the code is right
+ */
+func checkTOTP(secret []byte, code string, last int64) (int64, bool) {
+	now := totpPeriod(timeNow())
+	for period := now - TOTP_SKEW; period <= now + TOTP_SKEW; period++ {
+		if period <= last {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(hotp(secret, uint64(period), TOTP_DIGITS)), []byte(code)) == 1 {
+			return period, true
+		}
+	}
+	return 0, false
+}
+
+/*
+ * provisioningURI() - gets the otpauth:// URI authenticator apps are set up
+ * 						with, usually by scanning it as a QR code
+ *
+ * Parameters:
+ * 		- secret: a string representing the base32 encoded secret
+ * 		- username: a string representing the user's username
+ * Returns: a string with the URI
+ */
+func provisioningURI(secret string, username string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", TOTP_ISSUER)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", strconv.Itoa(TOTP_DIGITS))
+	v.Set("period", strconv.Itoa(TOTP_PERIOD))
+	return "otpauth://totp/" + url.PathEscape(TOTP_ISSUER + ":" + username) + "?" + v.Encode()
+}
+
+/*
+ * twoFactorEnabled() - checks whether a user logs in with a code as well
+ *
+ * Parameters: username: a string representing the user's username
+ * Returns: a boolean, true if two-factor authentication is on
+ */
+func twoFactorEnabled(username string) bool {
+	var enabled bool
+	err := db.QueryRow("SELECT enabled FROM two_factor WHERE username = ?", username).Scan(&enabled)
+	return err == nil && enabled
+}
+
+/*
+ * checkSecondFactor() - checks a code or recovery code of a user with
+ * 						two-factor authentication on, using it up if it is right
+ *
+ * Parameters:
+ * 		- username: a string representing the user's username
+ * 		- code: a string representing the code or recovery code the user gave
+ * Returns: a boolean, true if the code is right and was not used before
+ */
+func checkSecondFactor(username string, code string) bool {
+	var encoded string
+	var last int64
+	err := db.QueryRow("SELECT secret, last_period FROM two_factor WHERE username = ? AND enabled = 1", username).Scan(&encoded, &last)
+	if err != nil {
+		return false
+	}
+	secret, err := totp_encoding.DecodeString(encoded)
+	if err != nil {
+		return false
+	}
+	if period, ok := checkTOTP(secret, code, last); ok {
+		// only the first request with this code gets to move last_period on
+		res, err := db.Exec("UPDATE two_factor SET last_period = ? WHERE username = ? AND last_period < ?", period, username, period)
+		if err != nil {
+			return false
+		}
+		n, _ := res.RowsAffected()
+		return n == 1
+	}
+
+	// recovery codes are stored hashed like cookies, and deleted once used
+	res, err := db.Exec("DELETE FROM recovery_codes WHERE username = ? AND code_hash = ?", username, hashCookie(code))
+	if err != nil {
+		return false
+	}
+	n, _ := res.RowsAffected()
+	return n == 1
+}
+
+/*
+ * beginPendingLogin() - records a login which got the password right and waits
+ * 						for a two-factor code
+ *
+ * Parameters:
+ * 		- username: a string representing the user's username
+ * 		- device: a string representing a label for the device logging in
+ * Returns: a string with the pending token for the client, and an error if it
+ * 				could not be recorded
+ */
+func beginPendingLogin(username string, device string) (string, error) {
+	now := timeNow().UTC().UnixNano()
+	db.Exec("DELETE FROM pending_logins WHERE expires <= ?", now)
+
+	pending, err := newToken(TOKEN_PENDING)
+	if err != nil {
+		return "", err
+	}
+	_, err = db.Exec("INSERT INTO pending_logins (token_hash, username, device, expires) VALUES (?, ?, ?, ?)", hashCookie(pending), username, device, now + int64(PENDING_LOGIN_LIFETIME))
+	if err != nil {
+		return "", err
+	}
+	return pending, nil
+}
+
+/*
+ * loginCodeHandler() - finishes a login of a user with two-factor
+ * 						authentication on, creating their session once a right
+ * 						code or recovery code is given
+ *
+ * Parameters:
+ * 		- addr: a string representing the client's address, filled in by the rpc layer
+ * 		- pending: a string representing the token loginHandler returned
+ * 		- code: a string representing the code or recovery code
+ * Returns: an internal.LoginReturn with error or the cookie to be stored in the
+ * 				client on success
+ */
+func loginCodeHandler(addr string, pending string, code string) internal.LoginReturn {
+	token_hash := hashCookie(pending)
+	var username string
+	var device string
+	var expires int64
+	err := db.QueryRow("SELECT username, device, expires FROM pending_logins WHERE token_hash = ?", token_hash).Scan(&username, &device, &expires)
+	if err != nil {
+		return internal.LoginReturn{Err: internal.NewError(internal.Unauthenticated, "no login is waiting for a code, log in again")}
+	}
+	if expires <= timeNow().UTC().UnixNano() {
+		db.Exec("DELETE FROM pending_logins WHERE token_hash = ?", token_hash)
+		return internal.LoginReturn{Err: internal.NewError(internal.SessionExpired, "the code was not given in time, log in again")}
+	}
+
+	// guessing codes is throttled like guessing passwords
+	unlock := lockLogin(addr, username)
+	defer unlock()
+	err_limit := checkLoginAllowed(addr, username)
+	if err_limit.Code != internal.OK {
+		return internal.LoginReturn{Err: err_limit}
+	}
+	if !checkSecondFactor(username, code) {
+		recordLoginFailure(addr, username)
+		return internal.LoginReturn{Err: internal.NewError(internal.InvalidCredentials, "wrong or already used code")}
+	}
+
+	// a pending login finishes at most once, even if it was sent twice at once
+	res, err := db.Exec("DELETE FROM pending_logins WHERE token_hash = ?", token_hash)
+	if err != nil {
+		return internal.LoginReturn{Err: internal.NewError(internal.Internal, "could not finish logging in")}
+	}
+	if n, err := res.RowsAffected(); err != nil || n != 1 {
+		return internal.LoginReturn{Err: internal.NewError(internal.Unauthenticated, "no login is waiting for a code, log in again")}
+	}
+	clearLoginFailures(addr, username)
+	cookie, err1 := startSession(username, device)
+	if err1.Code != internal.OK {
+		return internal.LoginReturn{Err: err1}
+	}
+	return internal.LoginReturn{Cookie: cookie}
+}
+
+/*
+ * totpEnableHandler() - makes a new two-factor secret for the user, which
+ * 						takes effect once totp_confirm is given a code made from it
+ *
+ * Parameters: cookie: a string representing the user's cookie
+ * Returns: an internal.TwoFactorReturn with error or the secret and its
+ * 				provisioning URI on success
+ */
+func totpEnableHandler(cookie string) internal.TwoFactorReturn {
+	// check that request comes from valid user
+	err0, username := authenticateRequest(cookie)
+	if err0.Code != internal.OK {
+		return internal.TwoFactorReturn{Err: err0}
+	}
+	if twoFactorEnabled(username) {
+		return internal.TwoFactorReturn{Err: internal.NewError(internal.AlreadyExists, "two-factor authentication is already on, turn it off first to get a new secret")}
+	}
+
+	b := make([]byte, TOTP_SECRET_SIZE)
+	_, err := rand.Read(b)
+	if err != nil {
+		return internal.TwoFactorReturn{Err: internal.NewError(internal.Internal, "could not make a secret")}
+	}
+	secret := totp_encoding.EncodeToString(b)
+
+	// replaces a secret that was never confirmed
+	_, err = db.Exec("INSERT OR REPLACE INTO two_factor (username, secret, enabled, last_period) VALUES (?, ?, 0, 0)", username, secret)
+	if err != nil {
+		return internal.TwoFactorReturn{Err: internal.NewError(internal.Internal, "could not make a secret")}
+	}
+	return internal.TwoFactorReturn{Secret: secret, URI: provisioningURI(secret, username)}
+}
+
+/*
+ * totpConfirmHandler() - turns on two-factor authentication once the user shows
+ * 						they can make codes from the secret totp_enable gave them
+ *
+ * Parameters:
+ * 		- cookie: a string representing the user's cookie
+ * 		- code: a string representing a code made from the new secret
+ * Returns: an internal.RecoveryCodesReturn with error or the recovery codes on
+ * 				success, which are not shown again
+ */
+func totpConfirmHandler(cookie string, code string) internal.RecoveryCodesReturn {
+	// check that request comes from valid user
+	err0, username := authenticateRequest(cookie)
+	if err0.Code != internal.OK {
+		return internal.RecoveryCodesReturn{Err: err0}
+	}
+
+	var encoded string
+	var enabled bool
+	err := db.QueryRow("SELECT secret, enabled FROM two_factor WHERE username = ?", username).Scan(&encoded, &enabled)
+	if err != nil {
+		return internal.RecoveryCodesReturn{Err: internal.NewError(internal.NotFound, "no secret to confirm, get one with 2fa enable first")}
+	}
+	if enabled {
+		return internal.RecoveryCodesReturn{Err: internal.NewError(internal.AlreadyExists, "two-factor authentication is already on")}
+	}
+	secret, err := totp_encoding.DecodeString(encoded)
+	if err != nil {
+		return internal.RecoveryCodesReturn{Err: internal.NewError(internal.Internal, "could not turn on two-factor authentication")}
+	}
+	period, ok := checkTOTP(secret, code, 0)
+	if !ok {
+		return internal.RecoveryCodesReturn{Err: internal.NewError(internal.InvalidCredentials, "wrong code, check that the clock of the device making codes is right")}
+	}
+
+	var codes []string
+	for i := 0; i < RECOVERY_CODES; i++ {
+		recovery, err := newToken(TOKEN_RECOVERY)
+		if err != nil {
+			return internal.RecoveryCodesReturn{Err: internal.NewError(internal.Internal, "could not turn on two-factor authentication")}
+		}
+		codes = append(codes, recovery)
+	}
+
+	// turn it on together with the recovery codes, so nobody is left with one
+	// and not the other
+	tx, err := db.Begin()
+	if err != nil {
+		return internal.RecoveryCodesReturn{Err: internal.NewError(internal.Internal, "could not turn on two-factor authentication")}
+	}
+	exec := func(query string, args ...interface{}) {
+		if err == nil {
+			_, err = tx.Exec(query, args...)
+		}
+	}
+	exec("UPDATE two_factor SET enabled = 1, last_period = ? WHERE username = ?", period, username)
+	exec("DELETE FROM recovery_codes WHERE username = ?", username)
+	for _, recovery := range codes {
+		exec("INSERT INTO recovery_codes (username, code_hash) VALUES (?, ?)", username, hashCookie(recovery))
+	}
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+	if err != nil {
+		return internal.RecoveryCodesReturn{Err: internal.NewError(internal.Internal, "could not turn on two-factor authentication")}
+	}
+	return internal.RecoveryCodesReturn{Codes: codes}
+}
+
+/*
+ * totpDisableHandler() - turns off two-factor authentication, given a code or
+ * 						recovery code so a stolen cookie alone cannot do it
+ *
+ * Parameters:
+ * 		- addr: a string representing the client's address, filled in by the rpc layer
+ * 		- cookie: a string representing the user's cookie
+ * 		- code: a string representing a code or recovery code
+ * Returns: an internal.Error, with code OK upon success
+ */
+func totpDisableHandler(addr string, cookie string, code string) internal.Error {
+	// check that request comes from valid user
+	err0, username := authenticateRequest(cookie)
+	if err0.Code != internal.OK {
+		return err0
+	}
+	if !twoFactorEnabled(username) {
+		return internal.NewError(internal.NotFound, "two-factor authentication is not on")
+	}
+
+	// guessing codes is throttled like guessing passwords
+	unlock := lockLogin(addr, username)
+	defer unlock()
+	err_limit := checkLoginAllowed(addr, username)
+	if err_limit.Code != internal.OK {
+		return err_limit
+	}
+	if !checkSecondFactor(username, code) {
+		recordLoginFailure(addr, username)
+		return internal.NewError(internal.InvalidCredentials, "wrong or already used code")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return internal.NewError(internal.Internal, "could not turn off two-factor authentication")
+	}
+	exec := func(query string, args ...interface{}) {
+		if err == nil {
+			_, err = tx.Exec(query, args...)
+		}
+	}
+	exec("DELETE FROM two_factor WHERE username = ?", username)
+	exec("DELETE FROM recovery_codes WHERE username = ?", username)
+	exec("DELETE FROM pending_logins WHERE username = ?", username)
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+	if err != nil {
+		return internal.NewError(internal.Internal, "could not turn off two-factor authentication")
+	}
+	return internal.Error{}
+}
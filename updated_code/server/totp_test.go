@@ -0,0 +1,172 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"../internal"
+)
+
+// the SHA1 test vectors from RFC 6238, appendix B
+var rfc6238_secret = []byte("12345678901234567890")
+var rfc6238_vectors = []struct {
+	unix int64
+	code string
+}{
+	{59, "94287082"},
+	{1111111109, "07081804"},
+	{1111111111, "14050471"},
+	{1234567890, "89005924"},
+	{2000000000, "69279037"},
+	{20000000000, "65353130"},
+}
+
+func TestHOTP(t *testing.T) {
+	// RFC 4226, appendix D
+	want := []string{"755224", "287082", "359152", "969429", "338314", "254676", "287922", "162583", "399871", "520489"}
+	for i, code := range want {
+		if got := hotp(rfc6238_secret, uint64(i), 6); got != code {
+			t.Errorf("hotp(counter %v) = %v, want %v", i, got, code)
+		}
+	}
+}
+
+func TestTOTPVectors(t *testing.T) {
+	for _, v := range rfc6238_vectors {
+		period := totpPeriod(time.Unix(v.unix, 0))
+		if got := hotp(rfc6238_secret, uint64(period), 8); got != v.code {
+			t.Errorf("code at %v = %v, want %v", v.unix, got, v.code)
+		}
+	}
+}
+
+// setClock makes timeNow return the given Unix time until the test ends
+func setClock(t *testing.T, unix int64) {
+	old := timeNow
+	timeNow = func() time.Time { return time.Unix(unix, 0) }
+	t.Cleanup(func() { timeNow = old })
+}
+
+func TestCheckTOTP(t *testing.T) {
+	now := int64(1111111111)
+	code := hotp(rfc6238_secret, uint64(now / TOTP_PERIOD), TOTP_DIGITS)
+
+	setClock(t, now)
+	period, ok := checkTOTP(rfc6238_secret, code, 0)
+	if !ok || period != now / TOTP_PERIOD {
+		t.Fatalf("checkTOTP() of the current code = %v, %v", period, ok)
+	}
+
+	// used codes, or any older ones, are refused
+	if _, ok := checkTOTP(rfc6238_secret, code, period); ok {
+		t.Errorf("checkTOTP() accepted a code again")
+	}
+
+	// a clock off by one period is fine either way, by more is not
+	for _, skew := range []int64{-TOTP_PERIOD, TOTP_PERIOD} {
+		setClock(t, now + skew)
+		if _, ok := checkTOTP(rfc6238_secret, code, 0); !ok {
+			t.Errorf("checkTOTP() refused the code with the clock off by %vs", skew)
+		}
+	}
+	for _, skew := range []int64{-2 * TOTP_PERIOD, 2 * TOTP_PERIOD} {
+		setClock(t, now + skew)
+		if _, ok := checkTOTP(rfc6238_secret, code, 0); ok {
+			t.Errorf("checkTOTP() accepted the code with the clock off by %vs", skew)
+		}
+	}
+
+	setClock(t, now)
+	wrong := hotp(rfc6238_secret, uint64(now / TOTP_PERIOD + 5), TOTP_DIGITS)
+	if _, ok := checkTOTP(rfc6238_secret, wrong, 0); ok {
+		t.Errorf("checkTOTP() accepted the code of another period")
+	}
+}
+
+// beginLogin logs alice in with the right password, returning the pending
+// token to finish with a code
+func beginLogin(t *testing.T, addr string) string {
+	ret := loginHandler(addr, "alice", TEST_PASSWORD, "phone")
+	wantCode(t, "login with two-factor on", ret.Err, internal.TwoFactorRequired)
+	if ret.Pending == "" || ret.Cookie != "" {
+		t.Fatalf("login with two-factor on = %+v, want only a pending token", ret)
+	}
+	return ret.Pending
+}
+
+// finishLogin gives a code to a pending login, checking that a session is
+// made exactly when the code is accepted
+func finishLogin(t *testing.T, what string, addr string, pending string, code string, want internal.ErrorCode) {
+	ret := loginCodeHandler(addr, pending, code)
+	wantCode(t, what, ret.Err, want)
+	if want == internal.OK {
+		mustOK(t, what + ", the new session", authenticateHandler(ret.Cookie).Err)
+	} else if ret.Cookie != "" {
+		t.Errorf("%v made a session", what)
+	}
+	if ret.Err.Code == internal.InvalidCredentials {
+		waitOutBackoff(t, "user:alice")
+		waitOutBackoff(t, "addr:" + addr)
+	}
+}
+
+func TestLoginCode(t *testing.T) {
+	now := int64(1111111111)
+	setClock(t, now)
+	setUp(t)
+	alice := signUp(t, "alice")
+
+	enable := totpEnableHandler(alice)
+	mustOK(t, "totpEnableHandler()", enable.Err)
+	secret, err := totp_encoding.DecodeString(enable.Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := hotp(secret, uint64(now / TOTP_PERIOD), TOTP_DIGITS)
+	confirm := totpConfirmHandler(alice, code)
+	mustOK(t, "totpConfirmHandler()", confirm.Err)
+	if len(confirm.Codes) < 4 {
+		t.Fatalf("%v recovery codes, want at least 4", len(confirm.Codes))
+	}
+
+	// the code used to confirm cannot log in, nor can one made later be
+	// used twice
+	pending := beginLogin(t, "a1")
+	finishLogin(t, "code used to confirm", "a1", pending, code, internal.InvalidCredentials)
+	setClock(t, now + TOTP_PERIOD)
+	code = hotp(secret, uint64(now / TOTP_PERIOD + 1), TOTP_DIGITS)
+	finishLogin(t, "next code", "a1", pending, code, internal.OK)
+	finishLogin(t, "pending login again", "a1", pending, code, internal.Unauthenticated)
+	pending = beginLogin(t, "a1")
+	finishLogin(t, "next code again", "a1", pending, code, internal.InvalidCredentials)
+
+	// each recovery code logs in once
+	finishLogin(t, "recovery code", "a1", pending, confirm.Codes[0], internal.OK)
+	pending = beginLogin(t, "a1")
+	finishLogin(t, "recovery code again", "a1", pending, confirm.Codes[0], internal.InvalidCredentials)
+	finishLogin(t, "other recovery code", "a1", pending, confirm.Codes[1], internal.OK)
+
+	// a pending login sent twice at once with different good codes makes
+	// one session
+	pending = beginLogin(t, "a1")
+	var wg sync.WaitGroup
+	rets := make([]internal.LoginReturn, 2)
+	for i := range rets {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rets[i] = loginCodeHandler("a1", pending, confirm.Codes[2 + i])
+		}(i)
+	}
+	wg.Wait()
+	if (rets[0].Err.Code == internal.OK) == (rets[1].Err.Code == internal.OK) {
+		t.Errorf("pending login sent twice = %v and %v, want one OK", rets[0].Err.Code, rets[1].Err.Code)
+	}
+
+	// and one not finished in time has to start over
+	pending = beginLogin(t, "a1")
+	setClock(t, now + TOTP_PERIOD + int64(PENDING_LOGIN_LIFETIME / time.Second))
+	finishLogin(t, "code too late", "a1", pending, confirm.Codes[3], internal.SessionExpired)
+	finishLogin(t, "code after expiring", "a1", pending, confirm.Codes[3], internal.Unauthenticated)
+}
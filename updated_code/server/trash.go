@@ -0,0 +1,359 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"../internal"
+)
+
+// Removed files and directories are moved into a per-root trash directory
+// outside of the root, so they can no longer be listed or reached through
+// validatePath(), but still count against the quota until they are restored,
+// emptied out or purged config.TrashRetention after being removed. The old
+// versions of the removed files are kept along with them: their paths in the
+// versions table are the trash id followed by the path inside the entry
+// (paths in a root always start with "/"), until the entry is restored or
+// deleted.
+
+const TRASH_DIR = "trash/" // removed files, under abs_base_dir, one directory per root
+const TRASH_PURGE_INTERVAL = time.Hour // how often the trash is checked for files to purge
+
+/*
+ * trashDir() - gets the directory the removed files of a root are kept in
+ *
+ * Parameters: root: a string representing the name of the root directory
+ * Returns: a string with the full path to the directory, ending in "/"
+ */
+func trashDir(root string) string {
+	return abs_base_dir + TRASH_DIR + root + "/"
+}
+
+/*
+ * treeSize() - sums up the sizes of the files in a directory tree
+ *
+ * Parameters: p: a string representing the full path to a file or directory
+ * Returns: an int64 with the size in bytes
+ */
+func treeSize(p string) int64 {
+	var size int64
+	filepath.Walk(p, func(_ string, fi os.FileInfo, err error) error {
+		if err == nil && fi.Mode().IsRegular() {
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+/*
+ * deleteTrashWhere() - permanently deletes every trash entry matching a
+ * 						condition on the trash table, locking each root in turn
+ * 						(so the caller must not hold any)
+ *
+ * Parameters:
+ * 		- condition: a string with the WHERE clause
+ * 		- args: the arguments for the WHERE clause
+ * Returns: an error if some entry could not be deleted
+ */
+func deleteTrashWhere(condition string, args ...interface{}) error {
+	statement, _ := db.Prepare("SELECT trash_id, root FROM trash WHERE " + condition)
+	rows, err := statement.Query(args...)
+	if err != nil {
+		return err
+	}
+	var roots []string
+	ids := make(map[string][]string) // root -> trash ids
+	for rows.Next() {
+		var id string
+		var root string
+		rows.Scan(&id, &root)
+		if _, ok := ids[root]; !ok {
+			roots = append(roots, root)
+		}
+		ids[root] = append(ids[root], id)
+	}
+	rows.Close()
+
+	for _, root := range roots {
+		err = deleteTrashEntries(root, ids[root])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+ * deleteTrashEntries() - permanently deletes trash entries of one root, under
+ * 						the root's lock
+ *
+ * Parameters:
+ * 		- root: a string representing the name of the root directory
+ * 		- ids: the ids of the entries, ones restored or deleted in the meantime
+ * 				are skipped
+ * Returns: an error if some entry could not be deleted
+ */
+func deleteTrashEntries(root string, ids []string) error {
+	unlock := lockRoot(root)
+	defer unlock()
+
+	for _, id := range ids {
+		var found string
+		err := db.QueryRow("SELECT trash_id FROM trash WHERE trash_id = ? AND root = ?", id, root).Scan(&found)
+		if err == sql.ErrNoRows {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		usage, _ := walkTree(trashDir(root) + id)
+		err = os.RemoveAll(trashDir(root) + id)
+		if err != nil {
+			return err
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		tx.Exec("DELETE FROM trash WHERE trash_id = ?", id)
+		addUsage(tx, root, -int64(usage))
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+		deleteVersionsWhere("root = ? AND (path = ? OR substr(path, 1, ?) = ?)", root, id, len(id) + 1, id + "/")
+	}
+	return nil
+}
+
+/*
+ * purgeTrash() - deletes everything that has been in the trash for longer
+ * 				than config.TrashRetention, then again every TRASH_PURGE_INTERVAL
+ *
+ * Parameters: none
+ * Returns: never
+ */
+func purgeTrash() {
+	for {
+		deleteTrashWhere("removed < ?", time.Now().UTC().Add(-time.Duration(config.TrashRetention)).UnixNano())
+		time.Sleep(TRASH_PURGE_INTERVAL)
+	}
+}
+
+/*
+ * moveToTrash() - moves a file or directory out of its root into the root's
+ * 					trash, and sessions in it back to the root, the root has
+ * 					to be locked by the caller
+ *
+ * Parameters: full_path: a string representing the full path to the file or directory
+ * Returns: an internal.Error, with code OK upon success
+ */
+func moveToTrash(full_path string) internal.Error {
+	fi, err := os.Stat(full_path)
+	if err != nil {
+		return internal.NewError(internal.NotFound, "could not remove at specified path")
+	}
+	root := rootForPath(full_path)
+	rel := strings.TrimPrefix(full_path, abs_base_dir + root)
+
+	id, err := newToken(TOKEN_TRASH)
+	if err != nil {
+		return internal.NewError(internal.Internal, "could not move to trash")
+	}
+	err = os.MkdirAll(trashDir(root), 0775)
+	if err != nil {
+		return internal.NewError(internal.Internal, "could not move to trash")
+	}
+
+	err = os.Rename(full_path, trashDir(root) + id)
+	if err != nil {
+		return internal.NewError(internal.Internal, "could not move to trash")
+	}
+	tx, err := db.Begin()
+	if err == nil {
+		_, err = tx.Exec("INSERT INTO trash (trash_id, root, path, is_dir, size, removed) VALUES (?, ?, ?, ?, ?, ?)",
+			id, root, rel, fi.IsDir(), treeSize(trashDir(root) + id), time.Now().UTC().UnixNano())
+		if err == nil {
+			err = moveVersions(tx, root, rel, id)
+		}
+		if err == nil {
+			err = tx.Commit()
+		} else {
+			tx.Rollback()
+		}
+	}
+	if err != nil {
+		os.Rename(trashDir(root) + id, full_path)
+		return internal.NewError(internal.Internal, "could not move to trash")
+	}
+
+	// sessions which were in it go back to the root
+	n := utf8.RuneCountInString(rel)
+	statement, _ := db.Prepare("UPDATE session_pwd SET pwd = '/' WHERE session_id IN (SELECT session_id FROM sessions WHERE username IN (SELECT username FROM metadata WHERE root = ?)) AND (pwd = ? OR substr(pwd, 1, ?) = ?)")
+	statement.Exec(root, rel, n + 1, rel + "/")
+	return internal.Error{}
+}
+
+/*
+ * trashListHandler() - lists the files and directories in the user's trash,
+ * 					most recently removed first
+ *
+ * Parameters: cookie: a string representing the user's cookie
+ * Returns: an internal.TrashReturn with error or the entries on success
+ */
+func trashListHandler(cookie string) internal.TrashReturn {
+	// authenticate and get root
+	err0, username := authenticateRequest(cookie)
+	if err0.Code != internal.OK {
+		return internal.TrashReturn{Err: err0}
+	}
+	err1, root := rootForUsername(username)
+	if err1.Code != internal.OK {
+		return internal.TrashReturn{Err: err1}
+	}
+
+	statement, _ := db.Prepare("SELECT trash_id, path, is_dir, size, removed FROM trash WHERE root = ? ORDER BY removed DESC")
+	rows, err := statement.Query(root)
+	if err != nil {
+		return internal.TrashReturn{Err: internal.NewError(internal.Internal, "could not list trash")}
+	}
+	var entries []internal.TrashEnt
+	for rows.Next() {
+		var entry internal.TrashEnt
+		rows.Scan(&entry.ID_, &entry.Path_, &entry.IsDir_, &entry.Size_, &entry.Removed_)
+		entries = append(entries, entry)
+	}
+	rows.Close()
+
+	return internal.TrashReturn{Entries: entries}
+}
+
+/*
+ * trashRestoreHandler() - moves a file or directory out of the user's trash
+ * 						back into their root
+ *
+ * Parameters:
+ * 		- cookie: a string representing the user's cookie
+ * 		- id: a string representing the id of the entry as listed by trash_list
+ * 		- path: a string representing the user-inputted path to restore to, or
+ * 				the empty string to restore to where it was removed from
+ *
+ * Returns: an internal.Error, with code OK upon success
+ */
+func trashRestoreHandler(cookie string, id string, path string) internal.Error {
+	// authenticate and get root
+	err0, username := authenticateRequest(cookie)
+	if err0.Code != internal.OK {
+		return err0
+	}
+	err1, root := rootForUsername(username)
+	if err1.Code != internal.OK {
+		return err1
+	}
+
+	unlock := lockRoot(root)
+	defer unlock()
+
+	statement, _ := db.Prepare("SELECT path, is_dir FROM trash WHERE trash_id = ? AND root = ?")
+	rows, err := statement.Query(id, root)
+	if err != nil {
+		return internal.NewError(internal.Internal, "could not restore from trash")
+	}
+	var rel string
+	var is_dir bool
+	found := rows.Next()
+	if found {
+		rows.Scan(&rel, &is_dir)
+	}
+	rows.Close()
+	if !found {
+		return internal.NewError(internal.NotFound, "no such entry in trash")
+	}
+
+	// restore to the original location unless told otherwise, the space is
+	// already charged to the root so only the name and place are checked
+	full_path := abs_base_dir + root + rel
+	if path != "" {
+		err2, p := performChecks(cookie, path, ACCESS_OWNER)
+		if err2.Code != internal.OK {
+			return err2
+		}
+		full_path = p
+		if full_path == abs_base_dir + root {
+			return internal.NewError(internal.AlreadyExists, "something already exists at specified path")
+		}
+		err3 := checkSizeName(0, full_path)
+		if err3.Code != internal.OK {
+			return err3
+		}
+	}
+	if is_dir {
+		_, deepest := walkTree(trashDir(root) + id)
+		if !checkNestedPath(full_path + deepest, root) {
+			return internal.NewError(internal.InvalidPath, fmt.Sprintf("Too many nested files in path, must be at most %v deep", config.MaxNesting))
+		}
+		if filepath.Dir(full_path) != filepath.Dir(abs_base_dir + root + rel) {
+			err4 := checkSubdirCount(filepath.Dir(full_path))
+			if err4.Code != internal.OK {
+				return err4
+			}
+		}
+	}
+	if _, err := os.Lstat(full_path); err == nil {
+		return internal.NewError(internal.AlreadyExists, "something already exists at specified path")
+	}
+
+	err = os.Rename(trashDir(root) + id, full_path)
+	if err != nil {
+		return internal.NewError(internal.NotFound, "could not restore to specified path, its directory may not exist")
+	}
+
+	// the old versions come back with the files
+	tx, err := db.Begin()
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM trash WHERE trash_id = ?", id)
+		if err == nil {
+			err = moveVersions(tx, root, id, strings.TrimPrefix(full_path, abs_base_dir + root))
+		}
+		if err == nil {
+			err = tx.Commit()
+		} else {
+			tx.Rollback()
+		}
+	}
+	if err != nil {
+		os.Rename(full_path, trashDir(root) + id)
+		return internal.NewError(internal.Internal, "could not restore from trash")
+	}
+	return internal.Error{}
+}
+
+/*
+ * trashEmptyHandler() - permanently deletes everything in the user's trash
+ *
+ * Parameters: cookie: a string representing the user's cookie
+ * Returns: an internal.Error, with code OK upon success
+ */
+func trashEmptyHandler(cookie string) internal.Error {
+	// authenticate and get root
+	err0, username := authenticateRequest(cookie)
+	if err0.Code != internal.OK {
+		return err0
+	}
+	err1, root := rootForUsername(username)
+	if err1.Code != internal.OK {
+		return err1
+	}
+
+	err := deleteTrashWhere("root = ?", root)
+	if err != nil {
+		return internal.NewError(internal.Internal, "could not empty trash")
+	}
+	return internal.Error{}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"../internal"
+)
+
+func TestTrashRestoreLimits(t *testing.T) {
+	setUp(t)
+	config.MaxNesting = 4
+	alice := signUp(t, "alice")
+
+	for _, dir := range []string{"a", "a/b", "a/b/c", "x", "x/y", "full"} {
+		mustOK(t, "mkdir " + dir, mkdirHandler(alice, dir))
+	}
+	for i := 0; i < 20; i++ {
+		mustOK(t, "mkdir in full", mkdirHandler(alice, fmt.Sprintf("full/%v", i)))
+	}
+	ret := removeAllHandler(alice, "a", false)
+	mustOK(t, "removeAllHandler()", ret.Err)
+	list := trashListHandler(alice)
+	mustOK(t, "trashListHandler()", list.Err)
+	if len(list.Entries) != 1 {
+		t.Fatalf("%v entries in the trash, want 1", len(list.Entries))
+	}
+	id := list.Entries[0].ID_
+
+	// a directory is held to the same limits as one moved there
+	wantCode(t, "restore too deep", trashRestoreHandler(alice, id, "x/y/a"), internal.InvalidPath)
+	wantCode(t, "restore into a full directory", trashRestoreHandler(alice, id, "full/a"), internal.QuotaExceeded)
+	for _, p := range []string{"x/y/a", "full/a"} {
+		if _, err := os.Lstat(rootOf(t, "alice") + p); err == nil {
+			t.Errorf("%v exists after a refused restore", p)
+		}
+	}
+
+	// and is still in the trash to be restored elsewhere
+	mustOK(t, "restore to x/a", trashRestoreHandler(alice, id, "x/a"))
+	if _, err := os.Stat(rootOf(t, "alice") + "x/a/b/c"); err != nil {
+		t.Errorf("x/a/b/c is missing after restoring: %v", err)
+	}
+	list = trashListHandler(alice)
+	mustOK(t, "trashListHandler() after restoring", list.Err)
+	if len(list.Entries) != 0 {
+		t.Errorf("%v entries in the trash after restoring, want 0", len(list.Entries))
+	}
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"../internal"
+)
+
+// Large files are uploaded in several calls instead of one: upload_begin
+// reserves the file's size against the quota and returns an upload id,
+// upload_chunk appends to a staging file outside of the user's root, and
+// upload_commit checks the expected hash and renames the staging file into
+// place, so the file only ever appears complete. An upload which is begun
+// again with the same destination, size and hash resumes where it stopped.
+
+const UPLOAD_DIR = "uploads/" // staging directory for uploads, under abs_base_dir
+const MAX_UPLOAD_CHUNK = 1000000 // in bytes, largest chunk accepted in one call
+const UPLOAD_EXPIRY = 86400000000000 // in nanoseconds, unfinished uploads are dropped after a day without chunks
+const UPLOAD_PURGE_INTERVAL = time.Hour // how often unfinished uploads are checked for expiry
+
+// an upload session as stored in the uploads table
+type upload struct {
+	id       string
+	dest     string // absolute path as the user gave it, resolved again on commit
+	root     string // root the size is reserved against
+	size     int64
+	hash     string
+	received int64
+}
+
+/*
+ * stagingPath() - gets the path of the staging file for an upload
+ *
+ * Parameters: id: a string representing the upload id
+ * Returns: a string with the full path to the staging file
+ */
+func stagingPath(id string) string {
+	return abs_base_dir + UPLOAD_DIR + id
+}
+
+/*
+ * getUpload() - looks up an upload session of the given user
+ *
+ * Parameters:
+ * 		- username: a string representing the username
+ * 		- id: a string representing the upload id
+ *
+ * Returns: a tuple, with an internal.Error in the first part and the upload
+ * 				in the second if it exists and belongs to the user
+ */
+func getUpload(username string, id string) (internal.Error, upload) {
+	u := upload{id: id}
+	statement, _ := db.Prepare("SELECT dest, root, size, hash, received FROM uploads WHERE upload_id = ? AND username = ?")
+	rows, err := statement.Query(id, username)
+	if err != nil {
+		return internal.NewError(internal.Internal, "could not look up upload"), u
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return internal.NewError(internal.NotFound, "upload does not exist or has expired"), u
+	}
+	rows.Scan(&u.dest, &u.root, &u.size, &u.hash, &u.received)
+	return internal.Error{}, u
+}
+
+/*
+ * deleteUpload() - deletes an upload session and its staging file
+ *
+ * Parameters: id: a string representing the upload id
+ * Returns: nothing
+ */
+func deleteUpload(id string) {
+	statement, _ := db.Prepare("DELETE FROM uploads WHERE upload_id = ?")
+	statement.Exec(id)
+	os.Remove(stagingPath(id))
+}
+
+/*
+ * deleteUploadsWhere() - deletes every upload session matching a condition on
+ * 						the uploads table, along with their staging files,
+ * 						locking the root each one reserved space in (so the
+ * 						caller must not hold any)
+ *
+ * Parameters:
+ * 		- condition: a string with the WHERE clause
+ * 		- args: the arguments for the WHERE clause
+ * Returns: nothing
+ */
+func deleteUploadsWhere(condition string, args ...interface{}) {
+	statement, _ := db.Prepare("SELECT upload_id, root FROM uploads WHERE " + condition)
+	rows, err := statement.Query(args...)
+	if err != nil {
+		return
+	}
+	var roots []string
+	ids := make(map[string][]string) // root -> upload ids
+	for rows.Next() {
+		var id string
+		var root string
+		rows.Scan(&id, &root)
+		if _, ok := ids[root]; !ok {
+			roots = append(roots, root)
+		}
+		ids[root] = append(ids[root], id)
+	}
+	rows.Close()
+
+	// an upload may have been committed or sent a chunk before the lock was
+	// taken, so the condition is checked again as it is deleted
+	for _, root := range roots {
+		unlock := lockRoot(root)
+		for _, id := range ids[root] {
+			result, err := db.Exec("DELETE FROM uploads WHERE upload_id = ? AND (" + condition + ")", append([]interface{}{id}, args...)...)
+			if err != nil {
+				continue
+			}
+			if n, _ := result.RowsAffected(); n == 1 {
+				os.Remove(stagingPath(id))
+			}
+		}
+		unlock()
+	}
+}
+
+/*
+ * deleteExpiredUploads() - deletes the upload sessions nobody has sent a chunk
+ * 						for in UPLOAD_EXPIRY, giving back the space they reserved
+ *
+ * Parameters: none
+ * Returns: nothing
+ */
+func deleteExpiredUploads() {
+	deleteUploadsWhere("updated < ?", time.Now().UTC().UnixNano() - UPLOAD_EXPIRY)
+}
+
+/*
+ * purgeUploads() - deletes expired uploads, then again every
+ * 				UPLOAD_PURGE_INTERVAL, so abandoned uploads do not hold on to
+ * 				their reservations until someone begins another one
+ *
+ * Parameters: none
+ * Returns: never
+ */
+func purgeUploads() {
+	for {
+		deleteExpiredUploads()
+		time.Sleep(UPLOAD_PURGE_INTERVAL)
+	}
+}
+
+/*
+ * reservedForRoot() - sums up the space reserved by unfinished uploads into a root
+ *
+ * Parameters: root: a string representing the name of the root directory
+ * Returns: an int with the number of reserved bytes
+ */
+func reservedForRoot(root string) int {
+	var reserved int
+	statement, _ := db.Prepare("SELECT COALESCE(SUM(size), 0) FROM uploads WHERE root = ?")
+	statement.QueryRow(root).Scan(&reserved)
+	return reserved
+}
+
+/*
+ * uploadBeginHandler() - starts an upload of a file of the given size, or
+ * 						resumes an unfinished upload of the same file
+ *
+ * Parameters:
+ * 		- cookie: a string representing the user's cookie
+ * 		- p: a string representing the user-inputted path to upload to
+ * 		- size: an int64 representing the size of the file in bytes
+ * 		- hash: a string representing the hex encoded sha256 of the file
+ *
+ * Returns: an internal.UploadReturn with error, or the upload id and the
+ * 				offset to continue from on success
+ */
+func uploadBeginHandler(cookie string, p string, size int64, hash string) internal.UploadReturn {
+	// perform checks to validate user and action
+	err0, full_path := performChecks(cookie, p, ACCESS_WRITE)
+	if err0.Code != internal.OK {
+		return internal.UploadReturn{Err: err0}
+	}
+	_, username := authenticateRequest(cookie)
+
+	if size < 0 {
+		return internal.UploadReturn{Err: internal.NewError(internal.InvalidArgument, "size cannot be negative")}
+	}
+	hash = strings.ToLower(hash)
+	if len(hash) != 64 || strings.Trim(hash, "0123456789abcdef") != "" {
+		return internal.UploadReturn{Err: internal.NewError(internal.InvalidArgument, "hash must be a hex encoded sha256")}
+	}
+	if fi, err := os.Stat(full_path); err == nil && fi.IsDir() {
+		return internal.UploadReturn{Err: internal.NewError(internal.InvalidPath, "a directory exists at that path")}
+	}
+	if fi, err := os.Stat(path.Dir(full_path)); err != nil || !fi.IsDir() {
+		return internal.UploadReturn{Err: internal.NewError(internal.NotFound, "parent directory does not exist")}
+	}
+
+	// the pwd may change before the upload is committed, so remember the
+	// destination as an absolute path
+	dest := p
+	if !strings.HasPrefix(dest, "~") {
+		if !strings.HasPrefix(dest, "/") {
+			dest = path.Join(getSessionPWD(cookie), dest)
+		}
+		dest = path.Clean("/" + dest)
+	}
+
+	// drop uploads nobody has sent a chunk for in a long time
+	deleteExpiredUploads()
+
+	root := rootForPath(full_path)
+	unlock := lockRoot(root)
+	defer unlock()
+
+	// resume the upload of the same file, an upload of anything else to the
+	// same destination is replaced
+	statement, _ := db.Prepare("SELECT upload_id FROM uploads WHERE username = ? AND dest = ?")
+	rows, err := statement.Query(username, dest)
+	if err != nil {
+		return internal.UploadReturn{Err: internal.NewError(internal.Internal, "could not start upload")}
+	}
+	var old_id string
+	found := rows.Next()
+	if found {
+		rows.Scan(&old_id)
+	}
+	rows.Close()
+	if found {
+		err1, u := getUpload(username, old_id)
+		if err1.Code == internal.OK && u.size == size && u.hash == hash {
+			return internal.UploadReturn{ID: u.id, Offset: u.received}
+		}
+		deleteUpload(old_id)
+	}
+
+	// check name and reserve the size against the quota
+	err2 := checkSizeName(int(size), full_path)
+	if err2.Code != internal.OK {
+		return internal.UploadReturn{Err: err2}
+	}
+
+	id, err := newToken(TOKEN_UPLOAD)
+	if err != nil {
+		return internal.UploadReturn{Err: internal.NewError(internal.Internal, "could not start upload")}
+	}
+	f, err := os.Create(stagingPath(id))
+	if err != nil {
+		return internal.UploadReturn{Err: internal.NewError(internal.Internal, "could not start upload")}
+	}
+	f.Close()
+
+	statement, _ = db.Prepare("INSERT INTO uploads (upload_id, username, dest, root, size, hash, received, updated) VALUES (?, ?, ?, ?, ?, ?, 0, ?)")
+	_, err = statement.Exec(id, username, dest, root, size, hash, time.Now().UTC().UnixNano())
+	if err != nil {
+		os.Remove(stagingPath(id))
+		return internal.UploadReturn{Err: internal.NewError(internal.Internal, "could not start upload")}
+	}
+
+	return internal.UploadReturn{ID: id}
+}
+
+/*
+ * uploadChunkHandler() - writes the next chunk of an upload
+ *
+ * Parameters:
+ * 		- cookie: a string representing the user's cookie
+ * 		- id: a string representing the upload id
+ * 		- offset: an int64 representing where in the file the chunk goes, which
+ * 				has to be the number of bytes received so far
+ * 		- data: a byte array representing the chunk
+ *
+ * Returns: an internal.UploadReturn with error, or the offset of the next
+ * 				chunk on success (on error the offset is that of the next
+ * 				chunk expected, if the upload exists)
+ */
+func uploadChunkHandler(cookie string, id string, offset int64, data []byte) internal.UploadReturn {
+	// authenticate
+	err0, username := authenticateRequest(cookie)
+	if err0.Code != internal.OK {
+		return internal.UploadReturn{Err: err0}
+	}
+
+	if len(data) > MAX_UPLOAD_CHUNK {
+		return internal.UploadReturn{Err: internal.NewError(internal.InvalidArgument, "chunk is too large")}
+	}
+
+	// chunks of one user's uploads are written one at a time
+	err1, u := getUpload(username, id)
+	if err1.Code != internal.OK {
+		return internal.UploadReturn{Err: err1}
+	}
+	unlock := lockRoot(u.root)
+	defer unlock()
+	err1, u = getUpload(username, id)
+	if err1.Code != internal.OK {
+		return internal.UploadReturn{Err: err1}
+	}
+
+	ret := internal.UploadReturn{ID: id, Offset: u.received}
+	if offset != u.received {
+		ret.Err = internal.NewError(internal.InvalidArgument, "chunk does not start where the last one ended")
+		return ret
+	}
+	if offset + int64(len(data)) > u.size {
+		ret.Err = internal.NewError(internal.InvalidArgument, "chunk goes past the size of the upload")
+		return ret
+	}
+
+	f, err := os.OpenFile(stagingPath(id), os.O_WRONLY, 0664)
+	if err != nil {
+		ret.Err = internal.NewError(internal.Internal, "could not write chunk")
+		return ret
+	}
+	_, err = f.WriteAt(data, offset)
+	f.Close()
+	if err != nil {
+		ret.Err = internal.NewError(internal.Internal, "could not write chunk")
+		return ret
+	}
+
+	statement, _ := db.Prepare("UPDATE uploads SET received = ?, updated = ? WHERE upload_id = ?")
+	_, err = statement.Exec(offset + int64(len(data)), time.Now().UTC().UnixNano(), id)
+	if err != nil {
+		ret.Err = internal.NewError(internal.Internal, "could not write chunk")
+		return ret
+	}
+
+	ret.Offset = offset + int64(len(data))
+	return ret
+}
+
+/*
+ * uploadStatusHandler() - gets how much of an upload the server has received,
+ * 						so a client can resume after losing its connection
+ *
+ * Parameters:
+ * 		- cookie: a string representing the user's cookie
+ * 		- id: a string representing the upload id
+ *
+ * Returns: an internal.UploadReturn with error, or the offset of the next
+ * 				chunk on success
+ */
+func uploadStatusHandler(cookie string, id string) internal.UploadReturn {
+	// authenticate
+	err0, username := authenticateRequest(cookie)
+	if err0.Code != internal.OK {
+		return internal.UploadReturn{Err: err0}
+	}
+
+	err1, u := getUpload(username, id)
+	if err1.Code != internal.OK {
+		return internal.UploadReturn{Err: err1}
+	}
+	return internal.UploadReturn{ID: id, Offset: u.received}
+}
+
+/*
+ * uploadCommitHandler() - finishes an upload, moving the file into place if
+ * 						all of it was received and it has the expected hash
+ *
+ * Parameters:
+ * 		- cookie: a string representing the user's cookie
+ * 		- id: a string representing the upload id
+ * 		- hash: a string representing the hex encoded sha256 the file must have
+ *
+ * Returns: an internal.Error, with code OK upon success
+ */
+func uploadCommitHandler(cookie string, id string, hash string) internal.Error {
+	// authenticate
+	err0, username := authenticateRequest(cookie)
+	if err0.Code != internal.OK {
+		return err0
+	}
+
+	err1, u := getUpload(username, id)
+	if err1.Code != internal.OK {
+		return err1
+	}
+
+	// the destination is checked again, shares may have changed since begin
+	err2, full_path := performChecks(cookie, u.dest, ACCESS_WRITE)
+	if err2.Code != internal.OK {
+		return err2
+	}
+	root := rootForPath(full_path)
+	unlock := lockRoot(root)
+	defer unlock()
+
+	// look up again under the lock, a concurrent commit may have won
+	err1, u = getUpload(username, id)
+	if err1.Code != internal.OK {
+		return err1
+	}
+	if u.received != u.size {
+		return internal.NewError(internal.InvalidArgument, "upload is not complete")
+	}
+
+	// corrupted uploads cannot be resumed, so they are dropped
+	got, err := hashFile(stagingPath(id))
+	if err != nil {
+		return internal.NewError(internal.Internal, "could not read upload")
+	}
+	if got != strings.ToLower(hash) || got != u.hash {
+		deleteUpload(id)
+		return internal.NewError(internal.InvalidArgument, "uploaded file does not have the expected hash")
+	}
+
+	// the reservation only covers the root the upload was begun in
+	if root != u.root {
+		err3 := checkSizeName(int(u.size), full_path)
+		if err3.Code != internal.OK {
+			return err3
+		}
+	}
+	if fi, err := os.Stat(full_path); err == nil && fi.IsDir() {
+		return internal.NewError(internal.InvalidPath, "a directory exists at that path")
+	}
+
+	// staging directory and roots share a file system, so this is atomic
+	err4 := replaceFile(stagingPath(id), full_path)
+	if err4.Code != internal.OK {
+		return err4
+	}
+	statement, _ := db.Prepare("DELETE FROM uploads WHERE upload_id = ?")
+	statement.Exec(id)
+
+	return internal.Error{}
+}
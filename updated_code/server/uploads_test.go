@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"../internal"
+)
+
+func sha256Hex(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestUploadResumeAndCommit(t *testing.T) {
+	setUp(t)
+	alice := signUp(t, "alice")
+	data := strings.Repeat("0123456789", 30)
+	hash := sha256Hex(data)
+
+	ret := uploadBeginHandler(alice, "big.txt", int64(len(data)), hash)
+	mustOK(t, "uploadBeginHandler()", ret.Err)
+	id := ret.ID
+	ret = uploadChunkHandler(alice, id, 0, []byte(data[:100]))
+	mustOK(t, "first chunk", ret.Err)
+	if ret.Offset != 100 {
+		t.Errorf("offset after first chunk = %v, want 100", ret.Offset)
+	}
+
+	// a chunk that does not start where the last one ended is refused
+	ret = uploadChunkHandler(alice, id, 50, []byte(data[50:150]))
+	wantCode(t, "overlapping chunk", ret.Err, internal.InvalidArgument)
+	if ret.Offset != 100 {
+		t.Errorf("offset after overlapping chunk = %v, want 100", ret.Offset)
+	}
+	wantCode(t, "commit of half an upload", uploadCommitHandler(alice, id, hash), internal.InvalidArgument)
+
+	// beginning the same file again resumes it, where it left off
+	ret = uploadBeginHandler(alice, "/big.txt", int64(len(data)), strings.ToUpper(hash))
+	mustOK(t, "uploadBeginHandler() again", ret.Err)
+	if ret.ID != id || ret.Offset != 100 {
+		t.Errorf("resumed upload = %v at %v, want %v at 100", ret.ID, ret.Offset, id)
+	}
+	if status := uploadStatusHandler(alice, id); status.Offset != 100 {
+		t.Errorf("uploadStatusHandler() offset = %v, want 100", status.Offset)
+	}
+
+	// other users cannot see it
+	bob := signUp(t, "bob")
+	wantCode(t, "bob's status of alice's upload", uploadStatusHandler(bob, id).Err, internal.NotFound)
+	wantCode(t, "bob's chunk to alice's upload", uploadChunkHandler(bob, id, 100, []byte("x")).Err, internal.NotFound)
+
+	ret = uploadChunkHandler(alice, id, 100, []byte(data[100:]))
+	mustOK(t, "last chunk", ret.Err)
+	wantCode(t, "chunk past the end", uploadChunkHandler(alice, id, int64(len(data)), []byte("x")).Err, internal.InvalidArgument)
+	mustOK(t, "uploadCommitHandler()", uploadCommitHandler(alice, id, hash))
+
+	if got := readFile(rootOf(t, "alice") + "big.txt"); got != data {
+		t.Errorf("committed file = %q, want %q", got, data)
+	}
+	wantCode(t, "second commit", uploadCommitHandler(alice, id, hash), internal.NotFound)
+}
+
+func TestUploadCommitBadHash(t *testing.T) {
+	setUp(t)
+	alice := signUp(t, "alice")
+
+	ret := uploadBeginHandler(alice, "f.txt", 5, sha256Hex("hello"))
+	mustOK(t, "uploadBeginHandler()", ret.Err)
+	mustOK(t, "chunk", uploadChunkHandler(alice, ret.ID, 0, []byte("jello")).Err)
+	wantCode(t, "commit of a corrupted upload", uploadCommitHandler(alice, ret.ID, sha256Hex("hello")), internal.InvalidArgument)
+
+	// corrupted uploads are dropped, nothing ends up in the root
+	wantCode(t, "status of a corrupted upload", uploadStatusHandler(alice, ret.ID).Err, internal.NotFound)
+	if got := readFile(rootOf(t, "alice") + "f.txt"); got != "" {
+		t.Errorf("f.txt = %q after a failed commit, want no file", got)
+	}
+}
+
+func TestUploadQuotaReservation(t *testing.T) {
+	setUp(t)
+	alice := signUp(t, "alice")
+	err, root := rootForUsername("alice")
+	mustOK(t, "rootForUsername()", err)
+	usage, err1 := getUsage(root)
+	if err1 != nil {
+		t.Fatal(err1)
+	}
+	err1 = setQuota("alice", fmt.Sprint(usage + 1000))
+	if err1 != nil {
+		t.Fatal(err1)
+	}
+
+	// the whole size is reserved when the upload begins
+	first := uploadBeginHandler(alice, "a.txt", 600, sha256Hex(strings.Repeat("a", 600)))
+	mustOK(t, "first uploadBeginHandler()", first.Err)
+	if got := reservedForRoot(root); got != 600 {
+		t.Errorf("reservedForRoot() = %v, want 600", got)
+	}
+	wantCode(t, "second uploadBeginHandler()",
+		uploadBeginHandler(alice, "b.txt", 600, sha256Hex(strings.Repeat("b", 600))).Err, internal.QuotaExceeded)
+	wantCode(t, "uploadHandler() into reserved space",
+		uploadHandler(alice, "c.txt", []byte(strings.Repeat("c", 600))), internal.QuotaExceeded)
+
+	// committing turns the reservation into usage
+	mustOK(t, "chunk", uploadChunkHandler(alice, first.ID, 0, []byte(strings.Repeat("a", 600))).Err)
+	mustOK(t, "commit", uploadCommitHandler(alice, first.ID, sha256Hex(strings.Repeat("a", 600))))
+	if got := reservedForRoot(root); got != 0 {
+		t.Errorf("reservedForRoot() after commit = %v, want 0", got)
+	}
+	if got, _ := getUsage(root); got != usage + 600 {
+		t.Errorf("getUsage() after commit = %v, want %v", got, usage + 600)
+	}
+	wantCode(t, "uploadBeginHandler() past the quota",
+		uploadBeginHandler(alice, "b.txt", 600, sha256Hex(strings.Repeat("b", 600))).Err, internal.QuotaExceeded)
+
+	// a replaced upload gives its reservation back
+	second := uploadBeginHandler(alice, "b.txt", 300, sha256Hex(strings.Repeat("b", 300)))
+	mustOK(t, "small uploadBeginHandler()", second.Err)
+	third := uploadBeginHandler(alice, "b.txt", 400, sha256Hex(strings.Repeat("c", 400)))
+	mustOK(t, "replacing uploadBeginHandler()", third.Err)
+	if third.ID == second.ID {
+		t.Errorf("upload of a different file to b.txt resumed %v", second.ID)
+	}
+	if got := reservedForRoot(root); got != 400 {
+		t.Errorf("reservedForRoot() after replacing = %v, want 400", got)
+	}
+}
+
+func TestUploadExpiry(t *testing.T) {
+	setUp(t)
+	alice := signUp(t, "alice")
+	err, root := rootForUsername("alice")
+	mustOK(t, "rootForUsername()", err)
+
+	old := uploadBeginHandler(alice, "old.txt", 100, sha256Hex(strings.Repeat("o", 100)))
+	mustOK(t, "old uploadBeginHandler()", old.Err)
+	mustOK(t, "old chunk", uploadChunkHandler(alice, old.ID, 0, []byte("o")).Err)
+	fresh := uploadBeginHandler(alice, "fresh.txt", 50, sha256Hex(strings.Repeat("f", 50)))
+	mustOK(t, "fresh uploadBeginHandler()", fresh.Err)
+	db.Exec("UPDATE uploads SET updated = ? WHERE upload_id = ?", time.Now().UTC().UnixNano() - UPLOAD_EXPIRY - 1, old.ID)
+
+	// the sweep purgeUploads runs drops only the upload nobody sent a chunk
+	// for in time, with its staging file and reservation
+	deleteExpiredUploads()
+	wantCode(t, "status of the expired upload", uploadStatusHandler(alice, old.ID).Err, internal.NotFound)
+	if _, err := os.Stat(stagingPath(old.ID)); !os.IsNotExist(err) {
+		t.Errorf("staging file of the expired upload is still there: %v", err)
+	}
+	mustOK(t, "status of the fresh upload", uploadStatusHandler(alice, fresh.ID).Err)
+	if got := reservedForRoot(root); got != 50 {
+		t.Errorf("reservedForRoot() after the sweep = %v, want 50", got)
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"../internal"
+)
+
+// The storage charged to every root is kept in the usage table instead of
+// being measured with du on every check. It counts the bytes of the files in
+// the root, of their old versions and of the root's trash, plus DIR_USAGE for
+// every directory. Every handler that changes any of these updates the row in
+// the same statement or transaction as its other bookkeeping; --recompute-usage
+// measures everything on disk again and fixes rows which have drifted.
+
+const DIR_USAGE = 4096 // in bytes, what a directory is charged
+const USAGE_LARGEST_DIRS = 5 // number of directories listed by the usage rpc
+
+// either *sql.DB or *sql.Tx, so usage can be updated inside a transaction
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+/*
+ * addUsage() - adds to (or with a negative delta, takes from) the usage of a root
+ *
+ * Parameters:
+ * 		- ex: the database or transaction to update the usage in
+ * 		- root: a string representing the name of the root directory
+ * 		- delta: an int64 representing the number of bytes to add
+ * Returns: an error if the usage could not be updated
+ */
+func addUsage(ex execer, root string, delta int64) error {
+	_, err := ex.Exec("UPDATE usage SET bytes = bytes + ? WHERE root = ?", delta, root)
+	return err
+}
+
+/*
+ * getUsage() - gets the number of bytes charged to a root
+ *
+ * Parameters: root: a string representing the name of the root directory
+ * Returns: an int with the usage in bytes, and an error if it could not be read
+ */
+func getUsage(root string) (int, error) {
+	var usage int
+	err := db.QueryRow("SELECT bytes FROM usage WHERE root = ?", root).Scan(&usage)
+	return usage, err
+}
+
+/*
+ * measureUsage() - measures what should be charged to a root from disk
+ *
+ * Parameters: root: a string representing the name of the root directory
+ * Returns: an int64 with the usage in bytes
+ */
+func measureUsage(root string) int64 {
+	usage, _ := walkTree(abs_base_dir + root)
+
+	// versions are single files, the trash holds whole trees
+	for _, dir := range []string{versionsDir(root), trashDir(root)} {
+		if _, err := os.Stat(dir); err != nil {
+			continue
+		}
+		size, _ := walkTree(dir)
+		usage += size - DIR_USAGE
+	}
+	return int64(usage)
+}
+
+/*
+ * recomputeUsage() - measures the usage of roots on disk and stores it
+ *
+ * Parameters: all: a boolean, true to recompute every root and print the roots
+ * 				whose stored usage was off, false to only fill in roots which
+ * 				have no usage yet (i.e. on the first start with the usage table)
+ * Returns: an error if the usage could not be stored
+ */
+func recomputeUsage(all bool) error {
+	rows, err := db.Query("SELECT metadata.username, metadata.root, usage.bytes FROM metadata LEFT JOIN usage ON usage.root = metadata.root")
+	if err != nil {
+		return err
+	}
+	var usernames []string
+	var roots []string
+	var stored []*int64
+	for rows.Next() {
+		var username string
+		var root string
+		var bytes *int64
+		rows.Scan(&username, &root, &bytes)
+		if bytes != nil && !all {
+			continue
+		}
+		usernames = append(usernames, username)
+		roots = append(roots, root)
+		stored = append(stored, bytes)
+	}
+	rows.Close()
+
+	// the roots have to be locked so nothing changes while measuring
+	for i, root := range roots {
+		unlock := lockRoot(root)
+		usage := measureUsage(root)
+		_, err = db.Exec("INSERT OR REPLACE INTO usage (root, bytes) VALUES (?, ?)", root, usage)
+		unlock()
+		if err != nil {
+			return err
+		}
+		if all && (stored[i] == nil || *stored[i] != usage) {
+			old := "none"
+			if stored[i] != nil {
+				old = fmt.Sprint(*stored[i])
+			}
+			fmt.Printf("%v: stored usage %v, on disk %v\n", usernames[i], old, usage)
+		}
+	}
+	return nil
+}
+
+/*
+ * quotaForRoot() - gets the number of bytes that may be charged to a root,
+ * 					the owner's own quota or else config.UserQuota
+ *
+ * Parameters: root: a string representing the name of the root directory
+ * Returns: an int64 with the quota in bytes, and an error if it could not be read
+ */
+func quotaForRoot(root string) (int64, error) {
+	var quota *int64
+	err := db.QueryRow("SELECT quota FROM metadata WHERE root = ?", root).Scan(&quota)
+	if err != nil {
+		return 0, err
+	}
+	if quota == nil {
+		return config.UserQuota, nil
+	}
+	return *quota, nil
+}
+
+/*
+ * setQuota() - sets the quota of a user, for the --set-quota option
+ *
+ * Parameters:
+ * 		- username: a string representing the user's username
+ * 		- quota: a string with the quota in bytes, or "default" to go back
+ * 				to config.UserQuota
+ * Returns: an error if the user does not exist or the quota is invalid
+ */
+func setQuota(username string, quota string) error {
+	username = resolveUsername(username)
+	var value interface{}
+	if quota != "default" {
+		var bytes int64
+		_, err := fmt.Sscan(quota, &bytes)
+		if err != nil || bytes < 0 {
+			return fmt.Errorf("invalid quota %q, must be a number of bytes or \"default\"", quota)
+		}
+		value = bytes
+	}
+	res, err := db.Exec("UPDATE metadata SET quota = ? WHERE username = ?", value, username)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("no such user %q", username)
+	}
+	return nil
+}
+
+/*
+ * largestDirs() - counts the files in a root and finds its largest directories
+ *
+ * Parameters: root: a string representing the name of the root directory
+ * Returns: an int with the number of files, and the USAGE_LARGEST_DIRS largest
+ * 				directories below the root (charged like walkTree() does), largest first
+ */
+func largestDirs(root string) (int, []internal.DirUsage) {
+	base := abs_base_dir + root
+	files := 0
+	sizes := make(map[string]int64)
+	filepath.Walk(base, func(file string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		size := int64(DIR_USAGE)
+		if !fi.IsDir() {
+			files++
+			size = fi.Size()
+		}
+		// charge the entry to every directory it is in, but not the root itself
+		for dir := filepath.Dir(file); strings.HasPrefix(dir, base + "/"); dir = filepath.Dir(dir) {
+			sizes[strings.TrimPrefix(dir, base)] += size
+		}
+		if fi.IsDir() && file != base {
+			sizes[strings.TrimPrefix(file, base)] += size
+		}
+		return nil
+	})
+
+	var dirs []internal.DirUsage
+	for p, size := range sizes {
+		dirs = append(dirs, internal.DirUsage{Path_: p, Size_: size})
+	}
+	sort.Slice(dirs, func(i, j int) bool {
+		if dirs[i].Size_ != dirs[j].Size_ {
+			return dirs[i].Size_ > dirs[j].Size_
+		}
+		return dirs[i].Path_ < dirs[j].Path_
+	})
+	if len(dirs) > USAGE_LARGEST_DIRS {
+		dirs = dirs[:USAGE_LARGEST_DIRS]
+	}
+	return files, dirs
+}
+
+/*
+ * usageHandler() - reports how much of their quota the user has used
+ *
+ * Parameters: cookie: a string representing the user's cookie
+ * Returns: an internal.UsageReturn with error or the usage on success
+ */
+func usageHandler(cookie string) internal.UsageReturn {
+	// authenticate and get root
+	err0, username := authenticateRequest(cookie)
+	if err0.Code != internal.OK {
+		return internal.UsageReturn{Err: err0}
+	}
+	err1, root := rootForUsername(username)
+	if err1.Code != internal.OK {
+		return internal.UsageReturn{Err: err1}
+	}
+
+	// hold the root still so the numbers add up
+	unlock := lockRoot(root)
+	defer unlock()
+
+	var usage internal.Usage
+	used, err := getUsage(root)
+	if err != nil {
+		return internal.UsageReturn{Err: internal.NewError(internal.Internal, "could not get usage")}
+	}
+	usage.Used_ = int64(used)
+	usage.Limit_, err = quotaForRoot(root)
+	if err != nil {
+		return internal.UsageReturn{Err: internal.NewError(internal.Internal, "could not get quota")}
+	}
+	db.QueryRow("SELECT COALESCE(SUM(size), 0) FROM versions WHERE root = ?", root).Scan(&usage.Versions_)
+	db.QueryRow("SELECT COALESCE(SUM(size), 0) FROM trash WHERE root = ?", root).Scan(&usage.Trash_)
+
+	files, largest := largestDirs(root)
+	usage.Files_ = files
+
+	return internal.UsageReturn{Usage: usage, Largest: largest}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"../internal"
+)
+
+// checkUsage checks that the usage stored for a root is what is on disk
+func checkUsage(t *testing.T, what string, root string) int64 {
+	got, err := getUsage(root)
+	if err != nil {
+		t.Fatalf("getUsage() after %v: %v", what, err)
+	}
+	if want := measureUsage(root); int64(got) != want {
+		t.Errorf("getUsage() after %v = %v, %v on disk", what, got, want)
+	}
+	return int64(got)
+}
+
+func TestUsageBookkeeping(t *testing.T) {
+	setUp(t)
+	config.MaxVersions = 2
+	alice := signUp(t, "alice")
+	err, root := rootForUsername("alice")
+	mustOK(t, "rootForUsername()", err)
+	empty := checkUsage(t, "signing up", root)
+
+	// every handler which changes what is stored keeps the usage up to date
+	steps := []struct {
+		what string
+		do   func() internal.Error
+	}{
+		{"mkdir", func() internal.Error { return mkdirHandler(alice, "dir") }},
+		{"upload", func() internal.Error { return uploadHandler(alice, "dir/f.txt", []byte(strings.Repeat("a", 100))) }},
+		{"upload over a file", func() internal.Error { return uploadHandler(alice, "dir/f.txt", []byte(strings.Repeat("b", 50))) }},
+		{"upload past max_versions", func() internal.Error {
+			for i := 0; i < 3; i++ {
+				err := uploadHandler(alice, "dir/f.txt", []byte(strings.Repeat("c", 10 + i)))
+				if err.Code != internal.OK {
+					return err
+				}
+			}
+			return internal.Error{}
+		}},
+		{"restore a version", func() internal.Error {
+			list := listVersionsHandler(alice, "dir/f.txt")
+			if list.Err.Code != internal.OK {
+				return list.Err
+			}
+			return restoreVersionHandler(alice, "dir/f.txt", list.Versions[len(list.Versions) - 1].Version_)
+		}},
+		{"copy", func() internal.Error { return copyHandler(alice, "dir", "copy") }},
+		{"move over a file", func() internal.Error {
+			err := uploadHandler(alice, "g.txt", []byte("g"))
+			if err.Code != internal.OK {
+				return err
+			}
+			return moveHandler(alice, "g.txt", "copy/f.txt")
+		}},
+		{"remove", func() internal.Error { return removeHandler(alice, "dir/f.txt") }},
+		{"remove a tree", func() internal.Error { return removeAllHandler(alice, "copy", false).Err }},
+		{"restore from the trash", func() internal.Error {
+			list := trashListHandler(alice)
+			if list.Err.Code != internal.OK {
+				return list.Err
+			}
+			return trashRestoreHandler(alice, list.Entries[0].ID_, "")
+		}},
+		{"empty the trash", func() internal.Error { return trashEmptyHandler(alice) }},
+		{"commit an upload", func() internal.Error {
+			ret := uploadBeginHandler(alice, "up.txt", 3, sha256Hex("abc"))
+			if ret.Err.Code != internal.OK {
+				return ret.Err
+			}
+			ret = uploadChunkHandler(alice, ret.ID, 0, []byte("abc"))
+			if ret.Err.Code != internal.OK {
+				return ret.Err
+			}
+			return uploadCommitHandler(alice, ret.ID, sha256Hex("abc"))
+		}},
+	}
+	for _, step := range steps {
+		mustOK(t, step.what, step.do())
+		checkUsage(t, step.what, root)
+	}
+	if used := checkUsage(t, "everything", root); used <= empty {
+		t.Errorf("usage of %v is no more than that of an empty root, %v", used, empty)
+	}
+
+	// the usage rpc adds up to the same numbers
+	ret := usageHandler(alice)
+	mustOK(t, "usageHandler()", ret.Err)
+	used, _ := getUsage(root)
+	var versions int64
+	db.QueryRow("SELECT COALESCE(SUM(size), 0) FROM versions WHERE root = ?", root).Scan(&versions)
+	want := internal.Usage{Used_: int64(used), Limit_: config.UserQuota, Files_: 2, Versions_: versions, Trash_: 0}
+	if ret.Usage != want {
+		t.Errorf("usageHandler() = %+v, want %+v", ret.Usage, want)
+	}
+	if versions == 0 {
+		t.Errorf("no versions left to count")
+	}
+	want_largest := []internal.DirUsage{{Path_: "/copy", Size_: DIR_USAGE + 1}, {Path_: "/dir", Size_: DIR_USAGE}}
+	if fmt.Sprint(ret.Largest) != fmt.Sprint(want_largest) {
+		t.Errorf("largest directories = %+v, want %+v", ret.Largest, want_largest)
+	}
+	if err := setQuota("alice", "12345"); err != nil {
+		t.Fatalf("setQuota(): %v", err)
+	}
+	if got := usageHandler(alice).Usage.Limit_; got != 12345 {
+		t.Errorf("limit after setQuota() = %v, want 12345", got)
+	}
+}
+
+func TestRecomputeUsage(t *testing.T) {
+	setUp(t)
+	alice := signUp(t, "alice")
+	signUp(t, "bob")
+	mustOK(t, "upload", uploadHandler(alice, "f.txt", []byte("alice")))
+	roots := make(map[string]string)
+	for _, name := range []string{"alice", "bob"} {
+		err, root := rootForUsername(name)
+		mustOK(t, "rootForUsername()", err)
+		roots[name] = root
+	}
+
+	// only roots without a row are filled in on start
+	db.Exec("UPDATE usage SET bytes = 1 WHERE root = ?", roots["alice"])
+	db.Exec("DELETE FROM usage WHERE root = ?", roots["bob"])
+	if err := recomputeUsage(false); err != nil {
+		t.Fatalf("recomputeUsage(false): %v", err)
+	}
+	if got, _ := getUsage(roots["alice"]); got != 1 {
+		t.Errorf("getUsage() of alice after recomputeUsage(false) = %v, want the drifted 1", got)
+	}
+	checkUsage(t, "recomputeUsage(false)", roots["bob"])
+
+	// --recompute-usage fixes every root
+	if err := recomputeUsage(true); err != nil {
+		t.Fatalf("recomputeUsage(true): %v", err)
+	}
+	for name, root := range roots {
+		checkUsage(t, fmt.Sprintf("recomputeUsage(true) of %v", name), root)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+
+	"../internal"
+)
+
+// signupHandler only takes usernames of USERNAME_MIN_LENGTH to
+// USERNAME_MAX_LENGTH letters, digits, combining marks and ".", "_" or "-",
+// starting with a letter or digit, and stores them in Unicode NFC. Names which
+// only differ in case or Unicode form belong to the same user: u_p.username_key
+// holds every username NFKC normalized and case folded, and any username a user
+// types (to log in, to share, in a "~<owner>/" path or in an admin command) is
+// looked up by its key, so "Alice" logs in as "alice".
+//
+// Accounts from before this may break the rules, and some may have the same key
+// (migration 16 and --fsck report those). They keep working: a key shared by
+// several users only finds the one whose name was typed exactly.
+
+const USERNAME_MIN_LENGTH = 3 // shortest username, in characters
+const USERNAME_MAX_LENGTH = 32 // longest username, in characters
+
+/*
+ * usernameKey() - gets the form of a username that decides which user it is
+ *
+ * Parameters: name: a string representing the username as typed
+ * Returns: a string with the name NFKC normalized and case folded
+ */
+func usernameKey(name string) string {
+	return cases.Fold().String(norm.NFKC.String(name))
+}
+
+/*
+ * canonicalUsername() - checks that a new username is allowed, and puts it in
+ * 						the form it is stored in
+ *
+ * Parameters: name: a string representing the username as typed
+ * Returns: the NFC normalized username, and an internal.Error with code OK if
+ * 				it is allowed, InvalidArgument if not
+ */
+func canonicalUsername(name string) (string, internal.Error) {
+	name = norm.NFC.String(name)
+	bad := internal.NewError(internal.InvalidArgument, fmt.Sprintf("username must be %v to %v letters, digits, '.', '_' or '-', starting with a letter or digit", USERNAME_MIN_LENGTH, USERNAME_MAX_LENGTH))
+
+	length := utf8.RuneCountInString(name)
+	if length < USERNAME_MIN_LENGTH || length > USERNAME_MAX_LENGTH {
+		return "", bad
+	}
+	for i, r := range name {
+		switch {
+		case unicode.IsLetter(r), unicode.IsDigit(r):
+		case i > 0 && (unicode.IsMark(r) || strings.ContainsRune("._-", r)):
+		default:
+			return "", bad
+		}
+	}
+	return name, internal.Error{}
+}
+
+/*
+ * lookupUsername() - finds the user a typed username belongs to
+ *
+ * Parameters: name: a string representing the username as typed
+ * Returns: a string with the username as stored, and a boolean, false if there
+ * 				is no such user
+ */
+func lookupUsername(name string) (string, bool) {
+	rows, err := db.Query("SELECT username FROM u_p WHERE username_key = ?", usernameKey(name))
+	if err != nil {
+		return "", false
+	}
+	var matches []string
+	for rows.Next() {
+		var username string
+		rows.Scan(&username)
+		matches = append(matches, username)
+	}
+	rows.Close()
+
+	if len(matches) == 1 {
+		return matches[0], true
+	}
+	// users from before usernames were canonical can share a key
+	for _, username := range matches {
+		if username == name {
+			return username, true
+		}
+	}
+	return "", false
+}
+
+/*
+ * resolveUsername() - gets the stored form of a typed username, to use in
+ * 					queries by username
+ *
+ * Parameters: name: a string representing the username as typed
+ * Returns: a string with the username as stored, or as typed if there is no
+ * 				such user (so queries with it find nothing)
+ */
+func resolveUsername(name string) string {
+	if username, ok := lookupUsername(name); ok {
+		return username
+	}
+	return name
+}
+
+/*
+ * usernameCollisions() - groups usernames which belong to the same user by
+ * 						their keys
+ *
+ * Parameters: usernames: the usernames to check
+ * Returns: a list with each group of two or more usernames sharing a key,
+ * 				sorted
+ */
+func usernameCollisions(usernames []string) [][]string {
+	by_key := make(map[string][]string)
+	for _, username := range usernames {
+		key := usernameKey(username)
+		by_key[key] = append(by_key[key], username)
+	}
+	var collisions [][]string
+	for _, group := range by_key {
+		if len(group) > 1 {
+			sort.Strings(group)
+			collisions = append(collisions, group)
+		}
+	}
+	sort.Slice(collisions, func(i, j int) bool { return collisions[i][0] < collisions[j][0] })
+	return collisions
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"../internal"
+)
+
+func TestCanonicalUsername(t *testing.T) {
+	tests := []struct {
+		name string
+		want string // "" if the name is refused
+	}{
+		{"alice", "alice"},
+		{"Alice_99", "Alice_99"},
+		{"j.doe-2", "j.doe-2"},
+		{"zoë", "zoë"},
+		{"zoe\u0308", "zoë"}, // decomposed, stored composed
+		{"日本語", "日本語"},
+		{"", ""},
+		{"al", ""},
+		{strings.Repeat("a", USERNAME_MAX_LENGTH + 1), ""},
+		{"al ice", ""},
+		{"alice\n", ""},
+		{"al\x00ice", ""},
+		{"_alice", ""},
+		{"a/b/c", ""},
+		{"~alice", ""},
+	}
+	for _, test := range tests {
+		got, err := canonicalUsername(test.name)
+		if test.want == "" {
+			if err.Code != internal.InvalidArgument {
+				t.Errorf("canonicalUsername(%q) = %q, %v, want InvalidArgument", test.name, got, err)
+			}
+			continue
+		}
+		if err.Code != internal.OK || got != test.want {
+			t.Errorf("canonicalUsername(%q) = %q, %v, want %q", test.name, got, err, test.want)
+		}
+	}
+}
+
+func TestUsernameKey(t *testing.T) {
+	same := [][]string{
+		{"alice", "Alice", "ALICE", "ａｌｉｃｅ"},
+		{"zoë", "ZOË", "zoe\u0308"},
+		{"strasse", "STRASSE", "straße"},
+	}
+	for _, names := range same {
+		for _, name := range names[1:] {
+			if usernameKey(name) != usernameKey(names[0]) {
+				t.Errorf("usernameKey(%q) = %q, want %q like %q", name, usernameKey(name), usernameKey(names[0]), names[0])
+			}
+		}
+	}
+	if usernameKey("alice") == usernameKey("alice2") {
+		t.Errorf("usernameKey() is the same for different names")
+	}
+}
+
+func TestUsernameCollisions(t *testing.T) {
+	got := usernameCollisions([]string{"bob", "alice", "Bob", "carol", "ALICE", "Alice"})
+	want := [][]string{{"ALICE", "Alice", "alice"}, {"Bob", "bob"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("usernameCollisions() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"../internal"
+)
+
+// Files are never overwritten in place: the new contents are written to a
+// staging file which replaceFile() renames over the old one, after hard linking
+// the old one into the root's versions directory. The last config.MaxVersions
+// old versions of every file are kept there (and charged to the root's quota),
+// and can be listed and restored by anyone who can read or write the file. The
+// versions of a removed file go to the trash with it, see trash.go.
+
+const VERSIONS_DIR = "versions/" // old versions of files, under abs_base_dir, one directory per root
+
+/*
+ * versionsDir() - gets the directory the old versions of a root's files are kept in
+ *
+ * Parameters: root: a string representing the name of the root directory
+ * Returns: a string with the full path to the directory, ending in "/"
+ */
+func versionsDir(root string) string {
+	return abs_base_dir + VERSIONS_DIR + root + "/"
+}
+
+/*
+ * deleteVersionsWhere() - deletes every version matching a condition on the
+ * 						versions table, along with their files
+ *
+ * Parameters:
+ * 		- condition: a string with the WHERE clause
+ * 		- args: the arguments for the WHERE clause
+ * Returns: nothing
+ */
+func deleteVersionsWhere(condition string, args ...interface{}) {
+	statement, _ := db.Prepare("SELECT version_id, root, size FROM versions WHERE " + condition)
+	rows, err := statement.Query(args...)
+	if err != nil {
+		return
+	}
+	var ids []string
+	var roots []string
+	var sizes []int64
+	for rows.Next() {
+		var id string
+		var root string
+		var size int64
+		rows.Scan(&id, &root, &size)
+		ids = append(ids, id)
+		roots = append(roots, root)
+		sizes = append(sizes, size)
+	}
+	rows.Close()
+
+	for i, id := range ids {
+		tx, err := db.Begin()
+		if err != nil {
+			return
+		}
+		tx.Exec("DELETE FROM versions WHERE version_id = ?", id)
+		addUsage(tx, roots[i], -sizes[i])
+		if tx.Commit() == nil {
+			os.Remove(versionsDir(roots[i]) + id)
+		}
+	}
+}
+
+/*
+ * moveVersions() - points the old versions of a file, or of everything in a
+ * 					directory, at another path
+ *
+ * Parameters:
+ * 		- ex: the database or transaction to update them in
+ * 		- root: a string representing the name of the root directory
+ * 		- from: a string representing the path they are kept under now
+ * 		- to: a string representing the path to keep them under
+ * Returns: an error if they could not be updated
+ */
+func moveVersions(ex execer, root string, from string, to string) error {
+	// sqlite counts characters, not bytes
+	n := utf8.RuneCountInString(from)
+	_, err := ex.Exec("UPDATE versions SET path = ? || substr(path, ?) WHERE root = ? AND (path = ? OR substr(path, 1, ?) = ?)", to, n + 1, root, from, n + 1, from + "/")
+	return err
+}
+
+/*
+ * saveVersion() - keeps the current contents of a file as its newest old
+ * 					version, and drops its versions past config.MaxVersions
+ *
+ * Parameters: full_path: a string representing the full path to the file
+ * Returns: an error if the version could not be saved (there being no file
+ * 				at the path is not an error)
+ */
+func saveVersion(full_path string) error {
+	fi, err := os.Stat(full_path)
+	if err != nil || !fi.Mode().IsRegular() {
+		return nil
+	}
+	root := rootForPath(full_path)
+	rel := strings.TrimPrefix(full_path, abs_base_dir + root)
+
+	id, err := newToken(TOKEN_VERSION)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(versionsDir(root), 0775)
+	if err != nil {
+		return err
+	}
+
+	// the file is about to be replaced (never written to), so linking is enough
+	err = os.Link(full_path, versionsDir(root) + id)
+	if err != nil {
+		return err
+	}
+
+	// the version is charged to the root like any other file
+	tx, err := db.Begin()
+	if err == nil {
+		_, err = tx.Exec("INSERT INTO versions (version_id, root, path, version, size, mod_time, saved) SELECT ?, ?, ?, COALESCE(MAX(version), 0) + 1, ?, ?, ? FROM versions WHERE root = ? AND path = ?",
+			id, root, rel, fi.Size(), fi.ModTime().UnixNano(), time.Now().UTC().UnixNano(), root, rel)
+		if err == nil {
+			err = addUsage(tx, root, fi.Size())
+		}
+		if err == nil {
+			err = tx.Commit()
+		} else {
+			tx.Rollback()
+		}
+	}
+	if err != nil {
+		os.Remove(versionsDir(root) + id)
+		return err
+	}
+
+	deleteVersionsWhere("version_id IN (SELECT version_id FROM versions WHERE root = ? AND path = ? ORDER BY version DESC LIMIT -1 OFFSET ?)", root, rel, config.MaxVersions)
+	return nil
+}
+
+/*
+ * replaceFile() - moves a new file into place, keeping the one it replaces as
+ * 					an old version, the root has to be locked by the caller
+ *
+ * Parameters:
+ * 		- tmp_path: a string representing the full path to the new file, which
+ * 				has to be on the same file system (i.e. under abs_base_dir)
+ * 		- full_path: a string representing the full path to replace
+ *
+ * Returns: an internal.Error, with code OK upon success
+ */
+func replaceFile(tmp_path string, full_path string) internal.Error {
+	fi, err := os.Stat(tmp_path)
+	if err != nil {
+		return internal.NewError(internal.Internal, "could not read new file")
+	}
+	var old_size int64
+	if old, err := os.Stat(full_path); err == nil {
+		old_size = old.Size()
+	}
+
+	err = saveVersion(full_path)
+	if err != nil {
+		return internal.NewError(internal.Internal, "could not keep old version of file")
+	}
+
+	// renaming is atomic, the file is either the old or the new one
+	err = os.Rename(tmp_path, full_path)
+	if err != nil {
+		return internal.NewError(internal.NotFound, "could not move file into place")
+	}
+	addUsage(db, rootForPath(full_path), fi.Size() - old_size)
+	return internal.Error{}
+}
+
+/*
+ * listVersionsHandler() - lists the old versions kept of a file, newest first
+ *
+ * Parameters:
+ * 		- cookie: a string representing the user's cookie
+ * 		- path: a string representing the user-inputted path of the file
+ *
+ * Returns: an internal.VersionsReturn with error or the versions on success
+ */
+func listVersionsHandler(cookie string, path string) internal.VersionsReturn {
+	// perform checks to validate user and action
+	err0, path := performChecks(cookie, path, ACCESS_READ)
+	if err0.Code != internal.OK {
+		return internal.VersionsReturn{Err: err0}
+	}
+	root := rootForPath(path)
+	rel := strings.TrimPrefix(path, abs_base_dir + root)
+
+	statement, _ := db.Prepare("SELECT version_id, version, size, mod_time, saved FROM versions WHERE root = ? AND path = ? ORDER BY version DESC")
+	rows, err := statement.Query(root, rel)
+	if err != nil {
+		return internal.VersionsReturn{Err: internal.NewError(internal.Internal, "could not list versions")}
+	}
+	var versions []internal.Version
+	for rows.Next() {
+		var id string
+		var version internal.Version
+		rows.Scan(&id, &version.Version_, &version.Size_, &version.ModTime_, &version.Saved_)
+		version.Hash_, _ = hashFile(versionsDir(root) + id)
+		versions = append(versions, version)
+	}
+	rows.Close()
+
+	if len(versions) == 0 {
+		if _, err := os.Stat(path); err != nil {
+			return internal.VersionsReturn{Err: internal.NewError(internal.NotFound, "could not find file at specified path")}
+		}
+	}
+	return internal.VersionsReturn{Versions: versions}
+}
+
+/*
+ * restoreVersionHandler() - replaces a file with one of its old versions, the
+ * 						contents being replaced are kept as a new version
+ *
+ * Parameters:
+ * 		- cookie: a string representing the user's cookie
+ * 		- path: a string representing the user-inputted path of the file
+ * 		- version: an int representing the version number as listed by
+ * 				list_versions
+ *
+ * Returns: an internal.Error, with code OK upon success
+ */
+func restoreVersionHandler(cookie string, path string, version int) internal.Error {
+	// perform checks to validate user and action
+	err0, path := performChecks(cookie, path, ACCESS_WRITE)
+	if err0.Code != internal.OK {
+		return err0
+	}
+	root := rootForPath(path)
+	rel := strings.TrimPrefix(path, abs_base_dir + root)
+
+	unlock := lockRoot(root)
+	defer unlock()
+
+	statement, _ := db.Prepare("SELECT version_id, size FROM versions WHERE root = ? AND path = ? AND version = ?")
+	rows, err := statement.Query(root, rel, version)
+	if err != nil {
+		return internal.NewError(internal.Internal, "could not restore version")
+	}
+	var id string
+	var size int
+	found := rows.Next()
+	if found {
+		rows.Scan(&id, &size)
+	}
+	rows.Close()
+	if !found {
+		return internal.NewError(internal.NotFound, "no such version of this file")
+	}
+
+	// the restored copy is new data, the version itself stays in the history
+	str := checkSizeName(size, path)
+	if str.Code != internal.OK {
+		return str
+	}
+	src, err := os.Open(versionsDir(root) + id)
+	if err != nil {
+		return internal.NewError(internal.Internal, "could not read version")
+	}
+	defer src.Close()
+	tmp, err := ioutil.TempFile(abs_base_dir + UPLOAD_DIR, "restore")
+	if err != nil {
+		return internal.NewError(internal.Internal, "could not restore version")
+	}
+	_, err = io.Copy(tmp, src)
+	tmp.Close()
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0664)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return internal.NewError(internal.Internal, "could not restore version")
+	}
+
+	str = replaceFile(tmp.Name(), path)
+	if str.Code != internal.OK {
+		os.Remove(tmp.Name())
+	}
+	return str
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"testing"
+
+	"../internal"
+)
+
+// countVersions gets the number of old versions listed for a file
+func countVersions(t *testing.T, cookie string, p string) int {
+	ret := listVersionsHandler(cookie, p)
+	mustOK(t, "listVersionsHandler()", ret.Err)
+	return len(ret.Versions)
+}
+
+func TestVersionsPruning(t *testing.T) {
+	setUp(t)
+	alice := signUp(t, "alice")
+	err, root := rootForUsername("alice")
+	mustOK(t, "rootForUsername()", err)
+
+	wantCode(t, "versions of a missing file", listVersionsHandler(alice, "f.txt").Err, internal.NotFound)
+
+	// every upload after the first keeps what it replaced
+	config.MaxVersions = 3
+	for i := 0; i < config.MaxVersions + 3; i++ {
+		mustOK(t, fmt.Sprintf("upload %v", i), uploadHandler(alice, "f.txt", []byte(fmt.Sprintf("v%v", i))))
+	}
+
+	ret := listVersionsHandler(alice, "f.txt")
+	mustOK(t, "listVersionsHandler()", ret.Err)
+	if len(ret.Versions) != config.MaxVersions {
+		t.Fatalf("%v versions kept, want %v", len(ret.Versions), config.MaxVersions)
+	}
+	for i, v := range ret.Versions {
+		// newest first: version 5 holds v4, down to version 3 holding v2
+		want := config.MaxVersions + 2 - i
+		if v.Version_ != want || v.Hash_ != sha256Hex(fmt.Sprintf("v%v", want - 1)) || v.Size_ != 2 {
+			t.Errorf("version %v = %v, want version %v of %q", i, v, want, fmt.Sprintf("v%v", want - 1))
+		}
+	}
+
+	// pruned versions are gone from disk and from the usage
+	files, _ := ioutil.ReadDir(versionsDir(root))
+	if len(files) != config.MaxVersions {
+		t.Errorf("%v files in the versions directory, want %v", len(files), config.MaxVersions)
+	}
+	if usage, _ := getUsage(root); int64(usage) != measureUsage(root) {
+		t.Errorf("getUsage() = %v, measureUsage() = %v", usage, measureUsage(root))
+	}
+}
+
+func TestVersionsRestore(t *testing.T) {
+	setUp(t)
+	alice := signUp(t, "alice")
+	bob := signUp(t, "bob")
+	err, root := rootForUsername("alice")
+	mustOK(t, "rootForUsername()", err)
+
+	mustOK(t, "upload old", uploadHandler(alice, "f.txt", []byte("old")))
+	mustOK(t, "upload new", uploadHandler(alice, "f.txt", []byte("newer")))
+
+	wantCode(t, "restore of a missing version", restoreVersionHandler(alice, "f.txt", 2), internal.NotFound)
+	mustOK(t, "share f.txt", shareHandler(alice, "f.txt", "bob", false))
+	wantCode(t, "restore through a read-only share", restoreVersionHandler(bob, "~alice/f.txt", 1), internal.PermissionDenied)
+	if got := countVersions(t, bob, "~alice/f.txt"); got != 1 {
+		t.Errorf("%v versions through a read-only share, want 1", got)
+	}
+
+	// the restored version stays, what it replaced becomes the next version
+	mustOK(t, "restoreVersionHandler()", restoreVersionHandler(alice, "f.txt", 1))
+	if got := readFile(rootOf(t, "alice") + "f.txt"); got != "old" {
+		t.Errorf("f.txt = %q after restore, want %q", got, "old")
+	}
+	ret := listVersionsHandler(alice, "f.txt")
+	mustOK(t, "listVersionsHandler()", ret.Err)
+	if len(ret.Versions) != 2 || ret.Versions[0].Version_ != 2 || ret.Versions[0].Hash_ != sha256Hex("newer") ||
+		ret.Versions[1].Version_ != 1 || ret.Versions[1].Hash_ != sha256Hex("old") {
+		t.Errorf("versions after restore = %v, want 2 (newer) and 1 (old)", ret.Versions)
+	}
+	if usage, _ := getUsage(root); int64(usage) != measureUsage(root) {
+		t.Errorf("getUsage() = %v, measureUsage() = %v", usage, measureUsage(root))
+	}
+
+	// versions follow a file to the trash and back
+	mustOK(t, "remove f.txt", removeHandler(alice, "f.txt"))
+	wantCode(t, "versions of a removed file", listVersionsHandler(alice, "f.txt").Err, internal.NotFound)
+	list := trashListHandler(alice)
+	mustOK(t, "trashListHandler()", list.Err)
+	if len(list.Entries) != 1 {
+		t.Fatalf("%v entries in the trash, want 1", len(list.Entries))
+	}
+	mustOK(t, "trashRestoreHandler()", trashRestoreHandler(alice, list.Entries[0].ID_, ""))
+	if got := countVersions(t, alice, "f.txt"); got != 2 {
+		t.Errorf("%v versions after restoring from the trash, want 2", got)
+	}
+}